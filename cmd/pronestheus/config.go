@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const configFileFlag = "config.file"
+
+// secretFlags are the flags whose values can be read from the files given by their environment variables with the
+// _FILE suffix, such as Docker and Kubernetes secrets. The --nest-project tuples contain a client secret and a
+// refresh token too.
+var secretFlags = []string{
+	"nest-client-secret",
+	"nest-refresh-token",
+	"nest-project",
+	"nest-google-auth-cookies",
+	"nest-google-master-token",
+	"owm-auth",
+	"weatherapi-key",
+}
+
+// configFile returns the path of the configuration file given by the command line or the environment, if any.
+func configFile(app *kingpin.Application, args []string) string {
+	if context, err := app.ParseContext(args); err == nil {
+		for _, element := range context.Elements {
+			if flag, ok := element.Clause.(*kingpin.FlagClause); ok && flag.Model().Name == configFileFlag && element.Value != nil {
+				return *element.Value
+			}
+		}
+	}
+	return os.Getenv("PRONESTHEUS_CONFIG_FILE")
+}
+
+// loadConfigFile sets the defaults of the flags of the application to the values in the given YAML file, which maps
+// flag names without the leading dashes to their values, or lists of values for repeatable flags. Flags given on the
+// command line or in the environment still take precedence over the file.
+func loadConfigFile(app *kingpin.Application, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed reading config file: %v", err)
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return fmt.Errorf("failed parsing config file %s: %v", path, err)
+	}
+
+	// Sorted, so that the first unknown flag is always the one reported.
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		flag := app.GetFlag(name)
+		if flag == nil || name == configFileFlag {
+			return fmt.Errorf("unknown flag %q in config file %s", name, path)
+		}
+
+		switch value := values[name].(type) {
+		case []interface{}:
+			defaults := make([]string, 0, len(value))
+			for _, v := range value {
+				defaults = append(defaults, fmt.Sprint(v))
+			}
+			flag.Default(defaults...)
+		case nil:
+		default:
+			flag.Default(fmt.Sprint(value))
+		}
+	}
+	return nil
+}
+
+// loadSecretFiles sets the defaults of the secret flags to the contents of the files given by their environment
+// variables with the _FILE suffix, e.g. PRONESTHEUS_OWM_AUTH_FILE for --owm-auth, without the trailing newline.
+// Repeatable flags take one value per line of the file, like their environment variables. The flags and their plain
+// environment variables still take precedence over the files.
+func loadSecretFiles(app *kingpin.Application) error {
+	for _, name := range secretFlags {
+		flag := app.GetFlag(name)
+		if flag == nil {
+			continue
+		}
+		envar := "PRONESTHEUS_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name)) + "_FILE"
+		path := os.Getenv(envar)
+		if path == "" {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed reading %s: %v", envar, err)
+		}
+		value := strings.TrimRight(string(content), "\r\n")
+		if repeatable, ok := flag.Model().Value.(interface{ IsCumulative() bool }); ok && repeatable.IsCumulative() {
+			var values []string
+			for _, line := range strings.Split(value, "\n") {
+				if line = strings.TrimRight(line, "\r"); line != "" {
+					values = append(values, line)
+				}
+			}
+			flag.Default(values...)
+			continue
+		}
+		flag.Default(value)
+	}
+	return nil
+}
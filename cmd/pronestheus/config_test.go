@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pronestheus.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+listen-addr: ":9999"
+scrape-timeout: 1000
+nest-label: [id, room]
+metric-timestamps: true
+`), 0600))
+
+	tests := []struct {
+		name        string
+		args        []string
+		wantAddr    string
+		wantTimeout int
+	}{
+		{
+			name:        "file",
+			args:        []string{"--config.file", path},
+			wantAddr:    ":9999",
+			wantTimeout: 1000,
+		}, {
+			name:        "flag overrides file",
+			args:        []string{"--config.file=" + path, "--listen-addr=:8888"},
+			wantAddr:    ":8888",
+			wantTimeout: 1000,
+		}, {
+			name:        "no file",
+			args:        []string{},
+			wantAddr:    ":9777",
+			wantTimeout: 5000,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := kingpin.New("pronestheus", "")
+			app.Flag(configFileFlag, "").String()
+			addr := app.Flag("listen-addr", "").Default(":9777").String()
+			timeout := app.Flag("scrape-timeout", "").Default("5000").Int()
+			labels := app.Flag("nest-label", "").Strings()
+			timestamps := app.Flag("metric-timestamps", "").Bool()
+
+			if path := configFile(app, test.args); path != "" {
+				assert.NoError(t, loadConfigFile(app, path))
+			}
+			_, err := app.Parse(test.args)
+			assert.NoError(t, err)
+			assert.Equal(t, test.wantAddr, *addr)
+			assert.Equal(t, test.wantTimeout, *timeout)
+			if len(test.args) > 0 {
+				assert.Equal(t, []string{"id", "room"}, *labels)
+				assert.True(t, *timestamps)
+			}
+		})
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pronestheus.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("listen-addr: \":9999\"\nnest-label: [id]\n"), 0600))
+	t.Setenv("PRONESTHEUS_CONFIG_FILE", path)
+	t.Setenv("PRONESTHEUS_LISTEN_ADDR", ":7777")
+	t.Setenv("PRONESTHEUS_NEST_LABEL", "room\nlabel")
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantAddr string
+	}{
+		{
+			name:     "environment overrides file",
+			wantAddr: ":7777",
+		}, {
+			name:     "flag overrides environment",
+			args:     []string{"--listen-addr=:8888"},
+			wantAddr: ":8888",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := kingpin.New("pronestheus", "").DefaultEnvars()
+			app.Flag(configFileFlag, "").String()
+			addr := app.Flag("listen-addr", "").Default(":9777").String()
+			labels := app.Flag("nest-label", "").Strings()
+
+			assert.Equal(t, path, configFile(app, test.args))
+			assert.NoError(t, loadConfigFile(app, path))
+			_, err := app.Parse(test.args)
+			assert.NoError(t, err)
+			assert.Equal(t, test.wantAddr, *addr)
+			assert.Equal(t, []string{"room", "label"}, *labels)
+		})
+	}
+}
+
+func TestLoadConfigFileUnknownFlag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pronestheus.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("nest-tokn: xxx\n"), 0600))
+
+	app := kingpin.New("pronestheus", "")
+	app.Flag("nest-token", "").String()
+	assert.Error(t, loadConfigFile(app, path))
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	config, secret := filepath.Join(dir, "pronestheus.yml"), filepath.Join(dir, "owm_auth")
+	assert.NoError(t, ioutil.WriteFile(config, []byte("owm-auth: from-config\nnest-refresh-token: from-config\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(secret, []byte("from-file\n"), 0600))
+	t.Setenv("PRONESTHEUS_OWM_AUTH_FILE", secret)
+	t.Setenv("PRONESTHEUS_NEST_REFRESH_TOKEN_FILE", secret)
+	t.Setenv("PRONESTHEUS_NEST_REFRESH_TOKEN", "from-env")
+
+	app := kingpin.New("pronestheus", "").DefaultEnvars()
+	owmAuth := app.Flag("owm-auth", "").String()
+	refreshToken := app.Flag("nest-refresh-token", "").String()
+
+	assert.NoError(t, loadConfigFile(app, config))
+	assert.NoError(t, loadSecretFiles(app))
+	_, err := app.Parse(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", *owmAuth)
+	assert.Equal(t, "from-env", *refreshToken)
+
+	t.Setenv("PRONESTHEUS_OWM_AUTH_FILE", filepath.Join(dir, "missing"))
+	assert.Error(t, loadSecretFiles(app))
+}
+
+func TestLoadSecretFilesRepeatable(t *testing.T) {
+	projects := filepath.Join(t.TempDir(), "nest_projects")
+	assert.NoError(t, ioutil.WriteFile(projects, []byte("P1,C1,S1,R1\r\nP2,C2,S2,R2\n"), 0600))
+	t.Setenv("PRONESTHEUS_NEST_PROJECT_FILE", projects)
+
+	app := kingpin.New("pronestheus", "").DefaultEnvars()
+	nestProjects := app.Flag("nest-project", "").Strings()
+
+	assert.NoError(t, loadSecretFiles(app))
+	_, err := app.Parse(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"P1,C1,S1,R1", "P2,C2,S2,R2"}, *nestProjects)
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"pronestheus/pkg"
+	// The Docker image has no time zone database, which is needed for the schedules of the Nest app API.
+	_ "time/tzdata"
 
 	"github.com/alecthomas/kingpin/v2"
 )
@@ -15,39 +17,116 @@ var (
 	date    string
 )
 
-var cfg = &pkg.ExporterConfig{
-	ListenAddr:            kingpin.Flag("listen-addr", "Address on which to expose metrics and web interface.").Default(":9777").String(),
-	MetricsPath:           kingpin.Flag("metrics-path", "Path under which to expose metrics.").Default("/metrics").String(),
-	Timeout:               kingpin.Flag("scrape-timeout", "Time to wait for remote APIs to response, in milliseconds.").Default("5000").Int(),
-	NestURL:               kingpin.Flag("nest-url", "Nest API URL.").Default("https://smartdevicemanagement.googleapis.com/v1/").String(),
-	NestOAuthClientID:     kingpin.Flag("nest-client-id", "OAuth2 Client ID").String(),
-	NestOAuthClientSecret: kingpin.Flag("nest-client-secret", "OAuth2 Client Secret.").String(),
-	NestProjectID:         kingpin.Flag("nest-project-id", "Device Access Project ID.").String(),
-	NestRefreshToken:      kingpin.Flag("nest-refresh-token", "Refresh token").String(),
-	NestGoogleAuthURL:     kingpin.Flag("nest-google-auth-url", "Google auth URL for access to the Nest app. Optional: only needed for scraping Nest Temperature Sensors and the outside temperatures reported by the Nest App.").String(),
-	NestGoogleAuthCookies: kingpin.Flag("nest-google-auth-cookies", "Cookies for the Google auth URL for access to the Nest app. Optional: only needed for scraping Nest Temperature Sensors and the outside temperatures reported by the Nest App.").String(),
-	NestLabelSpaceToDash:  kingpin.Flag("nest-label-spaces-to-dashes", "Replace spaces with dashes in Nest thermostat label").Bool(),
-	WeatherURL:            kingpin.Flag("owm-url", "The OpenWeatherMap API URL.").Default("http://api.openweathermap.org/data/2.5/weather").String(),
-	WeatherToken:          kingpin.Flag("owm-auth", "The authorization token for OpenWeatherMap API.").String(),
-	WeatherLocation:       kingpin.Flag("owm-location", "The location ID for OpenWeatherMap API. Defaults to Amsterdam.").Default("2759794").String(),
+// newConfig defines the flags of the application and returns the configuration they're parsed into.
+func newConfig(app *kingpin.Application) *pkg.ExporterConfig {
+	return &pkg.ExporterConfig{
+		ListenAddr:            app.Flag("listen-addr", "Address on which to expose metrics and web interface, or a Unix domain socket such as unix:///run/pronestheus.sock.").Default(":9777").String(),
+		ListenSocketMode:      app.Flag("listen-socket-mode", "Permissions of the Unix domain socket of --listen-addr, in octal.").Default("0660").String(),
+		MetricsPath:           app.Flag("metrics-path", "Path under which to expose metrics.").Default("/metrics").String(),
+		WebConfigFile:         app.Flag("web.config.file", "Path to the web config file, which can enable TLS and basic authentication.").Default("").String(),
+		Timeout:               app.Flag("scrape-timeout", "Time to wait for remote APIs to response, in milliseconds. The default of the timeouts of the Nest API, the Nest app API and the weather API.").Default("5000").Int(),
+		TemperatureUnit:       app.Flag("temperature-unit", "Unit of the exported temperatures: celsius or fahrenheit.").Default("celsius").Enum("celsius", "fahrenheit"),
+		GoMetrics:             app.Flag("go-metrics", "Export the go_* metrics of the Go runtime of ProNestheus.").Default("true").Bool(),
+		ProcessMetrics:        app.Flag("process-metrics", "Export the process_* metrics of the ProNestheus process.").Default("true").Bool(),
+		MetricPrefix:          app.Flag("metric-prefix", "Prefix prepended to the names of all Nest and weather metrics, such as home_ for home_nest_up.").Default("").String(),
+		ConstLabels:           app.Flag("const-label", "Label added to all metrics, in the form <name>=<value>, such as house=main. Can be repeated.").Strings(),
+		MetricTimestamps:      app.Flag("metric-timestamps", "Export metrics with the timestamps of the upstream data, such as the time of the weather observation or of the last Temperature Sensor update, where available.").Bool(),
+		NestURL:               app.Flag("nest-url", "Nest API URL.").Default("https://smartdevicemanagement.googleapis.com/v1/").String(),
+		NestTimeout:           app.Flag("nest-timeout", "Time to wait for the Nest API to respond, in milliseconds. Default: --scrape-timeout.").Int(),
+		NestOAuthClientID:     app.Flag("nest-client-id", "OAuth2 Client ID").String(),
+		NestOAuthClientSecret: app.Flag("nest-client-secret", "OAuth2 Client Secret.").String(),
+		NestProjectID:         app.Flag("nest-project-id", "Device Access Project ID.").String(),
+		NestRefreshToken:      app.Flag("nest-refresh-token", "Refresh token").String(),
+		NestProjects:          app.Flag("nest-project", "Additional Device Access project, in the form PROJECT_ID,CLIENT_ID,CLIENT_SECRET,REFRESH_TOKEN. Can be repeated. Metrics get a project label when this is set.").Strings(),
+		NestGoogleAuthURL:     app.Flag("nest-google-auth-url", "Google auth URL for access to the Nest app. Optional: only needed for scraping Nest Temperature Sensors and the outside temperatures reported by the Nest App.").String(),
+		NestGoogleAuthCookies: app.Flag("nest-google-auth-cookies", "Cookies for the Google auth URL for access to the Nest app. Optional: only needed for scraping Nest Temperature Sensors and the outside temperatures reported by the Nest App.").String(),
+		NestGoogleCookiesFile: app.Flag("nest-google-auth-cookies-file", "File with the cookies for the Google auth URL for access to the Nest app, instead of --nest-google-auth-cookies. Re-read whenever the Nest app access token is renewed.").String(),
+		NestGoogleMasterToken: app.Flag("nest-google-master-token", "Google master token for access to the Nest app, instead of the Google auth URL and cookies.").String(),
+		NestGoogleEmail:       app.Flag("nest-google-email", "Email of the Google Account of --nest-google-master-token.").String(),
+		NestGoogleAndroidID:   app.Flag("nest-google-android-id", "Android device ID which --nest-google-master-token was issued for. Default: a fixed ID.").String(),
+		NestAppAPIHost:        app.Flag("nest-app-api-host", "Host of the API used by the Nest app. home.ft.nest.com for field-test accounts.").Default("home.nest.com").String(),
+		NestAppAuthPolicy:     app.Flag("nest-app-auth-policy", "Policy of the access token for the API used by the Nest app, matching --nest-app-api-host.").Default("authproxy-oauth-policy").String(),
+		NestAppTimeout:        app.Flag("nest-app-timeout", "Time to wait for the API used by the Nest app to respond, in milliseconds. Default: --scrape-timeout.").Int(),
+		NestAppAuthTimeout:    app.Flag("nest-app-auth-timeout", "Time to wait for the authentication with Google and the Nest auth proxy for the Nest app API, in milliseconds. Default: --scrape-timeout.").Int(),
+		NestAppSensorStale:    app.Flag("nest-app-sensor-stale-after", "Minutes after which a Nest Temperature Sensor which hasn't been updated is reported as stale.").Default("60").Int(),
+		NestAppSensorMaxAge:   app.Flag("nest-app-sensor-max-age", "Minutes after which the temperature and battery of a Nest Temperature Sensor which hasn't been updated are no longer exported. 0 to always export them.").Default("0").Int(),
+		NestAppSubscribe:      app.Flag("nest-app-subscribe", "Subscribe to the updates of the Nest app API in the background and serve scrapes from them, instead of calling the Nest app API on every scrape.").Bool(),
+		NestAppStructures:     app.Flag("nest-app-structure", "Only export the Nest app readings of this structure, given by its name or ID. Can be repeated. Default: all structures.").Strings(),
+		NestAppBucketTypes:    app.Flag("nest-app-bucket-type", "Type of the objects requested from the Nest app API, such as kryptonite for Temperature Sensors. Can be repeated. Default: all types ProNestheus exports metrics for.").Strings(),
+		NestAppMetricPrefix:   app.Flag("nest-app-metric-prefix", "Prefix of the Nest app metric names, replacing the leading nest.").Default("nest").String(),
+		NestLabelSpaceToDash:  app.Flag("nest-label-spaces-to-dashes", "Replace spaces with dashes in Nest thermostat label").Bool(),
+		LabelReplace:          app.Flag("label-replace", "Rewrite room, label, structure and where label values, in the form <regex>=<replacement>. Can be repeated; rules are applied in order.").Strings(),
+		LabelLowercase:        app.Flag("label-lowercase", "Lowercase room, label, structure and where label values.").Bool(),
+		NestIncludeDevices:    app.Flag("nest-include-device", "Only export Nest devices matching this filter, in the form <id|room|label>=<glob>. Can be repeated.").Strings(),
+		NestExcludeDevices:    app.Flag("nest-exclude-device", "Don't export Nest devices matching this filter, in the form <id|room|label>=<glob>. Can be repeated.").Strings(),
+		NestSamplingInterval:  app.Flag("nest-sampling-interval", "Interval, in seconds, at which Nest thermostats are sampled in the background to count heating runtime and cycles. Each sample is a Nest API call. Default: 0, disabled.").Default("0").Int(),
+		NestKeepOffline:       app.Flag("nest-keep-offline-readings", "Keep exporting the last known readings of offline Nest thermostats, together with staleness metrics.").Bool(),
+		NestShortIDs:          app.Flag("nest-short-ids", "Use only the device hash as the id label of Nest metrics. The full device name is kept in the name label of nest_thermostat_info.").Bool(),
+		NestLabels:            app.Flag("nest-label", "Label attached to the numeric Nest thermostat metrics: id, room, label or structure. Can be repeated. Default: all of them.").Enums("id", "room", "label", "structure"),
+		NestMetricPrefix:      app.Flag("nest-metric-prefix", "Prefix of the Nest thermostat metric names, replacing the leading nest.").Default("nest").String(),
+		NestV2MetricNames:     app.Flag("nest-v2-metric-names", "Use the nest_thermostat_* metric names, with humidity as a ratio, for Nest thermostat metrics and nest_sdm_up instead of nest_up. The old names are not exported then.").Bool(),
+		WeatherProvider:       app.Flag("weather-provider", "The weather service: openweathermap, metno for MET Norway, which needs no token but the coordinates of the location, or weatherapi for WeatherAPI.com, which needs --weatherapi-key and the coordinates, postal code or city of the location. Can be repeated; the weather metrics of several services get a provider label.").Default("openweathermap").Enums("openweathermap", "metno", "weatherapi"),
+		WeatherUserAgent:      app.Flag("weather-user-agent", "The User-Agent identifying ProNestheus to MET Norway, as required by its terms of service. Include your contact details.").Default("pronestheus github.com/klyubin/pronestheus").String(),
+		WeatherTimeout:        app.Flag("weather-timeout", "Time to wait for the weather API to respond, in milliseconds. Default: --scrape-timeout.").Int(),
+		WeatherAPIKey:         app.Flag("weatherapi-key", "The API key for WeatherAPI.com.").String(),
+		WeatherCacheTTL:       app.Flag("weather-cache-ttl", "Seconds for which weather readings are reused across scrapes instead of calling the weather API again. 0 to call it on every scrape.").Default("120").Int(),
+		WeatherLocationLabels: app.Flag("weather-location-labels", "Add the location and country labels, as resolved by the weather API, to the weather metrics.").Bool(),
+		WeatherURL:            app.Flag("owm-url", "The OpenWeatherMap API URL.").Default("http://api.openweathermap.org/data/2.5/weather").String(),
+		WeatherToken:          app.Flag("owm-auth", "The authorization token for OpenWeatherMap API.").String(),
+		WeatherLocation:       app.Flag("owm-location", "The location ID for OpenWeatherMap API. Defaults to Amsterdam.").Default("2759794").String(),
+		WeatherUnits:          app.Flag("owm-units", "Units requested from OpenWeatherMap API: standard (kelvin), metric (celsius) or imperial (fahrenheit). Default: following --temperature-unit.").Enum("standard", "metric", "imperial"),
+		WeatherAPIVersion:     app.Flag("owm-api-version", "The OpenWeatherMap API version: 2.5 for the current weather API at --owm-url, or 3.0 for the One Call API alone, which needs a One Call subscription and --owm-coordinates, --owm-city or --owm-location-from-nest.").Default("2.5").Enum("2.5", "3.0"),
+		WeatherOneCallURL:     app.Flag("owm-onecall-url", "The OpenWeatherMap One Call API URL, such as https://api.openweathermap.org/data/3.0/onecall, called for the UV index and dew point. Requires a One Call subscription. Default: not called, or the public One Call API with --owm-api-version=3.0.").String(),
+		WeatherForecastURL:    app.Flag("owm-forecast-url", "The OpenWeatherMap forecast API URL, such as https://api.openweathermap.org/data/2.5/forecast, called for the temperatures forecast 1, 3 and 6 hours ahead. Default: not called.").String(),
+		WeatherCoordinates:    app.Flag("owm-coordinates", "The coordinates of the location for OpenWeatherMap API, in the form <latitude>,<longitude>, instead of --owm-location.").String(),
+		WeatherCity:           app.Flag("owm-city", "The city for OpenWeatherMap API, such as Amsterdam,NL, instead of --owm-location. Looked up with OpenWeatherMap geocoding.").String(),
+		WeatherLocationNest:   app.Flag("owm-location-from-nest", "Use the location of the Nest structure reported by the Nest app API instead of --owm-location.").Bool(),
+	}
 }
 
-func main() {
+// parseConfig parses the configuration from the given command-line arguments, the environment, the secret files and
+// the config file. Each parse needs a new application, as the values of repeatable flags would pile up otherwise.
+func parseConfig(app *kingpin.Application, args []string) (*pkg.ExporterConfig, error) {
+	cfg := newConfig(app)
+
 	// Add short flags to --version and --help.
-	kingpin.Version(versionStr()).VersionFlag.Short('v')
-	kingpin.HelpFlag.Short('h')
+	app.Version(versionStr()).VersionFlag.Short('v')
+	app.HelpFlag.Short('h')
 
-	// Set the main command name so it can be used as a prefix for env variable names.
-	kingpin.CommandLine.Name = "pronestheus"
-	kingpin.CommandLine.DefaultEnvars()
+	// The main command name is the prefix of the env variable names.
+	app.DefaultEnvars()
+
+	// The config file and the secret files only provide the defaults of the flags, so they're loaded before the flags
+	// are parsed.
+	app.Flag(configFileFlag, "YAML file with the values of the flags, by their names without the leading dashes. Flags and environment variables take precedence over it.").PlaceHolder("FILE").String()
+	if path := configFile(app, args); path != "" {
+		if err := loadConfigFile(app, path); err != nil {
+			return nil, err
+		}
+	}
+	if err := loadSecretFiles(app); err != nil {
+		return nil, err
+	}
 
 	// TODO: add validators for empty values
 
-	kingpin.Parse()
+	_, err := app.Parse(args)
+	return cfg, err
+}
+
+func main() {
+	app := kingpin.New("pronestheus", "")
+	cfg, err := parseConfig(app, os.Args[1:])
+	app.FatalIfError(err, "")
 
 	exporter, err := pkg.NewExporter(cfg)
 	exitOnErr(err)
 
+	// SIGHUP and /-/reload re-read the config file and the secret files, with the same arguments.
+	exporter.ReloadWith(func() (*pkg.ExporterConfig, error) {
+		return parseConfig(kingpin.New("pronestheus", ""), os.Args[1:])
+	})
+
 	err = exporter.Run()
 	exitOnErr(err)
 }
@@ -7,18 +7,29 @@ import (
 	"math"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/tidwall/gjson"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/endpoints"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/go-kit/kit/log"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+
+	"pronestheus/pkg/sanitize"
+)
+
+const (
+	celsius    string = "celsius"
+	fahrenheit string = "fahrenheit"
 )
 
 var (
@@ -27,11 +38,24 @@ var (
 	errFailedUnmarshalling = errors.New("failed unmarshalling Nest API response body")
 	errFailedRequest       = errors.New("failed Nest API request")
 	errFailedReadingBody   = errors.New("failed reading Nest API response body")
+	errInvalidDeviceFilter = errors.New("invalid device filter; expected <id|room|label>=<glob>")
+	errInvalidTempUnit     = errors.New("invalid temperature unit; valid values: [celsius, fahrenheit]")
+	errRateLimited         = errors.New("nest API rate limit exceeded, backing off")
+	errInvalidLabel        = errors.New("invalid label; valid values: [id, room, label, structure]")
+)
+
+const (
+	// Backoff after the first rate limited response. It doubles with each consecutive rate limited response, up to
+	// maxRateLimitBackoff, unless the response asks to retry later.
+	minRateLimitBackoff = 30 * time.Second
+	maxRateLimitBackoff = 10 * time.Minute
 )
 
 // Thermostat stores thermostat data received from Nest API.
 type Thermostat struct {
 	ID               string
+	Type             string
+	Structure        string
 	Room             string
 	Label            string
 	Online           bool
@@ -40,41 +64,200 @@ type Thermostat struct {
 	CoolSetpointTemp float64
 	Humidity         float64
 	Status           string
+	Mode             string
+	TemperatureScale string
+}
+
+// Device stores the data common to all devices received from Nest API.
+type Device struct {
+	ID     string
+	Type   string
+	Room   string
+	Label  string
+	Online bool
+}
+
+// Readings contains the devices and thermostats received from Nest API.
+type Readings struct {
+	devices     []*Device
+	thermostats []*Thermostat
+	// parseErrors contains the errors of thermostats which couldn't be parsed, by thermostat ID.
+	parseErrors map[string]error
 }
 
 // Config provides the configuration necessary to create the Collector.
 type Config struct {
-	Logger                         log.Logger
-	Timeout                        int
-	APIURL                         string
-	OAuthClientID                  string
-	OAuthClientSecret              string
-	RefreshToken                   string
-	ProjectID                      string
-	OAuthToken                     *oauth2.Token
+	Logger            log.Logger
+	Timeout           int
+	Unit              string
+	APIURL            string
+	OAuthClientID     string
+	OAuthClientSecret string
+	RefreshToken      string
+	ProjectID         string
+	OAuthToken        *oauth2.Token
+	// TokenSource, if set, provides the access tokens for Nest API instead of the refresh token flow using
+	// OAuthClientID, OAuthClientSecret and RefreshToken.
+	TokenSource                    oauth2.TokenSource
 	ReplaceSpacesWithDashesInLabel bool
+	// LabelSanitizer, if set, is applied to the room, label and structure label values.
+	LabelSanitizer *sanitize.Sanitizer
+	// IncludeDevices and ExcludeDevices contain filters of the form <id|room|label>=<glob>. When IncludeDevices is
+	// not empty only devices matching at least one of its filters are exported. Devices matching any of the
+	// ExcludeDevices filters are never exported. Devices which aren't exported are left out of all metrics, including
+	// the device counts.
+	IncludeDevices []string
+	ExcludeDevices []string
+	// KeepOfflineReadings makes the Collector keep exporting the last known readings of thermostats which went
+	// offline, together with gauges describing how stale these readings are.
+	KeepOfflineReadings bool
+	// SamplingInterval is the interval, in seconds, at which the HVAC status of the thermostats is sampled in the
+	// background to count heating runtime and cycles. Zero disables background sampling.
+	SamplingInterval int
+	// Done, if set, stops the background sampling when closed.
+	Done <-chan struct{}
+	// ShortIDs makes the Collector use only the device hash, the last segment of the device name, as the id label.
+	// The full device name is still exported in the name label of nest_thermostat_info.
+	ShortIDs bool
+	// Labels are the labels attached to the numeric thermostat metrics, a subset of id, room, label and structure.
+	// Defaults to all of them. nest_thermostat_info always has all the labels.
+	Labels []string
+	// V2MetricNames switches the thermostat metrics to the nest_thermostat_* naming scheme, with humidity as a ratio
+	// and nest_sdm_up instead of nest_up.
+	V2MetricNames bool
+	// MetricPrefix replaces the leading "nest" of the metric names, so that the Collector can run side by side with
+	// another one exporting the same names. Defaults to nest.
+	MetricPrefix string
 }
 
 // Collector implements the Collector interface, collecting thermostats data from Nest API.
 type Collector struct {
 	client                         *http.Client
-	url                            string
+	tokenSource                    *observedTokenSource
+	devicesURL                     string
+	structuresURL                  string
 	logger                         log.Logger
 	metrics                        *Metrics
+	unit                           string
 	replaceSpacesWithDashesInLabel bool
+	labelSanitizer                 *sanitize.Sanitizer
+	include                        []deviceFilter
+	exclude                        []deviceFilter
+	keepOfflineReadings            bool
+	lastReadingsMu                 sync.Mutex
+	lastReadings                   map[string]lastReading
+	lastOnlineMu                   sync.Mutex
+	lastOnline                     map[string]time.Time
+	sampling                       bool
+	runtimesMu                     sync.Mutex
+	runtimes                       map[string]*hvacRuntime
+	shortIDs                       bool
+	labels                         []string
+	v2MetricNames                  bool
+	apiErrorsMu                    sync.Mutex
+	apiErrors                      map[apiError]float64
+	apiUpMu                        sync.Mutex
+	apiUp                          map[string]float64
+	rateLimitMu                    sync.Mutex
+	rateLimited                    float64
+	rateLimitedInARow              int
+	backoffUntil                   time.Time
+}
+
+// observedTokenSource wraps an oauth2.TokenSource, keeping track of the access token refreshes.
+type observedTokenSource struct {
+	src         oauth2.TokenSource
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+	refreshes   float64
+	failures    float64
+}
+
+// Token implements the oauth2.TokenSource interface.
+func (ts *observedTokenSource) Token() (*oauth2.Token, error) {
+	token, err := ts.src.Token()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if err != nil {
+		ts.failures++
+		return nil, err
+	}
+
+	// The wrapped token source returns the same token until it expires, a new access token means it was refreshed.
+	if token.AccessToken != ts.accessToken {
+		ts.refreshes++
+		ts.accessToken = token.AccessToken
+		ts.expiry = token.Expiry
+	}
+
+	return token, nil
+}
+
+// stats returns the number of refreshes, failed refreshes and the expiry of the current access token.
+func (ts *observedTokenSource) stats() (refreshes float64, failures float64, expiry time.Time) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.refreshes, ts.failures, ts.expiry
+}
+
+// apiError identifies a class of errors returned by Nest API.
+type apiError struct {
+	code   string
+	reason string
+}
+
+// hvacRuntime accumulates how long, and how many times, a thermostat has been heating.
+type hvacRuntime struct {
+	heating        bool
+	sampledAt      time.Time
+	heatingSeconds float64
+	heatingCycles  float64
+}
+
+// lastReading is the last reading of a thermostat received while it was online.
+type lastReading struct {
+	thermostat Thermostat
+	seenAt     time.Time
+}
+
+// deviceFilter matches the glob against the given field of a device.
+type deviceFilter struct {
+	field string
+	glob  string
 }
 
 // Metrics contains the metrics collected by the Collector.
 type Metrics struct {
 	up               *prometheus.Desc
+	devices          *prometheus.Desc
+	deviceUp         *prometheus.Desc
+	info             *prometheus.Desc
+	deviceOnline     *prometheus.Desc
 	online           *prometheus.Desc
 	ambientTemp      *prometheus.Desc
 	setpointTemp     *prometheus.Desc
 	heatSetpointTemp *prometheus.Desc
 	coolSetpointTemp *prometheus.Desc
+	setpointDelta    *prometheus.Desc
 	humidity         *prometheus.Desc
 	heating          *prometheus.Desc
 	cooling          *prometheus.Desc
+	temperatureScale *prometheus.Desc
+	stale            *prometheus.Desc
+	lastSeen         *prometheus.Desc
+	heatingSeconds   *prometheus.Desc
+	heatingCycles    *prometheus.Desc
+	offlineSeconds   *prometheus.Desc
+	apiErrors        *prometheus.Desc
+	apiUp            *prometheus.Desc
+	rateLimited      *prometheus.Desc
+	tokenRefreshes   *prometheus.Desc
+	tokenFailures    *prometheus.Desc
+	tokenExpiry      *prometheus.Desc
 }
 
 // New creates a Collector using the given Config.
@@ -83,68 +266,271 @@ func New(cfg Config) (*Collector, error) {
 		return nil, errors.Wrap(errFailedParsingURL, err.Error())
 	}
 
-	oauthConfig := &oauth2.Config{
-		ClientID:     cfg.OAuthClientID,
-		ClientSecret: cfg.OAuthClientSecret,
-		Scopes:       []string{"https://www.googleapis.com/auth/sdm.service"},
-		Endpoint:     endpoints.Google,
+	switch cfg.Unit {
+	case "":
+		cfg.Unit = celsius
+	case celsius, fahrenheit:
+	default:
+		return nil, errInvalidTempUnit
+	}
+
+	include, err := parseDeviceFilters(cfg.IncludeDevices)
+	if err != nil {
+		return nil, err
 	}
 
-	// If token is not provided we create a new one using RefreshToken. Using this token, the client will automatically
-	// get, and refresh, a valid access token for the API.
-	if cfg.OAuthToken == nil {
-		cfg.OAuthToken = &oauth2.Token{
-			TokenType:    "Bearer",
-			RefreshToken: cfg.RefreshToken,
+	exclude, err := parseDeviceFilters(cfg.ExcludeDevices)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MetricPrefix == "" {
+		cfg.MetricPrefix = "nest"
+	}
+
+	labels := cfg.Labels
+	if len(labels) == 0 {
+		labels = []string{"id", "room", "label", "structure"}
+	}
+	seenLabels := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		if label != "id" && label != "room" && label != "label" && label != "structure" {
+			return nil, errors.Wrap(errInvalidLabel, label)
+		}
+		if seenLabels[label] {
+			return nil, errors.Wrap(errInvalidLabel, "repeated "+label)
 		}
+		seenLabels[label] = true
 	}
 
-	client := oauthConfig.Client(context.Background(), cfg.OAuthToken)
+	tokenSource := &observedTokenSource{}
+	if cfg.TokenSource != nil {
+		// The token source is called for every request, so make sure tokens are reused until they expire.
+		tokenSource.src = oauth2.ReuseTokenSource(nil, cfg.TokenSource)
+	} else {
+		oauthConfig := &oauth2.Config{
+			ClientID:     cfg.OAuthClientID,
+			ClientSecret: cfg.OAuthClientSecret,
+			Scopes:       []string{"https://www.googleapis.com/auth/sdm.service"},
+			Endpoint:     endpoints.Google,
+		}
+
+		// If token is not provided we create a new one using RefreshToken. Using this token, the client will
+		// automatically get, and refresh, a valid access token for the API.
+		if cfg.OAuthToken == nil {
+			cfg.OAuthToken = &oauth2.Token{
+				TokenType:    "Bearer",
+				RefreshToken: cfg.RefreshToken,
+			}
+		} else {
+			// The token source modifies the token, so don't share it with other collectors.
+			token := *cfg.OAuthToken
+			cfg.OAuthToken = &token
+		}
+
+		tokenSource.src = oauthConfig.TokenSource(context.Background(), cfg.OAuthToken)
+		tokenSource.accessToken = cfg.OAuthToken.AccessToken
+		tokenSource.expiry = cfg.OAuthToken.Expiry
+	}
+
+	client := oauth2.NewClient(context.Background(), tokenSource)
 	client.Timeout = time.Duration(cfg.Timeout) * time.Millisecond
 
+	baseURL := strings.TrimRight(cfg.APIURL, "/") + "/enterprises/" + cfg.ProjectID
+
 	collector := &Collector{
 		client:                         client,
-		url:                            strings.TrimRight(cfg.APIURL, "/") + "/enterprises/" + cfg.ProjectID + "/devices/",
+		tokenSource:                    tokenSource,
+		devicesURL:                     baseURL + "/devices/",
+		structuresURL:                  baseURL + "/structures/",
 		logger:                         cfg.Logger,
-		metrics:                        buildMetrics(),
+		metrics:                        buildMetrics(cfg.MetricPrefix, cfg.Unit, labels, cfg.V2MetricNames),
+		unit:                           cfg.Unit,
 		replaceSpacesWithDashesInLabel: cfg.ReplaceSpacesWithDashesInLabel,
+		labelSanitizer:                 cfg.LabelSanitizer,
+		include:                        include,
+		exclude:                        exclude,
+		keepOfflineReadings:            cfg.KeepOfflineReadings,
+		lastReadings:                   make(map[string]lastReading),
+		lastOnline:                     make(map[string]time.Time),
+		sampling:                       cfg.SamplingInterval > 0,
+		runtimes:                       make(map[string]*hvacRuntime),
+		shortIDs:                       cfg.ShortIDs,
+		labels:                         labels,
+		v2MetricNames:                  cfg.V2MetricNames,
+		apiErrors:                      make(map[apiError]float64),
+		apiUp:                          make(map[string]float64),
+	}
+
+	if collector.sampling {
+		go collector.runSampler(time.Duration(cfg.SamplingInterval)*time.Second, cfg.Done)
 	}
 
 	return collector, nil
 }
 
-func buildMetrics() *Metrics {
-	var nestLabels = []string{"id", "room", "label"}
+func parseDeviceFilters(rawFilters []string) ([]deviceFilter, error) {
+	var filters []deviceFilter
+	for _, rawFilter := range rawFilters {
+		field, glob, found := strings.Cut(rawFilter, "=")
+		if !found || (field != "id" && field != "room" && field != "label") {
+			return nil, errors.Wrap(errInvalidDeviceFilter, rawFilter)
+		}
+
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, errors.Wrap(errInvalidDeviceFilter, err.Error())
+		}
+
+		filters = append(filters, deviceFilter{field: field, glob: glob})
+	}
+
+	return filters, nil
+}
+
+func (f deviceFilter) matches(device *Device) bool {
+	value := device.ID
+	switch f.field {
+	case "room":
+		value = device.Room
+	case "label":
+		value = device.Label
+	}
+
+	matched, _ := path.Match(f.glob, value)
+	return matched
+}
+
+// deviceID returns the id label value of the device with the given name.
+func (c *Collector) deviceID(name string) string {
+	if !c.shortIDs {
+		return name
+	}
+
+	return path.Base(name)
+}
+
+// isExported returns whether the device passes the include and exclude device filters.
+func (c *Collector) isExported(device *Device) bool {
+	included := len(c.include) == 0
+	for _, f := range c.include {
+		if f.matches(device) {
+			included = true
+			break
+		}
+	}
+
+	if !included {
+		return false
+	}
+
+	for _, f := range c.exclude {
+		if f.matches(device) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func buildMetrics(prefix, unit string, nestLabels []string, v2MetricNames bool) *Metrics {
+	var infoLabels = []string{"id", "room", "label", "structure", "type", "name"}
+	up := prometheus.NewDesc(strings.Join([]string{prefix, "up"}, "_"), "Was talking to Nest API successful.", nil, nil)
+	humidity := prometheus.NewDesc(strings.Join([]string{prefix, "humidity", "percent"}, "_"), "Inside humidity.", nestLabels, nil)
+	thermostat := prefix
+	if v2MetricNames {
+		up = prometheus.NewDesc(strings.Join([]string{prefix, "sdm", "up"}, "_"), "Was talking to Nest API successful.", nil, nil)
+		humidity = prometheus.NewDesc(strings.Join([]string{prefix, "thermostat", "humidity", "ratio"}, "_"), "Inside humidity.", nestLabels, nil)
+		thermostat = prefix + "_thermostat"
+	}
 	return &Metrics{
-		up:          prometheus.NewDesc(strings.Join([]string{"nest", "up"}, "_"), "Was talking to Nest API successful.", nil, nil),
-		online:      prometheus.NewDesc(strings.Join([]string{"nest", "online"}, "_"), "Is the thermostat online.", nestLabels, nil),
-		ambientTemp: prometheus.NewDesc(strings.Join([]string{"nest", "ambient", "temperature", "celsius"}, "_"), "Inside temperature.", nestLabels, nil),
-		// nest_setpoint_temperature_celsius is here for backward-compatibility with grdl/pronestheus
-		setpointTemp:     prometheus.NewDesc(strings.Join([]string{"nest", "setpoint", "temperature", "celsius"}, "_"), "Heating setpoint temperature.", nestLabels, nil),
-		heatSetpointTemp: prometheus.NewDesc(strings.Join([]string{"nest", "heat", "setpoint", "temperature", "celsius"}, "_"), "Heating setpoint temperature.", nestLabels, nil),
-		coolSetpointTemp: prometheus.NewDesc(strings.Join([]string{"nest", "cool", "setpoint", "temperature", "celsius"}, "_"), "Cooling setpoint temperature.", nestLabels, nil),
-		humidity:         prometheus.NewDesc(strings.Join([]string{"nest", "humidity", "percent"}, "_"), "Inside humidity.", nestLabels, nil),
-		heating:          prometheus.NewDesc(strings.Join([]string{"nest", "heating"}, "_"), "Is thermostat heating.", nestLabels, nil),
-		cooling:          prometheus.NewDesc(strings.Join([]string{"nest", "cooling"}, "_"), "Is thermostat cooling.", nestLabels, nil),
+		up:             up,
+		apiErrors:      prometheus.NewDesc(strings.Join([]string{prefix, "api", "errors", "total"}, "_"), "Number of error responses from Nest API by HTTP status code and error status.", []string{"code", "reason"}, nil),
+		apiUp:          prometheus.NewDesc(strings.Join([]string{prefix, "api", "up"}, "_"), "Was the last call to the Nest API endpoint successful.", []string{"endpoint"}, nil),
+		rateLimited:    prometheus.NewDesc(strings.Join([]string{prefix, "api", "rate", "limited", "total"}, "_"), "Number of Nest API responses rejecting requests due to rate limiting.", nil, nil),
+		tokenRefreshes: prometheus.NewDesc(strings.Join([]string{prefix, "oauth", "token", "refreshes", "total"}, "_"), "Number of OAuth2 access token refreshes.", nil, nil),
+		tokenFailures:  prometheus.NewDesc(strings.Join([]string{prefix, "oauth", "token", "refresh", "failures", "total"}, "_"), "Number of failed OAuth2 access token refreshes.", nil, nil),
+		tokenExpiry:    prometheus.NewDesc(strings.Join([]string{prefix, "oauth", "token", "expiry", "timestamp", "seconds"}, "_"), "When the current OAuth2 access token expires.", nil, nil),
+		devices:        prometheus.NewDesc(strings.Join([]string{prefix, "devices", "total"}, "_"), "Number of devices in the account by type.", []string{"type"}, nil),
+		deviceUp:       prometheus.NewDesc(strings.Join([]string{prefix, "device", "up"}, "_"), "Was parsing the thermostat data successful.", []string{"id"}, nil),
+		info:           prometheus.NewDesc(strings.Join([]string{prefix, "thermostat", "info"}, "_"), "Thermostat identity metadata.", infoLabels, nil),
+		deviceOnline:   prometheus.NewDesc(strings.Join([]string{prefix, "device", "online"}, "_"), "Is the device online.", []string{"id", "type", "room"}, nil),
+		online:         prometheus.NewDesc(strings.Join([]string{thermostat, "online"}, "_"), "Is the thermostat online.", nestLabels, nil),
+		ambientTemp:    prometheus.NewDesc(strings.Join([]string{thermostat, "ambient", "temperature", unit}, "_"), "Inside temperature.", nestLabels, nil),
+		// nest_setpoint_temperature_<unit> started out as the heating setpoint, for backward-compatibility with
+		// grdl/pronestheus. It now has a type label, heat or cool, for the setpoints of the thermostat's mode.
+		setpointTemp:     prometheus.NewDesc(strings.Join([]string{thermostat, "setpoint", "temperature", unit}, "_"), "Setpoint temperature of the thermostat's mode.", append(append([]string{}, nestLabels...), "type"), nil),
+		heatSetpointTemp: prometheus.NewDesc(strings.Join([]string{thermostat, "heat", "setpoint", "temperature", unit}, "_"), "Heating setpoint temperature.", nestLabels, nil),
+		coolSetpointTemp: prometheus.NewDesc(strings.Join([]string{thermostat, "cool", "setpoint", "temperature", unit}, "_"), "Cooling setpoint temperature.", nestLabels, nil),
+		setpointDelta:    prometheus.NewDesc(strings.Join([]string{thermostat, "setpoint", "ambient", "delta", unit}, "_"), "Difference between the setpoint temperature and the inside temperature.", nestLabels, nil),
+		humidity:         humidity,
+		heating:          prometheus.NewDesc(strings.Join([]string{thermostat, "heating"}, "_"), "Is thermostat heating.", nestLabels, nil),
+		cooling:          prometheus.NewDesc(strings.Join([]string{thermostat, "cooling"}, "_"), "Is thermostat cooling.", nestLabels, nil),
+		stale:            prometheus.NewDesc(strings.Join([]string{thermostat, "data", "stale"}, "_"), "Are the exported readings the last known readings of an offline thermostat.", nestLabels, nil),
+		lastSeen:         prometheus.NewDesc(strings.Join([]string{thermostat, "last", "seen", "timestamp", "seconds"}, "_"), "When the thermostat was last seen online.", nestLabels, nil),
+		heatingSeconds:   prometheus.NewDesc(strings.Join([]string{thermostat, "heating", "seconds", "total"}, "_"), "Time the thermostat has spent heating.", nestLabels, nil),
+		heatingCycles:    prometheus.NewDesc(strings.Join([]string{thermostat, "heating", "cycles", "total"}, "_"), "Number of times the thermostat has started heating.", nestLabels, nil),
+		offlineSeconds:   prometheus.NewDesc(strings.Join([]string{prefix, "thermostat", "offline", "seconds"}, "_"), "How long the thermostat has been offline, zero if it is online.", nestLabels, nil),
+		temperatureScale: prometheus.NewDesc(strings.Join([]string{prefix, "thermostat", "temperature", "scale"}, "_"), "Temperature scale configured on the thermostat.", append(append([]string{}, nestLabels...), "scale"), nil),
 	}
 }
 
 // Describe implements the prometheus.Describe interface.
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.metrics.up
+	ch <- c.metrics.apiErrors
+	ch <- c.metrics.apiUp
+	ch <- c.metrics.rateLimited
+	ch <- c.metrics.tokenRefreshes
+	ch <- c.metrics.tokenFailures
+	ch <- c.metrics.tokenExpiry
+	ch <- c.metrics.devices
+	ch <- c.metrics.deviceUp
+	ch <- c.metrics.info
+	ch <- c.metrics.deviceOnline
 	ch <- c.metrics.online
 	ch <- c.metrics.ambientTemp
 	ch <- c.metrics.setpointTemp
 	ch <- c.metrics.heatSetpointTemp
 	ch <- c.metrics.coolSetpointTemp
+	ch <- c.metrics.setpointDelta
 	ch <- c.metrics.humidity
 	ch <- c.metrics.heating
 	ch <- c.metrics.cooling
+	ch <- c.metrics.temperatureScale
+	ch <- c.metrics.stale
+	ch <- c.metrics.lastSeen
+	ch <- c.metrics.heatingSeconds
+	ch <- c.metrics.heatingCycles
+	ch <- c.metrics.offlineSeconds
 }
 
 // Collect implements the prometheus.Collector interface.
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
-	thermostats, err := c.getNestReadings()
+	readings, err := c.getNestReadings()
+
+	c.apiErrorsMu.Lock()
+	for e, count := range c.apiErrors {
+		ch <- prometheus.MustNewConstMetric(c.metrics.apiErrors, prometheus.CounterValue, count, e.code, e.reason)
+	}
+	c.apiErrorsMu.Unlock()
+
+	c.apiUpMu.Lock()
+	for endpoint, up := range c.apiUp {
+		ch <- prometheus.MustNewConstMetric(c.metrics.apiUp, prometheus.GaugeValue, up, endpoint)
+	}
+	c.apiUpMu.Unlock()
+
+	c.rateLimitMu.Lock()
+	ch <- prometheus.MustNewConstMetric(c.metrics.rateLimited, prometheus.CounterValue, c.rateLimited)
+	c.rateLimitMu.Unlock()
+
+	refreshes, failures, expiry := c.tokenSource.stats()
+	ch <- prometheus.MustNewConstMetric(c.metrics.tokenRefreshes, prometheus.CounterValue, refreshes)
+	ch <- prometheus.MustNewConstMetric(c.metrics.tokenFailures, prometheus.CounterValue, failures)
+	if !expiry.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.metrics.tokenExpiry, prometheus.GaugeValue, float64(expiry.Unix()))
+	}
+
 	if err != nil {
 		ch <- prometheus.MustNewConstMetric(c.metrics.up, prometheus.GaugeValue, 0)
 		c.logger.Log("level", "error", "message", "Failed collecting Nest data", "stack", errors.WithStack(err))
@@ -155,58 +541,287 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 
 	ch <- prometheus.MustNewConstMetric(c.metrics.up, prometheus.GaugeValue, 1)
 
-	for _, therm := range thermostats {
+	if c.sampling {
+		c.sample(readings, time.Now())
+	}
+
+	// Devices which aren't exported are left out of all metrics.
+	exported := make(map[string]bool)
+	deviceCounts := make(map[string]int)
+	for _, device := range readings.devices {
+		if c.isExported(device) {
+			exported[device.ID] = true
+			deviceCounts[device.Type]++
+		}
+	}
+	for deviceType, count := range deviceCounts {
+		ch <- prometheus.MustNewConstMetric(c.metrics.devices, prometheus.GaugeValue, float64(count), deviceType)
+	}
+
+	for id, err := range readings.parseErrors {
+		if !exported[id] {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.metrics.deviceUp, prometheus.GaugeValue, 0, c.deviceID(id))
+		c.logger.Log("level", "error", "message", "Failed parsing Nest thermostat data", "id", id, "stack", errors.WithStack(err))
+	}
+
+	// Thermostats have their own, more detailed, metrics below.
+	for _, device := range readings.devices {
+		if device.Type != "THERMOSTAT" && exported[device.ID] {
+			ch <- prometheus.MustNewConstMetric(c.metrics.deviceOnline, prometheus.GaugeValue, b2f(device.Online), c.deviceID(device.ID), device.Type, c.labelSanitizer.Sanitize(device.Room))
+		}
+	}
+
+	for _, therm := range readings.thermostats {
+		if !exported[therm.ID] {
+			continue
+		}
+
 		thermLabel := therm.Label
 		if c.replaceSpacesWithDashesInLabel {
 			thermLabel = strings.Replace(thermLabel, " ", "-", -1)
 		}
-		labels := []string{therm.ID, therm.Room, thermLabel}
+		thermLabel = c.labelSanitizer.Sanitize(thermLabel)
+		id := c.deviceID(therm.ID)
+		room := c.labelSanitizer.Sanitize(therm.Room)
+		structure := c.labelSanitizer.Sanitize(therm.Structure)
+		labels := c.labelValues(map[string]string{"id": id, "room": room, "label": thermLabel, "structure": structure})
 
+		ch <- prometheus.MustNewConstMetric(c.metrics.deviceUp, prometheus.GaugeValue, 1, id)
+		ch <- prometheus.MustNewConstMetric(c.metrics.info, prometheus.GaugeValue, 1, id, room, thermLabel, structure, therm.Type, therm.ID)
 		ch <- prometheus.MustNewConstMetric(c.metrics.online, prometheus.GaugeValue, b2f(therm.Online), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.offlineSeconds, prometheus.GaugeValue, c.offlineDuration(therm, time.Now()).Seconds(), labels...)
 
-		// Emit the rest of the metrics only if the thermostat is ONLINE.
+		if c.sampling {
+			if runtime, found := c.runtime(therm.ID); found {
+				ch <- prometheus.MustNewConstMetric(c.metrics.heatingSeconds, prometheus.CounterValue, runtime.heatingSeconds, labels...)
+				ch <- prometheus.MustNewConstMetric(c.metrics.heatingCycles, prometheus.CounterValue, runtime.heatingCycles, labels...)
+			}
+		}
+
+		reading := therm
+		if c.keepOfflineReadings {
+			var lastSeen time.Time
+			reading, lastSeen = c.lastKnownReading(therm)
+			if reading != nil {
+				ch <- prometheus.MustNewConstMetric(c.metrics.stale, prometheus.GaugeValue, b2f(!therm.Online), labels...)
+				ch <- prometheus.MustNewConstMetric(c.metrics.lastSeen, prometheus.GaugeValue, float64(lastSeen.Unix()), labels...)
+			}
+		}
+
+		// Emit the rest of the metrics only if the thermostat is ONLINE, or if
+		// we have its last known readings from when it was ONLINE.
 		// When the thermostat is offline, we do not know the current values
 		// of these metrics.
-		if !therm.Online {
+		if reading == nil || !reading.Online {
 			continue
 		}
 
-		ch <- prometheus.MustNewConstMetric(c.metrics.ambientTemp, prometheus.GaugeValue, therm.AmbientTemp, labels...)
-		if !math.IsNaN(therm.HeatSetpointTemp) {
-			ch <- prometheus.MustNewConstMetric(c.metrics.setpointTemp, prometheus.GaugeValue, therm.HeatSetpointTemp, labels...)
-			ch <- prometheus.MustNewConstMetric(c.metrics.heatSetpointTemp, prometheus.GaugeValue, therm.HeatSetpointTemp, labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.ambientTemp, prometheus.GaugeValue, c.temperature(reading.AmbientTemp), labels...)
+		for setpointType, setpoint := range modeSetpoints(reading) {
+			ch <- prometheus.MustNewConstMetric(c.metrics.setpointTemp, prometheus.GaugeValue, c.temperature(setpoint), append(labels, setpointType)...)
+		}
+		if !math.IsNaN(reading.HeatSetpointTemp) {
+			ch <- prometheus.MustNewConstMetric(c.metrics.heatSetpointTemp, prometheus.GaugeValue, c.temperature(reading.HeatSetpointTemp), labels...)
+		}
+		if !math.IsNaN(reading.CoolSetpointTemp) {
+			ch <- prometheus.MustNewConstMetric(c.metrics.coolSetpointTemp, prometheus.GaugeValue, c.temperature(reading.CoolSetpointTemp), labels...)
 		}
-		if !math.IsNaN(therm.CoolSetpointTemp) {
-			ch <- prometheus.MustNewConstMetric(c.metrics.coolSetpointTemp, prometheus.GaugeValue, therm.CoolSetpointTemp, labels...)
+		if delta := setpointDelta(reading); !math.IsNaN(delta) {
+			ch <- prometheus.MustNewConstMetric(c.metrics.setpointDelta, prometheus.GaugeValue, c.temperatureDelta(delta), labels...)
+		}
+		ch <- prometheus.MustNewConstMetric(c.metrics.humidity, prometheus.GaugeValue, c.humidity(reading.Humidity), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.heating, prometheus.GaugeValue, b2f(reading.Status == "HEATING"), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.cooling, prometheus.GaugeValue, b2f(reading.Status == "COOLING"), labels...)
+		if reading.TemperatureScale != "" {
+			ch <- prometheus.MustNewConstMetric(c.metrics.temperatureScale, prometheus.GaugeValue, 1, append(labels, reading.TemperatureScale)...)
 		}
-		ch <- prometheus.MustNewConstMetric(c.metrics.humidity, prometheus.GaugeValue, therm.Humidity, labels...)
-		ch <- prometheus.MustNewConstMetric(c.metrics.heating, prometheus.GaugeValue, b2f(therm.Status == "HEATING"), labels...)
-		ch <- prometheus.MustNewConstMetric(c.metrics.cooling, prometheus.GaugeValue, b2f(therm.Status == "COOLING"), labels...)
 	}
 }
 
-func (c *Collector) getNestReadings() (thermostats []*Thermostat, err error) {
-	res, err := c.client.Get(c.url)
-	if err != nil {
-		return nil, errors.Wrap(errFailedRequest, err.Error())
+// labelValues returns the values of the configured labels, in order.
+func (c *Collector) labelValues(values map[string]string) []string {
+	labels := make([]string, 0, len(c.labels))
+	for _, label := range c.labels {
+		labels = append(labels, values[label])
 	}
 
-	if res.StatusCode != 200 {
-		return nil, errors.Wrap(errNon200Response, fmt.Sprintf("code: %d", res.StatusCode))
+	return labels
+}
+
+// offlineDuration returns how long the thermostat has been offline at the given time. Thermostats which haven't been
+// seen online since the Collector was created are considered offline since they were first seen.
+func (c *Collector) offlineDuration(therm *Thermostat, now time.Time) time.Duration {
+	c.lastOnlineMu.Lock()
+	defer c.lastOnlineMu.Unlock()
+
+	lastOnline, found := c.lastOnline[therm.ID]
+	if therm.Online || !found {
+		c.lastOnline[therm.ID] = now
+		lastOnline = now
 	}
 
-	defer res.Body.Close()
+	return now.Sub(lastOnline)
+}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, errors.Wrap(errFailedReadingBody, err.Error())
+// lastKnownReading returns the reading of the thermostat from the last time it was online, together with the time it
+// was received. If the thermostat is online the given reading is remembered and returned. It returns nil if the
+// thermostat hasn't been seen online yet.
+func (c *Collector) lastKnownReading(therm *Thermostat) (*Thermostat, time.Time) {
+	c.lastReadingsMu.Lock()
+	defer c.lastReadingsMu.Unlock()
+
+	if therm.Online {
+		c.lastReadings[therm.ID] = lastReading{thermostat: *therm, seenAt: time.Now()}
+	}
+
+	last, found := c.lastReadings[therm.ID]
+	if !found {
+		return nil, time.Time{}
+	}
+
+	return &last.thermostat, last.seenAt
+}
+
+// runSampler samples the HVAC status of the thermostats every interval until done is closed. Sampling only at scrape
+// time can't tell how long the thermostats have been heating between scrapes.
+func (c *Collector) runSampler(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		readings, err := c.getNestReadings()
+		if err != nil {
+			c.logger.Log("level", "error", "message", "Failed sampling Nest data", "stack", errors.WithStack(err))
+			continue
+		}
+
+		c.sample(readings, time.Now())
+	}
+}
+
+// sample updates the heating runtimes of the thermostats with readings taken at the given time. The time between two
+// samples is counted as heating time if the thermostat was heating at the earlier one.
+func (c *Collector) sample(readings *Readings, now time.Time) {
+	c.runtimesMu.Lock()
+	defer c.runtimesMu.Unlock()
+
+	for _, therm := range readings.thermostats {
+		heating := therm.Online && therm.Status == "HEATING"
+
+		runtime, found := c.runtimes[therm.ID]
+		if !found {
+			c.runtimes[therm.ID] = &hvacRuntime{heating: heating, sampledAt: now}
+			continue
+		}
+
+		if !now.After(runtime.sampledAt) {
+			continue
+		}
+
+		if runtime.heating {
+			runtime.heatingSeconds += now.Sub(runtime.sampledAt).Seconds()
+		} else if heating {
+			runtime.heatingCycles++
+		}
+
+		runtime.heating = heating
+		runtime.sampledAt = now
+	}
+}
+
+// runtime returns a copy of the heating runtime of the thermostat.
+func (c *Collector) runtime(id string) (hvacRuntime, bool) {
+	c.runtimesMu.Lock()
+	defer c.runtimesMu.Unlock()
+
+	runtime, found := c.runtimes[id]
+	if !found {
+		return hvacRuntime{}, false
+	}
+
+	return *runtime, true
+}
+
+// listEndpoint lists the objects of the given Nest API endpoint, recording whether the call was successful. Calls
+// failing because the context was cancelled by the failure of another call aren't recorded.
+func (c *Collector) listEndpoint(ctx context.Context, endpoint string, rawurl string) ([]gjson.Result, error) {
+	results, err := c.list(ctx, rawurl, endpoint)
+	if err == nil || ctx.Err() == nil {
+		c.setAPIUp(endpoint, err == nil)
 	}
 
-	// Iterate over the array of "devices" returned from the API and unmarshall them into Thermostat objects.
-	gjson.Get(string(body), "devices").ForEach(func(_, device gjson.Result) bool {
+	return results, err
+}
+
+// setAPIUp records whether the last call to the given Nest API endpoint was successful.
+func (c *Collector) setAPIUp(endpoint string, up bool) {
+	c.apiUpMu.Lock()
+	defer c.apiUpMu.Unlock()
+
+	c.apiUp[endpoint] = b2f(up)
+}
+
+func (c *Collector) getNestReadings() (*Readings, error) {
+	// Devices and structures are fetched concurrently. If either call fails the other one is cancelled.
+	var devices, structureList []gjson.Result
+	g, ctx := errgroup.WithContext(context.Background())
+	g.Go(func() error {
+		var err error
+		devices, err = c.listEndpoint(ctx, "devices", c.devicesURL)
+		return err
+	})
+	g.Go(func() error {
+		var err error
+		structureList, err = c.listEndpoint(ctx, "structures", c.structuresURL)
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	// Map structure resource names to their user-visible names.
+	structures := make(map[string]string)
+	for _, structure := range structureList {
+		structures[structure.Get("name").String()] = structure.Get("traits.sdm\\.structures\\.traits\\.Info.customName").String()
+	}
+
+	if len(devices) == 0 {
+		return nil, errors.Wrap(errFailedUnmarshalling, "no devices in devices list")
+	}
+
+	readings := &Readings{parseErrors: make(map[string]error)}
+
+	// Iterate over the "devices" returned from the API and unmarshall them into Device objects, and the thermostats
+	// into Thermostat objects.
+	for _, device := range devices {
+		room, structure := parentRoom(device, structures)
+		online := device.Get("traits.sdm\\.devices\\.traits\\.Connectivity.status").String() == "ONLINE"
+
+		readings.devices = append(readings.devices, &Device{
+			ID:     device.Get("name").String(),
+			Type:   strings.TrimPrefix(device.Get("type").String(), "sdm.devices.types."),
+			Room:   room,
+			Label:  device.Get("traits.sdm\\.devices\\.traits\\.Info.customName").String(),
+			Online: online,
+		})
+
 		// Skip to next device if the current one is not a thermostat.
 		if device.Get("type").String() != "sdm.devices.types.THERMOSTAT" {
-			return true
+			continue
+		}
+
+		// A malformed thermostat is reported on its own, without failing the whole scrape.
+		if err := validateThermostat(device, online); err != nil {
+			readings.parseErrors[device.Get("name").String()] = err
+			continue
 		}
 
 		heatSetPoint := math.NaN()
@@ -223,42 +838,248 @@ func (c *Collector) getNestReadings() (thermostats []*Thermostat, err error) {
 			coolSetPoint = v.Float()
 		}
 
-		room := ""
-		// We determine the room from the list of parent relationships of this
-		// thermostat. We're explicitly looking for relationships of type
-		// "room" because I didn't have a way to test how other relationship
-		// types look like.
-		//
-		// Even though this is an array of relationships, a Nest thermostat
-		// can belong only to a single room.
-		for _, parent := range device.Get("parentRelations").Array() {
-			if strings.Contains(parent.Get("parent").String(), "/rooms/") {
-				room = parent.Get("displayName").String()
-				break
-			}
-		}
-
 		thermostat := Thermostat{
 			ID:               device.Get("name").String(),
+			Type:             strings.TrimPrefix(device.Get("type").String(), "sdm.devices.types."),
+			Structure:        structure,
 			Room:             room,
 			Label:            device.Get("traits.sdm\\.devices\\.traits\\.Info.customName").String(),
-			Online:           device.Get("traits.sdm\\.devices\\.traits\\.Connectivity.status").String() == "ONLINE",
+			Online:           online,
 			AmbientTemp:      device.Get("traits.sdm\\.devices\\.traits\\.Temperature.ambientTemperatureCelsius").Float(),
 			HeatSetpointTemp: heatSetPoint,
 			CoolSetpointTemp: coolSetPoint,
 			Humidity:         device.Get("traits.sdm\\.devices\\.traits\\.Humidity.ambientHumidityPercent").Float(),
 			Status:           device.Get("traits.sdm\\.devices\\.traits\\.ThermostatHvac.status").String(),
+			Mode:             device.Get("traits.sdm\\.devices\\.traits\\.ThermostatMode.mode").String(),
+			TemperatureScale: device.Get("traits.sdm\\.devices\\.traits\\.Settings.temperatureScale").String(),
 		}
 
-		thermostats = append(thermostats, &thermostat)
-		return true
-	})
+		readings.thermostats = append(readings.thermostats, &thermostat)
+	}
+
+	return readings, nil
+}
+
+// validateThermostat returns an error if the traits required to export the thermostat's metrics are missing.
+func validateThermostat(device gjson.Result, online bool) error {
+	if !device.Get("traits.sdm\\.devices\\.traits\\.Connectivity.status").Exists() {
+		return errors.Wrap(errFailedUnmarshalling, "missing connectivity status")
+	}
+
+	// The readings are only exported when the thermostat is online.
+	if !online {
+		return nil
+	}
+
+	if device.Get("traits.sdm\\.devices\\.traits\\.Temperature.ambientTemperatureCelsius").Type != gjson.Number {
+		return errors.Wrap(errFailedUnmarshalling, "missing ambient temperature")
+	}
+
+	if device.Get("traits.sdm\\.devices\\.traits\\.Humidity.ambientHumidityPercent").Type != gjson.Number {
+		return errors.Wrap(errFailedUnmarshalling, "missing ambient humidity")
+	}
+
+	return nil
+}
+
+// parentRoom returns the names of the room and the structure the device belongs to.
+func parentRoom(device gjson.Result, structures map[string]string) (room string, structure string) {
+	// We determine the room from the list of parent relationships of this
+	// device. We're explicitly looking for relationships of type
+	// "room" because I didn't have a way to test how other relationship
+	// types look like.
+	//
+	// Even though this is an array of relationships, a Nest device
+	// can belong only to a single room.
+	for _, parent := range device.Get("parentRelations").Array() {
+		if parentName := parent.Get("parent").String(); strings.Contains(parentName, "/rooms/") {
+			return parent.Get("displayName").String(), structures[parentName[:strings.Index(parentName, "/rooms/")]]
+		}
+	}
+
+	return "", ""
+}
+
+// list returns the objects stored under key in the responses of a paginated SDM API list call, following
+// nextPageToken until all pages have been fetched.
+func (c *Collector) list(ctx context.Context, rawurl string, key string) ([]gjson.Result, error) {
+	var results []gjson.Result
+	pageToken := ""
+	for {
+		pageURL := rawurl
+		if pageToken != "" {
+			pageURL += "?pageToken=" + url.QueryEscape(pageToken)
+		}
+
+		body, err := c.get(ctx, pageURL)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, gjson.GetBytes(body, key).Array()...)
+
+		pageToken = gjson.GetBytes(body, "nextPageToken").String()
+		if pageToken == "" {
+			return results, nil
+		}
+	}
+}
+
+func (c *Collector) get(ctx context.Context, rawurl string) ([]byte, error) {
+	c.rateLimitMu.Lock()
+	backoffUntil := c.backoffUntil
+	c.rateLimitMu.Unlock()
+
+	// Don't make things worse by calling the API while backing off.
+	if time.Now().Before(backoffUntil) {
+		return nil, errors.Wrap(errRateLimited, fmt.Sprintf("until %s", backoffUntil.Format(time.RFC3339)))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, errors.Wrap(errFailedRequest, err.Error())
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(errFailedRequest, err.Error())
+	}
 
-	if len(thermostats) == 0 {
-		return nil, errors.Wrap(errFailedUnmarshalling, "no valid thermostats in devices list")
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(errFailedReadingBody, err.Error())
 	}
 
-	return thermostats, nil
+	if res.StatusCode != 200 {
+		// Google APIs describe errors with a JSON body like {"error": {"code": 401, "message": "...", "status": "UNAUTHENTICATED"}}.
+		reason := gjson.GetBytes(body, "error.status").String()
+		if reason == "" {
+			reason = "UNKNOWN"
+		}
+
+		c.apiErrorsMu.Lock()
+		c.apiErrors[apiError{code: strconv.Itoa(res.StatusCode), reason: reason}]++
+		c.apiErrorsMu.Unlock()
+
+		if res.StatusCode == http.StatusTooManyRequests {
+			c.backOff(res.Header.Get("Retry-After"), time.Now())
+		}
+
+		return nil, errors.Wrap(errNon200Response, fmt.Sprintf("code: %d, status: %s, message: %s", res.StatusCode, reason, gjson.GetBytes(body, "error.message").String()))
+	}
+
+	c.resetBackOff(time.Now())
+
+	return body, nil
+}
+
+// resetBackOff starts the backoff over after a successful response received at the given time. Responses to calls
+// made before an ongoing backoff started don't reset it.
+func (c *Collector) resetBackOff(now time.Time) {
+	c.rateLimitMu.Lock()
+	defer c.rateLimitMu.Unlock()
+
+	if !now.Before(c.backoffUntil) {
+		c.rateLimitedInARow = 0
+	}
+}
+
+// backOff stops calling the API for a while after a rate limited response received at the given time. The
+// Retry-After header of the response can be either a number of seconds or an HTTP date.
+func (c *Collector) backOff(retryAfter string, now time.Time) {
+	c.rateLimitMu.Lock()
+	defer c.rateLimitMu.Unlock()
+
+	c.rateLimited++
+	// Concurrent calls rejected together don't increase the backoff further.
+	if !now.Before(c.backoffUntil) {
+		c.rateLimitedInARow++
+	}
+
+	backoff := maxRateLimitBackoff
+	if c.rateLimitedInARow <= 5 {
+		backoff = minRateLimitBackoff << (max(c.rateLimitedInARow, 1) - 1)
+	}
+
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		if d := time.Duration(seconds) * time.Second; d > backoff {
+			backoff = d
+		}
+	} else if date, err := http.ParseTime(retryAfter); err == nil {
+		if d := date.Sub(now); d > backoff {
+			backoff = d
+		}
+	}
+
+	c.backoffUntil = now.Add(backoff)
+}
+
+// temperature converts a temperature in Celsius, as reported by Nest API, to the unit of the exported metrics.
+func (c *Collector) temperature(celsiusTemp float64) float64 {
+	if c.unit == fahrenheit {
+		return celsiusTemp*9/5 + 32
+	}
+	return celsiusTemp
+}
+
+// temperatureDelta converts a temperature difference in Celsius to the unit of the exported metrics.
+func (c *Collector) temperatureDelta(celsiusDelta float64) float64 {
+	if c.unit == fahrenheit {
+		return celsiusDelta * 9 / 5
+	}
+	return celsiusDelta
+}
+
+// humidity converts a humidity in percent to the unit of the exported metric.
+func (c *Collector) humidity(percent float64) float64 {
+	if c.v2MetricNames {
+		return percent / 100
+	}
+	return percent
+}
+
+// modeSetpoints returns the setpoints, in Celsius, the thermostat is using in its current mode, by setpoint type: heat
+// or cool. When the mode is unknown all the available setpoints are returned.
+func modeSetpoints(therm *Thermostat) map[string]float64 {
+	heat := !math.IsNaN(therm.HeatSetpointTemp) && (therm.Mode == "" || therm.Mode == "HEAT" || therm.Mode == "HEATCOOL")
+	cool := !math.IsNaN(therm.CoolSetpointTemp) && (therm.Mode == "" || therm.Mode == "COOL" || therm.Mode == "HEATCOOL")
+
+	setpoints := make(map[string]float64)
+	if heat {
+		setpoints["heat"] = therm.HeatSetpointTemp
+	}
+	if cool {
+		setpoints["cool"] = therm.CoolSetpointTemp
+	}
+
+	return setpoints
+}
+
+// setpointDelta returns how far, in Celsius, the inside temperature is from the setpoint the thermostat is trying to
+// reach. It is positive when the thermostat needs to heat and negative when it needs to cool. In the heat-cool mode
+// it is zero while the inside temperature is within the setpoint range. It returns NaN when there is no setpoint.
+func setpointDelta(therm *Thermostat) float64 {
+	heat := !math.IsNaN(therm.HeatSetpointTemp)
+	cool := !math.IsNaN(therm.CoolSetpointTemp)
+
+	switch {
+	case heat && cool:
+		if therm.AmbientTemp < therm.HeatSetpointTemp {
+			return therm.HeatSetpointTemp - therm.AmbientTemp
+		}
+		if therm.AmbientTemp > therm.CoolSetpointTemp {
+			return therm.CoolSetpointTemp - therm.AmbientTemp
+		}
+		return 0
+	case heat:
+		return therm.HeatSetpointTemp - therm.AmbientTemp
+	case cool:
+		return therm.CoolSetpointTemp - therm.AmbientTemp
+	default:
+		return math.NaN()
+	}
 }
 
 func b2f(b bool) float64 {
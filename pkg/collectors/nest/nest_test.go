@@ -1,11 +1,19 @@
 package nest
 
 import (
+	"math"
+	"net/http"
+	"net/http/httptest"
 	mock "pronestheus/test"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/alecthomas/assert"
+	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
 )
 
 func TestServerResponses(t *testing.T) {
@@ -21,6 +29,8 @@ func TestServerResponses(t *testing.T) {
 			wantErr: nil,
 			want: &Thermostat{
 				ID:               "enterprises/PROJECT_ID/devices/DEVICE_ID",
+				Type:             "THERMOSTAT",
+				Structure:        "Home",
 				Room:             "Living Room",
 				Label:            "Custom Name",
 				Online:           true,
@@ -29,6 +39,8 @@ func TestServerResponses(t *testing.T) {
 				HeatSetpointTemp: float64(19.17838),
 				Humidity:         float64(57),
 				Status:           "OFF",
+				Mode:             "HEATCOOL",
+				TemperatureScale: "CELSIUS",
 			},
 		}, {
 			name:    "invalid auth token",
@@ -56,19 +68,216 @@ func TestServerResponses(t *testing.T) {
 			})
 			assert.NoError(t, err)
 
-			thermostats, err := c.getNestReadings()
+			readings, err := c.getNestReadings()
 
 			if test.wantErr != nil {
-				assert.Nil(t, thermostats)
+				assert.Nil(t, readings)
 				assert.True(t, errors.Is(err, test.wantErr))
 			} else {
 				assert.NoError(t, err)
-				assert.Len(t, thermostats, 1)
-				assert.Equal(t, thermostats[0], test.want)
+				assert.Len(t, readings.devices, 2)
+				assert.Equal(t, readings.devices[0], &Device{ID: test.want.ID, Type: "THERMOSTAT", Room: "Living Room", Label: test.want.Label, Online: true})
+				assert.Equal(t, readings.devices[1], &Device{ID: "enterprises/PROJECT_ID/devices/CAMERA_ID", Type: "CAMERA", Room: "Hallway", Label: "Front Door", Online: false})
+				assert.Len(t, readings.thermostats, 1)
+				assert.Equal(t, readings.thermostats[0], test.want)
 			}
 		})
 	}
 }
+
+func TestCustomTokenSource(t *testing.T) {
+	var gotAuthorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuthorization = r.Header.Get("Authorization")
+		mock.NestServer().Config.Handler.ServeHTTP(w, r)
+	}))
+
+	c, err := New(Config{
+		APIURL:      server.URL,
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "custom token", TokenType: "Bearer"}),
+	})
+	assert.NoError(t, err)
+
+	readings, err := c.getNestReadings()
+	assert.NoError(t, err)
+	assert.Len(t, readings.thermostats, 1)
+	assert.Equal(t, gotAuthorization, "Bearer custom token")
+}
+
+func TestPagination(t *testing.T) {
+	c, err := New(Config{
+		APIURL:     mock.NestServerPaginated().URL,
+		OAuthToken: mock.ValidToken(),
+	})
+	assert.NoError(t, err)
+
+	readings, err := c.getNestReadings()
+	assert.NoError(t, err)
+	assert.Len(t, readings.thermostats, 2)
+	assert.Equal(t, readings.thermostats[0].ID, "enterprises/PROJECT_ID/devices/DEVICE_ID")
+	assert.Equal(t, readings.thermostats[1].ID, "enterprises/PROJECT_ID/devices/DEVICE_ID_2")
+	assert.Equal(t, readings.thermostats[1].Label, "Second Name")
+}
+
+func TestMalformedDevice(t *testing.T) {
+	c, err := New(Config{
+		APIURL:     mock.NestServerMalformedDevice().URL,
+		OAuthToken: mock.ValidToken(),
+	})
+	assert.NoError(t, err)
+
+	readings, err := c.getNestReadings()
+	assert.NoError(t, err)
+	assert.Len(t, readings.devices, 2)
+	assert.Len(t, readings.thermostats, 1)
+	assert.Equal(t, readings.thermostats[0].ID, "enterprises/PROJECT_ID/devices/DEVICE_ID")
+	assert.Equal(t, readings.thermostats[0].Status, "HEATING")
+	assert.Len(t, readings.parseErrors, 1)
+	assert.True(t, errors.Is(readings.parseErrors["enterprises/PROJECT_ID/devices/MALFORMED_DEVICE_ID"], errFailedUnmarshalling))
+}
+
+func TestAPIErrors(t *testing.T) {
+	c, err := New(Config{
+		APIURL:     mock.NestServerInvalidToken().URL,
+		OAuthToken: mock.ValidToken(),
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = c.getNestReadings()
+		assert.True(t, errors.Is(err, errNon200Response))
+		assert.Contains(t, err.Error(), "Request had invalid authentication credentials")
+	}
+
+	// Devices and structures are requested concurrently, so each scrape counts one or two errors.
+	assert.Equal(t, len(c.apiErrors), 1)
+	count := c.apiErrors[apiError{code: "401", reason: "UNAUTHENTICATED"}]
+	assert.True(t, count >= 2 && count <= 4)
+}
+
+func TestAPIUp(t *testing.T) {
+	c, err := New(Config{
+		APIURL:     mock.NestServer().URL,
+		OAuthToken: mock.ValidToken(),
+	})
+	assert.NoError(t, err)
+
+	_, err = c.getNestReadings()
+	assert.NoError(t, err)
+	assert.Equal(t, c.apiUp, map[string]float64{"devices": 1, "structures": 1})
+
+	c, err = New(Config{
+		APIURL:     mock.NestServerStructuresUnavailable().URL,
+		OAuthToken: mock.ValidToken(),
+	})
+	assert.NoError(t, err)
+
+	_, err = c.getNestReadings()
+	assert.True(t, errors.Is(err, errNon200Response))
+	assert.Equal(t, c.apiUp, map[string]float64{"devices": 1, "structures": 0})
+}
+
+func TestRateLimited(t *testing.T) {
+	server, requests := mock.NestServerRateLimited()
+
+	c, err := New(Config{
+		APIURL:     server.URL,
+		OAuthToken: mock.ValidToken(),
+	})
+	assert.NoError(t, err)
+
+	_, err = c.getNestReadings()
+	assert.True(t, errors.Is(err, errNon200Response))
+	assert.True(t, c.backoffUntil.After(time.Now().Add(115*time.Second)))
+	assert.Equal(t, c.rateLimitedInARow, 1)
+
+	// The API isn't called again while backing off. Depending on timing, one of the concurrent calls may have been
+	// cancelled before reaching the API.
+	sent := atomic.LoadInt32(requests)
+	_, err = c.getNestReadings()
+	assert.True(t, errors.Is(err, errRateLimited))
+	assert.Equal(t, atomic.LoadInt32(requests), sent)
+	assert.True(t, c.rateLimited >= 1 && c.rateLimited <= float64(sent))
+}
+
+func TestBackOff(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		inARow     int
+		retryAfter string
+		want       time.Duration
+	}{
+		{
+			name: "first",
+			want: 30 * time.Second,
+		}, {
+			name:   "exponential",
+			inARow: 2,
+			want:   2 * time.Minute,
+		}, {
+			name:   "capped",
+			inARow: 10,
+			want:   10 * time.Minute,
+		}, {
+			name:       "retry after seconds",
+			retryAfter: "90",
+			want:       90 * time.Second,
+		}, {
+			name:       "retry after date",
+			retryAfter: "Mon, 01 Jan 2024 12:05:00 GMT",
+			want:       5 * time.Minute,
+		}, {
+			name:       "retry after shorter than backoff",
+			inARow:     3,
+			retryAfter: "10",
+			want:       4 * time.Minute,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{
+				APIURL: "https://example.com/valid",
+			})
+			assert.NoError(t, err)
+
+			c.rateLimitedInARow = test.inARow
+			c.backOff(test.retryAfter, now)
+			assert.Equal(t, c.backoffUntil, now.Add(test.want))
+		})
+	}
+}
+
+func TestBackOffAfterSuccessDuringBackOff(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	c, err := New(Config{
+		APIURL: "https://example.com/valid",
+	})
+	assert.NoError(t, err)
+
+	c.backOff("", now)
+	assert.Equal(t, c.backoffUntil, now.Add(30*time.Second))
+
+	// A call made before the backoff started succeeds, and another one is rate limited.
+	c.resetBackOff(now.Add(time.Second))
+	assert.Equal(t, c.rateLimitedInARow, 1)
+	c.backOff("", now.Add(2*time.Second))
+	assert.Equal(t, c.rateLimitedInARow, 1)
+	assert.Equal(t, c.backoffUntil, now.Add(32*time.Second))
+
+	// Even with the counter reset, a rate limited response doesn't panic.
+	c.rateLimitedInARow = 0
+	c.backOff("", now.Add(3*time.Second))
+	assert.Equal(t, c.backoffUntil, now.Add(33*time.Second))
+
+	// Once the backoff is over, a successful response starts it over.
+	c.resetBackOff(now.Add(time.Minute))
+	assert.Equal(t, c.rateLimitedInARow, 0)
+}
+
 func TestAPIURLParsing(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -106,3 +315,399 @@ func TestAPIURLParsing(t *testing.T) {
 		})
 	}
 }
+
+func TestDeviceFilters(t *testing.T) {
+	device := &Device{
+		ID:    "enterprises/PROJECT_ID/devices/DEVICE_ID",
+		Room:  "Living Room",
+		Label: "Downstairs",
+	}
+
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		wantErr  error
+		exported bool
+	}{
+		{
+			name:     "no filters",
+			exported: true,
+		}, {
+			name:     "included by room",
+			include:  []string{"room=Living*"},
+			exported: true,
+		}, {
+			name:     "not included",
+			include:  []string{"room=Bedroom", "label=Up*"},
+			exported: false,
+		}, {
+			name:     "excluded by id",
+			exclude:  []string{"id=enterprises/*/devices/DEVICE_ID"},
+			exported: false,
+		}, {
+			name:     "included and excluded",
+			include:  []string{"room=Living Room"},
+			exclude:  []string{"label=Down*"},
+			exported: false,
+		}, {
+			name:    "invalid field",
+			include: []string{"serial=123"},
+			wantErr: errInvalidDeviceFilter,
+		}, {
+			name:    "invalid glob",
+			exclude: []string{"label=[Down"},
+			wantErr: errInvalidDeviceFilter,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{
+				APIURL:         "https://example.com/valid",
+				IncludeDevices: test.include,
+				ExcludeDevices: test.exclude,
+			})
+
+			if test.wantErr != nil {
+				assert.Nil(t, c)
+				assert.True(t, errors.Is(err, test.wantErr))
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, c.isExported(device), test.exported)
+			}
+		})
+	}
+}
+
+func TestExcludedDevicesWithoutMetrics(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		exclude  []string
+		excluded string
+	}{
+		{
+			name:     "camera",
+			url:      mock.NestServer().URL,
+			exclude:  []string{"id=enterprises/*/devices/CAMERA_ID"},
+			excluded: "CAMERA",
+		}, {
+			name:     "malformed thermostat",
+			url:      mock.NestServerMalformedDevice().URL,
+			exclude:  []string{"label=Malformed"},
+			excluded: "MALFORMED_DEVICE_ID",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{
+				Logger:         log.NewNopLogger(),
+				APIURL:         test.url,
+				OAuthToken:     mock.ValidToken(),
+				ExcludeDevices: test.exclude,
+			})
+			assert.NoError(t, err)
+
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(c)
+			families, err := registry.Gather()
+			assert.NoError(t, err)
+
+			devices := 0.0
+			for _, family := range families {
+				for _, metric := range family.GetMetric() {
+					for _, label := range metric.GetLabel() {
+						assert.NotContains(t, label.GetValue(), test.excluded, family.GetName())
+					}
+					if family.GetName() == "nest_devices_total" {
+						devices += metric.GetGauge().GetValue()
+					}
+				}
+			}
+			assert.Equal(t, devices, 1.0)
+		})
+	}
+}
+
+func TestShortIDs(t *testing.T) {
+	name := "enterprises/PROJECT_ID/devices/DEVICE_ID"
+
+	c := &Collector{}
+	assert.Equal(t, c.deviceID(name), name)
+
+	c = &Collector{shortIDs: true}
+	assert.Equal(t, c.deviceID(name), "DEVICE_ID")
+}
+
+func TestLabels(t *testing.T) {
+	values := map[string]string{"id": "DEVICE_ID", "room": "Living Room", "label": "Custom Name", "structure": "Home"}
+
+	c, err := New(Config{APIURL: "https://example.com/valid"})
+	assert.NoError(t, err)
+	assert.Equal(t, c.labelValues(values), []string{"DEVICE_ID", "Living Room", "Custom Name", "Home"})
+
+	c, err = New(Config{APIURL: "https://example.com/valid", Labels: []string{"structure", "room"}})
+	assert.NoError(t, err)
+	assert.Equal(t, c.labelValues(values), []string{"Home", "Living Room"})
+
+	c, err = New(Config{APIURL: "https://example.com/valid", Labels: []string{"type"}})
+	assert.Nil(t, c)
+	assert.True(t, errors.Is(err, errInvalidLabel))
+
+	c, err = New(Config{APIURL: "https://example.com/valid", Labels: []string{"room", "room"}})
+	assert.Nil(t, c)
+	assert.True(t, errors.Is(err, errInvalidLabel))
+}
+
+func TestLastKnownReading(t *testing.T) {
+	c, err := New(Config{
+		APIURL:              "https://example.com/valid",
+		KeepOfflineReadings: true,
+	})
+	assert.NoError(t, err)
+
+	reading, _ := c.lastKnownReading(&Thermostat{ID: "DEVICE_ID", Online: false})
+	assert.Nil(t, reading)
+
+	reading, seenAt := c.lastKnownReading(&Thermostat{ID: "DEVICE_ID", Online: true, AmbientTemp: 20})
+	assert.NotNil(t, reading)
+	assert.Equal(t, reading.AmbientTemp, float64(20))
+
+	reading, lastSeenAt := c.lastKnownReading(&Thermostat{ID: "DEVICE_ID", Online: false})
+	assert.NotNil(t, reading)
+	assert.True(t, reading.Online)
+	assert.Equal(t, reading.AmbientTemp, float64(20))
+	assert.Equal(t, lastSeenAt, seenAt)
+}
+
+func TestOfflineDuration(t *testing.T) {
+	c, err := New(Config{APIURL: "https://example.com/valid"})
+	assert.NoError(t, err)
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	online := &Thermostat{ID: "DEVICE_ID", Online: true}
+	offline := &Thermostat{ID: "DEVICE_ID", Online: false}
+
+	assert.Equal(t, c.offlineDuration(online, start), time.Duration(0))
+	assert.Equal(t, c.offlineDuration(online, start.Add(time.Minute)), time.Duration(0))
+	assert.Equal(t, c.offlineDuration(offline, start.Add(2*time.Minute)), time.Minute)
+	assert.Equal(t, c.offlineDuration(offline, start.Add(31*time.Minute)), 30*time.Minute)
+	assert.Equal(t, c.offlineDuration(online, start.Add(32*time.Minute)), time.Duration(0))
+
+	// Thermostats which were never seen online are offline since they were first seen.
+	never := &Thermostat{ID: "OTHER_DEVICE_ID", Online: false}
+	assert.Equal(t, c.offlineDuration(never, start), time.Duration(0))
+	assert.Equal(t, c.offlineDuration(never, start.Add(time.Hour)), time.Hour)
+}
+
+func TestTemperatureUnit(t *testing.T) {
+	tests := []struct {
+		name    string
+		unit    string
+		celsius float64
+		want    float64
+		wantErr error
+	}{
+		{
+			name:    "default",
+			unit:    "",
+			celsius: 20,
+			want:    20,
+		}, {
+			name:    "celsius",
+			unit:    "celsius",
+			celsius: 20,
+			want:    20,
+		}, {
+			name:    "fahrenheit",
+			unit:    "fahrenheit",
+			celsius: 20,
+			want:    68,
+		}, {
+			name:    "invalid",
+			unit:    "kelvin",
+			wantErr: errInvalidTempUnit,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{
+				APIURL: "https://example.com/valid",
+				Unit:   test.unit,
+			})
+
+			if test.wantErr != nil {
+				assert.Nil(t, c)
+				assert.True(t, errors.Is(err, test.wantErr))
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, c.temperature(test.celsius), test.want)
+			}
+		})
+	}
+}
+
+func TestSetpointDelta(t *testing.T) {
+	tests := []struct {
+		name string
+		heat float64
+		cool float64
+		want float64
+	}{
+		{
+			name: "heating",
+			heat: 21,
+			cool: math.NaN(),
+			want: 1.5,
+		}, {
+			name: "cooling",
+			heat: math.NaN(),
+			cool: 18,
+			want: -1.5,
+		}, {
+			name: "range below",
+			heat: 20,
+			cool: 24,
+			want: 0.5,
+		}, {
+			name: "range within",
+			heat: 19,
+			cool: 24,
+			want: 0,
+		}, {
+			name: "range above",
+			heat: 16,
+			cool: 19,
+			want: -0.5,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			therm := &Thermostat{
+				AmbientTemp:      19.5,
+				HeatSetpointTemp: test.heat,
+				CoolSetpointTemp: test.cool,
+			}
+			assert.Equal(t, setpointDelta(therm), test.want)
+		})
+	}
+
+	assert.True(t, math.IsNaN(setpointDelta(&Thermostat{HeatSetpointTemp: math.NaN(), CoolSetpointTemp: math.NaN()})))
+}
+
+func TestModeSetpoints(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		heat float64
+		cool float64
+		want map[string]float64
+	}{
+		{
+			name: "heat",
+			mode: "HEAT",
+			heat: 20,
+			cool: math.NaN(),
+			want: map[string]float64{"heat": 20},
+		}, {
+			name: "cool",
+			mode: "COOL",
+			heat: math.NaN(),
+			cool: 24,
+			want: map[string]float64{"cool": 24},
+		}, {
+			name: "heat-cool",
+			mode: "HEATCOOL",
+			heat: 20,
+			cool: 24,
+			want: map[string]float64{"heat": 20, "cool": 24},
+		}, {
+			name: "off",
+			mode: "OFF",
+			heat: 20,
+			cool: 24,
+			want: map[string]float64{},
+		}, {
+			name: "unknown mode",
+			heat: 20,
+			cool: math.NaN(),
+			want: map[string]float64{"heat": 20},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			therm := &Thermostat{Mode: test.mode, HeatSetpointTemp: test.heat, CoolSetpointTemp: test.cool}
+			assert.Equal(t, modeSetpoints(therm), test.want)
+		})
+	}
+}
+
+func TestHeatingRuntime(t *testing.T) {
+	c, err := New(Config{
+		APIURL: "https://example.com/valid",
+	})
+	assert.NoError(t, err)
+
+	start := time.Now()
+	samples := []struct {
+		offset time.Duration
+		status string
+	}{
+		{0, "OFF"},
+		{time.Minute, "HEATING"},
+		{2 * time.Minute, "HEATING"},
+		{3 * time.Minute, "OFF"},
+		{4 * time.Minute, "HEATING"},
+		{5 * time.Minute, "OFF"},
+	}
+
+	for _, s := range samples {
+		c.sample(&Readings{thermostats: []*Thermostat{{ID: "DEVICE_ID", Online: true, Status: s.status}}}, start.Add(s.offset))
+	}
+
+	runtime, found := c.runtime("DEVICE_ID")
+	assert.True(t, found)
+	assert.Equal(t, runtime.heatingSeconds, float64(180))
+	assert.Equal(t, runtime.heatingCycles, float64(2))
+
+	_, found = c.runtime("OTHER_DEVICE_ID")
+	assert.False(t, found)
+}
+
+// fakeTokenSource returns the given tokens, or error if the token is nil, in order.
+type fakeTokenSource struct {
+	tokens []*oauth2.Token
+}
+
+func (ts *fakeTokenSource) Token() (*oauth2.Token, error) {
+	token := ts.tokens[0]
+	ts.tokens = ts.tokens[1:]
+	if token == nil {
+		return nil, errors.New("refresh failed")
+	}
+	return token, nil
+}
+
+func TestObservedTokenSource(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	first := &oauth2.Token{AccessToken: "first", Expiry: expiry}
+	second := &oauth2.Token{AccessToken: "second", Expiry: expiry.Add(time.Hour)}
+
+	ts := &observedTokenSource{
+		src: &fakeTokenSource{tokens: []*oauth2.Token{first, first, nil, second, second}},
+	}
+
+	for i := 0; i < 5; i++ {
+		ts.Token()
+	}
+
+	refreshes, failures, gotExpiry := ts.stats()
+	assert.Equal(t, refreshes, float64(2))
+	assert.Equal(t, failures, float64(1))
+	assert.Equal(t, gotExpiry, second.Expiry)
+}
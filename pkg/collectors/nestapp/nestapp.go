@@ -2,105 +2,355 @@ package nestapp
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tidwall/gjson"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/go-kit/kit/log"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+
+	"pronestheus/pkg/sanitize"
+)
+
+const (
+	celsius    string = "celsius"
+	fahrenheit string = "fahrenheit"
+
+	metersPerSecondPerMph = 0.44704
+
+	// sensorBatteryLowLevel is the battery level under which the battery of a Temperature Sensor is considered low.
+	// Temperature Sensors report their battery level on Nest's internal scale, which follows the battery voltage. The
+	// threshold is empirical, as Nest doesn't document the scale; the raw level is exported as
+	// nest_temp_sensor_battery, with the default prefix, for alerting on other thresholds.
+	sensorBatteryLowLevel = 66
+
+	// defaultRateLimitBackoff is how long to stop calling the API after a rate limited response which doesn't say
+	// when to retry.
+	defaultRateLimitBackoff = time.Minute
+
+	// masterTokenAuthURL is where Google master tokens are exchanged for access tokens, the way the Google Home
+	// Android app does it.
+	masterTokenAuthURL = "https://android.clients.google.com/auth"
+	// defaultMasterTokenAndroidID is the Android device ID presented when exchanging the master token, unless
+	// Config.AuthAndroidID sets the ID of the device the token was issued for.
+	defaultMasterTokenAndroidID = "4d2e5c7b9a1f3e60"
+	// googleHomeAppSignature is the signature of the Google Home Android app, on whose behalf the access token is
+	// requested.
+	googleHomeAppSignature = "24bb24c05e47e0aefa68a58a766179d9b613a600"
+
+	defaultAPIHost      = "home.nest.com"
+	defaultAuthPolicyID = "authproxy-oauth-policy"
+	defaultIssueJWTURL  = "https://nestauthproxyservice-pa.googleapis.com/v1/issue_jwt"
 )
 
+// bucketTypes are the types of the objects requested from Nest app API: structures, locations, Temperature Sensors
+// ("kryptonite"), thermostats ("device" and "shared"), Protects ("topaz") and their connection status
+// ("widget_track"), cameras ("quartz"), Nest x Yale locks ("yale"), the Temperature Sensor settings of the
+// thermostats ("rcs_settings"), their energy usage history ("energy_latest"), schedules ("schedule") and connection
+// status ("track").
+var bucketTypes = []string{"structure", "where", "kryptonite", "device", "shared", "topaz", "widget_track", "quartz", "yale", "rcs_settings", "energy_latest", "schedule", "track"}
+
 var (
 	errNon200Response      = errors.New("nest app API responded with non-200 code")
 	errFailedUnmarshalling = errors.New("failed unmarshalling Nest app API response body")
 	errFailedRequest       = errors.New("failed Nest app API request")
 	errFailedReadingBody   = errors.New("failed reading Nest app API response body")
+	errInvalidTempUnit     = errors.New("invalid temperature unit; valid values: [celsius, fahrenheit]")
+	errRateLimited         = errors.New("nest app API rate limit exceeded, backing off")
 )
 
+// retryDelays are the delays before the retries of an app_launch request which failed due to a server error or a
+// dropped connection. Up to half of each delay is added at random, so that retries don't come in lockstep.
+var retryDelays = []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second}
+
 // Config provides the configuration necessary to create the Collector.
 type Config struct {
-	Logger      log.Logger
-	Timeout     int
+	Logger  log.Logger
+	Timeout int
+	// AuthTimeout is the time to wait, in milliseconds, for the authentication with Google and the Nest auth proxy,
+	// which is often slower than the API used by the Nest app. Defaults to Timeout.
+	AuthTimeout int
+	Unit        string
 	AuthURL     string
 	AuthCookies string
+	// AuthCookiesFile, if set, is the file from which the cookies are read instead of AuthCookies. It is re-read on
+	// every reauthentication, so that the cookies can be refreshed without restarting.
+	AuthCookiesFile string
+	// AuthMasterToken and AuthEmail, if set, are a long-lived Google master token ("aas_et/...") and the email of its
+	// Google Account, used for authentication instead of AuthURL and the cookies.
+	AuthMasterToken string
+	AuthEmail       string
+	// AuthAndroidID is the Android device ID the master token was issued for, presented when exchanging it. Defaults
+	// to a fixed ID.
+	AuthAndroidID string
+	// APIHost is the host of the API used by the Nest app, home.ft.nest.com for field-test accounts. Defaults to
+	// home.nest.com.
+	APIHost string
+	// AuthPolicyID is the policy of the Nest access token, matching APIHost. Defaults to authproxy-oauth-policy.
+	AuthPolicyID string
+	// IssueJWTURL is the URL at which the Google Account access token is exchanged for the Nest access token.
+	// Defaults to the Nest auth proxy.
+	IssueJWTURL string
+	// APIURL is the base URL of the API used by the Nest app. Defaults to https:// followed by APIHost.
+	APIURL string
+	// LabelSanitizer, if set, is applied to the structure and where label values.
+	LabelSanitizer *sanitize.Sanitizer
+	// MetricTimestamps makes the Collector export the Temperature Sensor metrics with the time of their last update
+	// instead of the time of the scrape.
+	MetricTimestamps bool
+	// SensorStaleAfter is the number of minutes after which a Temperature Sensor which hasn't been updated is
+	// considered stale. Defaults to 60.
+	SensorStaleAfter int
+	// SensorMaxAge is the number of minutes after which the temperature and battery level of a Temperature Sensor
+	// which hasn't been updated are no longer exported. Zero exports them regardless of their age.
+	SensorMaxAge int
+	// Subscribe makes the Collector subscribe to the updates of the Nest app API in the background and serve the
+	// scrapes from them, instead of fetching the readings on every scrape.
+	Subscribe bool
+	// Done, if set, stops the subscription when closed, at the latest once the long-poll in progress returns.
+	Done <-chan struct{}
+	// Structures, if set, are the names or IDs of the only structures whose readings are exported.
+	Structures []string
+	// BucketTypes are the types of the objects requested from Nest app API. Defaults to all the types the Collector
+	// exports metrics for.
+	BucketTypes []string
+	// MetricPrefix replaces the leading "nest" of the metric names, e.g. nest_app_up becomes <prefix>_app_up, to keep
+	// them apart from the nest_* metrics of the Nest SDM API collector, whose prefix is nest.Config.MetricPrefix.
+	// Defaults to nest.
+	MetricPrefix string
 }
 
 // Collector implements the Collector interface, collecting thermostats data from Nest app API.
 type Collector struct {
 	config                Config
 	client                *http.Client
+	authClient            *http.Client
+	subscribeClient       *http.Client
+	reauthGroup           singleflight.Group
+	authMu                sync.Mutex // Guards accessToken, accessTokenValidUntil and userId.
 	accessToken           string
 	accessTokenValidUntil time.Time
 	userId                string
 	logger                log.Logger
 	metrics               *Metrics
+
+	structuresMu sync.Mutex
+	structures   []Structure
+
+	buckets bucketCache
+
+	subscribedMu sync.Mutex
+	isSubscribed bool
+
+	transferredBytes uint64
+	responseBytes    uint64
+
+	reauths            uint64
+	googleAuthFailures uint64
+	jwtFailures        uint64
+
+	retryDelays  []time.Duration
+	retries      uint64
+	rateLimitMu  sync.Mutex
+	backoffUntil time.Time
 }
 
 // Metrics contains the metrics collected by the Collector.
 type Metrics struct {
-	up           *prometheus.Desc
-	temp         *prometheus.Desc
-	batteryLevel *prometheus.Desc
-	outsideTemp  *prometheus.Desc
+	up                *prometheus.Desc
+	subscribed        *prometheus.Desc
+	transferred       *prometheus.Desc
+	responseBytes     *prometheus.Desc
+	tokenExpiry       *prometheus.Desc
+	retries           *prometheus.Desc
+	reauths           *prometheus.Desc
+	reauthFailures    *prometheus.Desc
+	temp              *prometheus.Desc
+	batteryLevel      *prometheus.Desc
+	batteryLow        *prometheus.Desc
+	lastUpdate        *prometheus.Desc
+	stale             *prometheus.Desc
+	outsideTemp       *prometheus.Desc
+	outsideHum        *prometheus.Desc
+	windSpeed         *prometheus.Desc
+	weatherInfo       *prometheus.Desc
+	sunrise           *prometheus.Desc
+	sunset            *prometheus.Desc
+	capabilities      *prometheus.Desc
+	ambientTemp       *prometheus.Desc
+	backplateTemp     *prometheus.Desc
+	targetTemp        *prometheus.Desc
+	heaterState       *prometheus.Desc
+	auxHeaterState    *prometheus.Desc
+	emerHeatState     *prometheus.Desc
+	acState           *prometheus.Desc
+	fanState          *prometheus.Desc
+	fanTimerTimeout   *prometheus.Desc
+	leaf              *prometheus.Desc
+	learning          *prometheus.Desc
+	timeToTarget      *prometheus.Desc
+	smokeStatus       *prometheus.Desc
+	coStatus          *prometheus.Desc
+	batteryHealth     *prometheus.Desc
+	protectOnline     *prometheus.Desc
+	lastManualTest    *prometheus.Desc
+	lastSelfTest      *prometheus.Desc
+	cameraOnline      *prometheus.Desc
+	streaming         *prometheus.Desc
+	locked            *prometheus.Desc
+	lockBattery       *prometheus.Desc
+	away              *prometheus.Desc
+	awaySince         *prometheus.Desc
+	activeSensor      *prometheus.Desc
+	heatingTime       *prometheus.Desc
+	coolingTime       *prometheus.Desc
+	rhrEnrolled       *prometheus.Desc
+	rhrActive         *prometheus.Desc
+	rhrStart          *prometheus.Desc
+	rhrEnd            *prometheus.Desc
+	heatLinkConn      *prometheus.Desc
+	heatLinkTemp      *prometheus.Desc
+	targetHumidity    *prometheus.Desc
+	humidifierState   *prometheus.Desc
+	dehumidifierState *prometheus.Desc
+	nextSetpoint      *prometheus.Desc
+	nextSetpointAt    *prometheus.Desc
+	online            *prometheus.Desc
+	lastConnection    *prometheus.Desc
 }
 
 // New creates a Collector using the given Config.
 func New(cfg Config) (*Collector, error) {
+	switch cfg.Unit {
+	case "":
+		cfg.Unit = celsius
+	case celsius, fahrenheit:
+	default:
+		return nil, errInvalidTempUnit
+	}
+
+	if cfg.MetricPrefix == "" {
+		cfg.MetricPrefix = "nest"
+	}
+	if cfg.SensorStaleAfter == 0 {
+		cfg.SensorStaleAfter = 60
+	}
+	if len(cfg.BucketTypes) == 0 {
+		cfg.BucketTypes = bucketTypes
+	}
+	if cfg.APIHost == "" {
+		cfg.APIHost = defaultAPIHost
+	}
+	if cfg.AuthAndroidID == "" {
+		cfg.AuthAndroidID = defaultMasterTokenAndroidID
+	}
+	if cfg.AuthPolicyID == "" {
+		cfg.AuthPolicyID = defaultAuthPolicyID
+	}
+	if cfg.IssueJWTURL == "" {
+		cfg.IssueJWTURL = defaultIssueJWTURL
+	}
+	if cfg.APIURL == "" {
+		cfg.APIURL = "https://" + cfg.APIHost
+	}
+
+	if cfg.AuthTimeout == 0 {
+		cfg.AuthTimeout = cfg.Timeout
+	}
+
 	client := &http.Client{}
 	client.Timeout = time.Duration(cfg.Timeout) * time.Millisecond
+	authClient := &http.Client{}
+	authClient.Timeout = time.Duration(cfg.AuthTimeout) * time.Millisecond
+	// The long-poll outlasts the timeout of the regular requests, and is bounded by subscribeTimeout instead.
+	subscribeClient := &http.Client{}
 
 	collector := &Collector{
-		config:  cfg,
-		client:  client,
-		logger:  cfg.Logger,
-		metrics: buildMetrics(),
+		config:          cfg,
+		client:          client,
+		authClient:      authClient,
+		subscribeClient: subscribeClient,
+		logger:          cfg.Logger,
+		metrics:         buildMetrics(cfg.MetricPrefix, cfg.Unit),
+		retryDelays:     retryDelays,
 	}
 
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Timeout)*time.Millisecond)
-	defer cancel()
-	err := collector.reauth(ctxTimeout)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to authenticate to Nest API: %w", err)
+	if cfg.Subscribe {
+		go collector.runSubscription()
 	}
 
+	// Authentication is deferred to the first scrape, so that the exporter starts even if Google or Nest are
+	// unreachable for a moment. Until it succeeds, nest_app_up is 0.
 	return collector, nil
 }
 
 func (c *Collector) reauth(ctx context.Context) error {
+	atomic.AddUint64(&c.reauths, 1)
 	googleAccessToken, err := c.getGoogleAccessToken(ctx)
 	if err != nil {
+		atomic.AddUint64(&c.googleAuthFailures, 1)
 		return fmt.Errorf("Failed to get Google Account access token: %w", err)
 	}
 	jwt, userId, jwtExpirationInstant, err := c.getNestJwt(ctx, googleAccessToken)
 	if err != nil {
+		atomic.AddUint64(&c.jwtFailures, 1)
 		return fmt.Errorf("Failed to get Nest access token: %w", err)
 	}
 
+	c.authMu.Lock()
 	c.accessToken = jwt
 	c.userId = userId
 	c.accessTokenValidUntil = jwtExpirationInstant
+	c.authMu.Unlock()
 	c.logger.Log("level", "debug", "message", fmt.Sprintf("Obtained new access token for API used by the Nest app. Valid until %s", jwtExpirationInstant.String()))
 	return nil
 }
 
+// authCookies returns the cookies for the Google auth URL, reading them from the cookies file if there is one.
+func (c *Collector) authCookies() (string, error) {
+	if c.config.AuthCookiesFile == "" {
+		return c.config.AuthCookies, nil
+	}
+	cookies, err := os.ReadFile(c.config.AuthCookiesFile)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read cookies file: %w", err)
+	}
+	return strings.TrimSpace(string(cookies)), nil
+}
+
 func (c *Collector) getGoogleAccessToken(ctx context.Context) (string, error) {
+	if c.config.AuthMasterToken != "" {
+		return c.getGoogleAccessTokenFromMasterToken(ctx)
+	}
+
 	req, err := http.NewRequestWithContext(ctx, "GET", c.config.AuthURL, nil)
 	if err != nil {
 		return "", fmt.Errorf("Failed to create GET request: %w", err)
 	}
-	req.Header.Set("Cookie", c.config.AuthCookies)
+	cookies, err := c.authCookies()
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Cookie", cookies)
 	req.Header.Set("X-Requested-With", "XmlHttpRequest")
 
-	resp, err := c.client.Do(req)
+	resp, err := c.authClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("Request failed: %w", err)
 	}
@@ -124,15 +374,74 @@ func (c *Collector) getGoogleAccessToken(ctx context.Context) (string, error) {
 	return accessToken, nil
 }
 
+// getGoogleAccessTokenFromMasterToken exchanges the master token for a Google Account access token scoped to the
+// Nest account.
+func (c *Collector) getGoogleAccessTokenFromMasterToken(ctx context.Context) (string, error) {
+	form := url.Values{
+		"accountType":                  {"HOSTED_OR_GOOGLE"},
+		"Email":                        {c.config.AuthEmail},
+		"has_permission":               {"1"},
+		"Token":                        {c.config.AuthMasterToken},
+		"service":                      {"oauth2:https://www.googleapis.com/auth/nest-account"},
+		"source":                       {"android"},
+		"androidId":                    {c.config.AuthAndroidID},
+		"app":                          {"com.google.android.apps.chromecast.app"},
+		"client_sig":                   {googleHomeAppSignature},
+		"device_country":               {"us"},
+		"operatorCountry":              {"us"},
+		"lang":                         {"en"},
+		"sdk_version":                  {"17"},
+		"google_play_services_version": {"240913000"},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", masterTokenAuthURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("Failed to create POST request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.authClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read response body: %w", err)
+	}
+
+	return parseMasterTokenResponse(string(body))
+}
+
+// parseMasterTokenResponse extracts the access token from the response to a master token exchange, which consists
+// of key=value lines.
+func parseMasterTokenResponse(body string) (string, error) {
+	values := make(map[string]string)
+	for _, line := range strings.Split(body, "\n") {
+		if key, value, found := strings.Cut(strings.TrimSpace(line), "="); found {
+			values[key] = value
+		}
+	}
+
+	if errorId, found := values["Error"]; found {
+		return "", fmt.Errorf("%s", errorId)
+	}
+	accessToken := values["Auth"]
+	if accessToken == "" {
+		return "", fmt.Errorf("No access token in the response")
+	}
+	return accessToken, nil
+}
+
 func (c *Collector) getNestJwt(ctx context.Context, googleAccessToken string) (string, string, time.Time, error) {
 	requestBody := fmt.Sprintf(`{"embed_google_oauth_access_token": true,
 "expire_after": "3600s",
 "google_oauth_access_token": "%s",
-"policy_id": "authproxy-oauth-policy"
-}`, googleAccessToken)
+"policy_id": "%s"
+}`, googleAccessToken, c.config.AuthPolicyID)
 	req, err := http.NewRequestWithContext(ctx,
 		"POST",
-		"https://nestauthproxyservice-pa.googleapis.com/v1/issue_jwt",
+		c.config.IssueJWTURL,
 		bytes.NewReader([]byte(requestBody)))
 	if err != nil {
 		return "", "", time.Now(), fmt.Errorf("Failed to create POST request: %w", err)
@@ -141,7 +450,7 @@ func (c *Collector) getNestJwt(ctx context.Context, googleAccessToken string) (s
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Requested-With", "XmlHttpRequest")
 
-	resp, err := c.client.Do(req)
+	resp, err := c.authClient.Do(req)
 	if err != nil {
 		return "", "", time.Now(), fmt.Errorf("Request failed: %w", err)
 	}
@@ -180,28 +489,153 @@ func (c *Collector) getNestJwt(ctx context.Context, googleAccessToken string) (s
 	return jwt, userId, expirationInstant, nil
 }
 
-func buildMetrics() *Metrics {
+func buildMetrics(prefix, unit string) *Metrics {
 	var sensorLabels = []string{"serial", "structure", "where"}
 	var structureLabels = []string{"id", "name"}
+	var tempSensorLabels = []string{"serial", "structure", "where", "thermostat"}
 	return &Metrics{
-		up:           prometheus.NewDesc("nest_app_up", "Was talking to Nest app API successful.", nil, nil),
-		temp:         prometheus.NewDesc("nest_temp_sensor_temperature_celsius", "Temperature Sensor temperature", sensorLabels, nil),
-		batteryLevel: prometheus.NewDesc("nest_temp_sensor_battery", "Temperature Sensor battery level (0-100)", sensorLabels, nil),
-		outsideTemp:  prometheus.NewDesc("nest_outside_temperature_celsius", "Outside temperature", structureLabels, nil),
+		up:                prometheus.NewDesc(prefix+"_app_up", "Was talking to Nest app API successful.", nil, nil),
+		transferred:       prometheus.NewDesc(prefix+"_app_response_transferred_bytes_total", "Bytes of Nest app API responses transferred, compressed", nil, nil),
+		responseBytes:     prometheus.NewDesc(prefix+"_app_response_bytes_total", "Bytes of Nest app API responses, decompressed", nil, nil),
+		tokenExpiry:       prometheus.NewDesc(prefix+"_app_token_expiry_timestamp_seconds", "When the access token for Nest app API expires", nil, nil),
+		retries:           prometheus.NewDesc(prefix+"_app_request_retries_total", "Retries of Nest app API requests after transient failures", nil, nil),
+		reauths:           prometheus.NewDesc(prefix+"_app_reauth_total", "Authentication attempts to Nest app API", nil, nil),
+		reauthFailures:    prometheus.NewDesc(prefix+"_app_reauth_failures_total", "Failed authentication attempts to Nest app API, by the failed stage: google or jwt", []string{"stage"}, nil),
+		subscribed:        prometheus.NewDesc(prefix+"_app_subscription_up", "Are the readings kept current by the subscription to Nest app API updates", nil, nil),
+		temp:              prometheus.NewDesc(prefix+"_temp_sensor_temperature_"+unit, "Temperature Sensor temperature", tempSensorLabels, nil),
+		batteryLevel:      prometheus.NewDesc(prefix+"_temp_sensor_battery", "Temperature Sensor raw battery level, on Nest's internal scale", tempSensorLabels, nil),
+		batteryLow:        prometheus.NewDesc(prefix+"_temp_sensor_battery_low", "Is the Temperature Sensor battery low", tempSensorLabels, nil),
+		lastUpdate:        prometheus.NewDesc(prefix+"_temp_sensor_last_update_timestamp_seconds", "When the Temperature Sensor was last updated", tempSensorLabels, nil),
+		stale:             prometheus.NewDesc(prefix+"_temp_sensor_stale", "Has the Temperature Sensor not been updated for too long", tempSensorLabels, nil),
+		outsideTemp:       prometheus.NewDesc(prefix+"_outside_temperature_"+unit, "Outside temperature", structureLabels, nil),
+		outsideHum:        prometheus.NewDesc(prefix+"_outside_humidity_percent", "Outside humidity", structureLabels, nil),
+		windSpeed:         prometheus.NewDesc(prefix+"_outside_wind_speed_meters_per_second", "Outside wind speed", structureLabels, nil),
+		weatherInfo:       prometheus.NewDesc(prefix+"_outside_weather_info", "Outside weather condition", append(structureLabels, "condition"), nil),
+		sunrise:           prometheus.NewDesc(prefix+"_outside_sunrise_timestamp_seconds", "When the sun rises at the structure today", structureLabels, nil),
+		sunset:            prometheus.NewDesc(prefix+"_outside_sunset_timestamp_seconds", "When the sun sets at the structure today", structureLabels, nil),
+		capabilities:      prometheus.NewDesc(prefix+"_app_thermostat_capabilities", "Capabilities of the HVAC system wired to the thermostat", append(sensorLabels, "can_heat", "can_cool", "has_fan", "has_humidifier"), nil),
+		ambientTemp:       prometheus.NewDesc(prefix+"_app_ambient_temperature_"+unit, "Thermostat inside temperature", sensorLabels, nil),
+		backplateTemp:     prometheus.NewDesc(prefix+"_app_backplate_temperature_"+unit, "Temperature measured inside the thermostat", sensorLabels, nil),
+		targetTemp:        prometheus.NewDesc(prefix+"_app_target_temperature_"+unit, "Thermostat target temperature", sensorLabels, nil),
+		heaterState:       prometheus.NewDesc(prefix+"_app_hvac_heater_state", "Is the thermostat heating", sensorLabels, nil),
+		auxHeaterState:    prometheus.NewDesc(prefix+"_app_hvac_aux_heater_state", "Is the thermostat heating with the heat pump's auxiliary heat", sensorLabels, nil),
+		emerHeatState:     prometheus.NewDesc(prefix+"_app_hvac_emergency_heat_state", "Is the thermostat heating with the heat pump's emergency heat", sensorLabels, nil),
+		acState:           prometheus.NewDesc(prefix+"_app_hvac_ac_state", "Is the thermostat cooling", sensorLabels, nil),
+		fanState:          prometheus.NewDesc(prefix+"_app_hvac_fan_state", "Is the thermostat's fan running", sensorLabels, nil),
+		fanTimerTimeout:   prometheus.NewDesc(prefix+"_app_fan_timer_timeout_timestamp_seconds", "When the running fan timer stops the fan", sensorLabels, nil),
+		leaf:              prometheus.NewDesc(prefix+"_app_leaf", "Does the thermostat show the energy-saving Leaf", sensorLabels, nil),
+		learning:          prometheus.NewDesc(prefix+"_app_learning_enabled", "Does the thermostat learn its schedule automatically (Auto-Schedule)", sensorLabels, nil),
+		timeToTarget:      prometheus.NewDesc(prefix+"_app_time_to_target_seconds", "How long the thermostat expects to take to reach its target temperature", sensorLabels, nil),
+		smokeStatus:       prometheus.NewDesc(prefix+"_app_protect_smoke_status", "Protect smoke status (0 OK, 1 warning, 2 emergency)", sensorLabels, nil),
+		coStatus:          prometheus.NewDesc(prefix+"_app_protect_co_status", "Protect carbon monoxide status (0 OK, 1 warning, 2 emergency)", sensorLabels, nil),
+		batteryHealth:     prometheus.NewDesc(prefix+"_app_protect_battery_health", "Protect battery health (0 OK, 1 replace)", sensorLabels, nil),
+		protectOnline:     prometheus.NewDesc(prefix+"_app_protect_online", "Is the Protect online", sensorLabels, nil),
+		lastManualTest:    prometheus.NewDesc(prefix+"_app_protect_last_manual_test_timestamp_seconds", "When the Protect was last tested manually", sensorLabels, nil),
+		lastSelfTest:      prometheus.NewDesc(prefix+"_app_protect_last_self_test_timestamp_seconds", "When the Protect last tested itself", sensorLabels, nil),
+		cameraOnline:      prometheus.NewDesc(prefix+"_app_camera_online", "Is the camera online", sensorLabels, nil),
+		streaming:         prometheus.NewDesc(prefix+"_app_camera_streaming_enabled", "Is streaming enabled on the camera", sensorLabels, nil),
+		locked:            prometheus.NewDesc(prefix+"_app_lock_locked", "Is the lock locked", sensorLabels, nil),
+		lockBattery:       prometheus.NewDesc(prefix+"_app_lock_battery", "Lock battery level (0-100)", sensorLabels, nil),
+		heatingTime:       prometheus.NewDesc(prefix+"_app_heating_seconds", "Time the thermostat has spent heating during the day", append(sensorLabels, "day"), nil),
+		coolingTime:       prometheus.NewDesc(prefix+"_app_cooling_seconds", "Time the thermostat has spent cooling during the day", append(sensorLabels, "day"), nil),
+		heatLinkConn:      prometheus.NewDesc(prefix+"_app_heat_link_connection", "Heat Link connection status (0 disconnected)", sensorLabels, nil),
+		heatLinkTemp:      prometheus.NewDesc(prefix+"_app_heat_link_temperature_"+unit, "Temperature measured by the Heat Link", sensorLabels, nil),
+		targetHumidity:    prometheus.NewDesc(prefix+"_app_target_humidity_percent", "Target humidity of the thermostat's humidifier or dehumidifier", sensorLabels, nil),
+		humidifierState:   prometheus.NewDesc(prefix+"_app_humidifier_state", "Is the thermostat humidifying", sensorLabels, nil),
+		dehumidifierState: prometheus.NewDesc(prefix+"_app_dehumidifier_state", "Is the thermostat dehumidifying", sensorLabels, nil),
+		nextSetpoint:      prometheus.NewDesc(prefix+"_app_next_setpoint_temperature_"+unit, "Next scheduled setpoint temperature", sensorLabels, nil),
+		nextSetpointAt:    prometheus.NewDesc(prefix+"_app_next_setpoint_timestamp_seconds", "When the next scheduled setpoint starts", sensorLabels, nil),
+		online:            prometheus.NewDesc(prefix+"_app_thermostat_online", "Is the thermostat online", sensorLabels, nil),
+		lastConnection:    prometheus.NewDesc(prefix+"_app_thermostat_last_connection_timestamp_seconds", "When the thermostat last connected to the Nest service", sensorLabels, nil),
+		activeSensor:      prometheus.NewDesc(prefix+"_app_active_sensor", "Temperature sensor controlling the thermostat", []string{"thermostat", "sensor_serial"}, nil),
+		away:              prometheus.NewDesc(prefix+"_app_structure_away", "Is the structure in the away mode", structureLabels, nil),
+		rhrEnrolled:       prometheus.NewDesc(prefix+"_app_rush_hour_enrolled", "Does the structure take part in Rush Hour Rewards", structureLabels, nil),
+		rhrActive:         prometheus.NewDesc(prefix+"_app_rush_hour_event_active", "Is a Rush Hour Rewards event in progress", structureLabels, nil),
+		rhrStart:          prometheus.NewDesc(prefix+"_app_rush_hour_event_start_timestamp_seconds", "When the current or upcoming Rush Hour Rewards event starts", structureLabels, nil),
+		rhrEnd:            prometheus.NewDesc(prefix+"_app_rush_hour_event_end_timestamp_seconds", "When the current or upcoming Rush Hour Rewards event ends", structureLabels, nil),
+		awaySince:         prometheus.NewDesc(prefix+"_app_structure_away_timestamp_seconds", "When the away mode of the structure last changed", structureLabels, nil),
 	}
 }
 
 // Describe implements the prometheus.Describe interface.
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.metrics.up
+	ch <- c.metrics.subscribed
+	ch <- c.metrics.transferred
+	ch <- c.metrics.responseBytes
+	ch <- c.metrics.tokenExpiry
+	ch <- c.metrics.retries
+	ch <- c.metrics.reauths
+	ch <- c.metrics.reauthFailures
 	ch <- c.metrics.temp
 	ch <- c.metrics.batteryLevel
+	ch <- c.metrics.batteryLow
+	ch <- c.metrics.lastUpdate
+	ch <- c.metrics.stale
 	ch <- c.metrics.outsideTemp
+	ch <- c.metrics.outsideHum
+	ch <- c.metrics.windSpeed
+	ch <- c.metrics.weatherInfo
+	ch <- c.metrics.sunrise
+	ch <- c.metrics.sunset
+	ch <- c.metrics.capabilities
+	ch <- c.metrics.ambientTemp
+	ch <- c.metrics.backplateTemp
+	ch <- c.metrics.targetTemp
+	ch <- c.metrics.heaterState
+	ch <- c.metrics.auxHeaterState
+	ch <- c.metrics.emerHeatState
+	ch <- c.metrics.acState
+	ch <- c.metrics.fanState
+	ch <- c.metrics.fanTimerTimeout
+	ch <- c.metrics.leaf
+	ch <- c.metrics.learning
+	ch <- c.metrics.timeToTarget
+	ch <- c.metrics.smokeStatus
+	ch <- c.metrics.coStatus
+	ch <- c.metrics.batteryHealth
+	ch <- c.metrics.protectOnline
+	ch <- c.metrics.lastManualTest
+	ch <- c.metrics.lastSelfTest
+	ch <- c.metrics.cameraOnline
+	ch <- c.metrics.streaming
+	ch <- c.metrics.locked
+	ch <- c.metrics.lockBattery
+	ch <- c.metrics.away
+	ch <- c.metrics.awaySince
+	ch <- c.metrics.activeSensor
+	ch <- c.metrics.heatingTime
+	ch <- c.metrics.coolingTime
+	ch <- c.metrics.rhrEnrolled
+	ch <- c.metrics.rhrActive
+	ch <- c.metrics.rhrStart
+	ch <- c.metrics.rhrEnd
+	ch <- c.metrics.heatLinkConn
+	ch <- c.metrics.heatLinkTemp
+	ch <- c.metrics.targetHumidity
+	ch <- c.metrics.humidifierState
+	ch <- c.metrics.dehumidifierState
+	ch <- c.metrics.nextSetpoint
+	ch <- c.metrics.nextSetpointAt
+	ch <- c.metrics.online
+	ch <- c.metrics.lastConnection
 }
 
 // Collect implements the prometheus.Collector interface.
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 	readings, err := c.getReadings()
+	if err == nil && len(c.config.Structures) > 0 {
+		readings = filterStructures(readings, c.config.Structures)
+	}
+	ch <- prometheus.MustNewConstMetric(c.metrics.transferred, prometheus.CounterValue, float64(atomic.LoadUint64(&c.transferredBytes)))
+	ch <- prometheus.MustNewConstMetric(c.metrics.responseBytes, prometheus.CounterValue, float64(atomic.LoadUint64(&c.responseBytes)))
+	ch <- prometheus.MustNewConstMetric(c.metrics.retries, prometheus.CounterValue, float64(atomic.LoadUint64(&c.retries)))
+	ch <- prometheus.MustNewConstMetric(c.metrics.reauths, prometheus.CounterValue, float64(atomic.LoadUint64(&c.reauths)))
+	ch <- prometheus.MustNewConstMetric(c.metrics.reauthFailures, prometheus.CounterValue, float64(atomic.LoadUint64(&c.googleAuthFailures)), "google")
+	ch <- prometheus.MustNewConstMetric(c.metrics.reauthFailures, prometheus.CounterValue, float64(atomic.LoadUint64(&c.jwtFailures)), "jwt")
+	if validUntil := c.tokenValidUntil(); !validUntil.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.metrics.tokenExpiry, prometheus.GaugeValue, float64(validUntil.Unix()))
+	}
 	if err != nil {
 		ch <- prometheus.MustNewConstMetric(c.metrics.up, prometheus.GaugeValue, 0)
 		c.logger.Log("level", "error", "message", "Failed collecting Nest app data", "stack", errors.WithStack(err))
@@ -211,29 +645,190 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 	c.logger.Log("level", "debug", "message", "Successfully collected Nest app data")
 
 	ch <- prometheus.MustNewConstMetric(c.metrics.up, prometheus.GaugeValue, 1)
+	if c.config.Subscribe {
+		ch <- prometheus.MustNewConstMetric(c.metrics.subscribed, prometheus.GaugeValue, b2f(c.subscribed()))
+	}
 
+	c.structuresMu.Lock()
+	c.structures = readings.structures
+	c.structuresMu.Unlock()
+
+	now := time.Now()
 	for _, sensor := range readings.sensors {
-		labels := []string{sensor.SerialNumber, sensor.StructureName, sensor.WhereName}
+		labels := []string{sensor.SerialNumber, c.config.LabelSanitizer.Sanitize(sensor.StructureName), c.config.LabelSanitizer.Sanitize(sensor.WhereName), sensor.ThermostatSerial}
+
+		// Readings which are too old are dropped, so that they can't be mistaken for current ones.
+		if c.config.SensorMaxAge == 0 || !sensor.stale(now, time.Duration(c.config.SensorMaxAge)*time.Minute) {
+			ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.temp, prometheus.GaugeValue, c.temperature(sensor.Temperature), labels...), sensor.LastUpdatedAt)
+			ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.batteryLevel, prometheus.GaugeValue, float64(sensor.BatteryLevel), labels...), sensor.LastUpdatedAt)
+			ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.batteryLow, prometheus.GaugeValue, b2f(sensor.batteryLow()), labels...), sensor.LastUpdatedAt)
+		}
+		if sensor.LastUpdatedAt.Unix() > 0 {
+			ch <- prometheus.MustNewConstMetric(c.metrics.lastUpdate, prometheus.GaugeValue, float64(sensor.LastUpdatedAt.Unix()), labels...)
+		}
+		ch <- prometheus.MustNewConstMetric(c.metrics.stale, prometheus.GaugeValue, b2f(sensor.stale(now, time.Duration(c.config.SensorStaleAfter)*time.Minute)), labels...)
+	}
+
+	for _, therm := range readings.thermostats {
+		labels := []string{therm.SerialNumber, c.config.LabelSanitizer.Sanitize(therm.StructureName), c.config.LabelSanitizer.Sanitize(therm.WhereName)}
+
+		// Whether thermostats are online is only known from their "track" objects.
+		if c.requestsBucketType("track") {
+			ch <- prometheus.MustNewConstMetric(c.metrics.online, prometheus.GaugeValue, b2f(therm.Online), labels...)
+		}
+		if !therm.LastConnection.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.metrics.lastConnection, prometheus.GaugeValue, float64(therm.LastConnection.Unix()), labels...)
+		}
+		caps := therm.Capabilities
+		ch <- prometheus.MustNewConstMetric(c.metrics.capabilities, prometheus.GaugeValue, 1, append(labels,
+			strconv.FormatBool(caps.CanHeat), strconv.FormatBool(caps.CanCool), strconv.FormatBool(caps.HasFan), strconv.FormatBool(caps.HasHumidifier))...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.ambientTemp, prometheus.GaugeValue, c.temperature(therm.AmbientTemperature), labels...)
+		if !math.IsNaN(therm.BackplateTemperature) {
+			ch <- prometheus.MustNewConstMetric(c.metrics.backplateTemp, prometheus.GaugeValue, c.temperature(therm.BackplateTemperature), labels...)
+		}
+		if !math.IsNaN(therm.TargetTemperature) {
+			ch <- prometheus.MustNewConstMetric(c.metrics.targetTemp, prometheus.GaugeValue, c.temperature(therm.TargetTemperature), labels...)
+		}
+		ch <- prometheus.MustNewConstMetric(c.metrics.heaterState, prometheus.GaugeValue, b2f(therm.HeaterOn), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.auxHeaterState, prometheus.GaugeValue, b2f(therm.AuxHeaterOn), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.emerHeatState, prometheus.GaugeValue, b2f(therm.EmergencyHeatOn), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.acState, prometheus.GaugeValue, b2f(therm.ACOn), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.fanState, prometheus.GaugeValue, b2f(therm.FanOn), labels...)
+		if !therm.FanTimerTimeout.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.metrics.fanTimerTimeout, prometheus.GaugeValue, float64(therm.FanTimerTimeout.Unix()), labels...)
+		}
+		ch <- prometheus.MustNewConstMetric(c.metrics.leaf, prometheus.GaugeValue, b2f(therm.Leaf), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.learning, prometheus.GaugeValue, b2f(therm.Learning), labels...)
+		if now.Before(therm.TargetReachedAt) {
+			ch <- prometheus.MustNewConstMetric(c.metrics.timeToTarget, prometheus.GaugeValue, therm.TargetReachedAt.Sub(now).Seconds(), labels...)
+		}
+		if therm.HeatLink != nil {
+			ch <- prometheus.MustNewConstMetric(c.metrics.heatLinkConn, prometheus.GaugeValue, float64(therm.HeatLink.Connection), labels...)
+			if !math.IsNaN(therm.HeatLink.Temperature) {
+				ch <- prometheus.MustNewConstMetric(c.metrics.heatLinkTemp, prometheus.GaugeValue, c.temperature(therm.HeatLink.Temperature), labels...)
+			}
+		}
+		if therm.Humidifier != nil {
+			if !math.IsNaN(therm.Humidifier.TargetHumidity) {
+				ch <- prometheus.MustNewConstMetric(c.metrics.targetHumidity, prometheus.GaugeValue, therm.Humidifier.TargetHumidity, labels...)
+			}
+			ch <- prometheus.MustNewConstMetric(c.metrics.humidifierState, prometheus.GaugeValue, b2f(therm.Humidifier.Humidifying), labels...)
+			ch <- prometheus.MustNewConstMetric(c.metrics.dehumidifierState, prometheus.GaugeValue, b2f(therm.Humidifier.Dehumidifying), labels...)
+		}
+		if temp, at, found := therm.nextSetpoint(now); found {
+			ch <- prometheus.MustNewConstMetric(c.metrics.nextSetpoint, prometheus.GaugeValue, c.temperature(temp), labels...)
+			ch <- prometheus.MustNewConstMetric(c.metrics.nextSetpointAt, prometheus.GaugeValue, float64(at.Unix()), labels...)
+		}
+		for day, usage := range therm.Usage {
+			ch <- prometheus.MustNewConstMetric(c.metrics.heatingTime, prometheus.GaugeValue, usage.HeatingSeconds, append(labels, day)...)
+			ch <- prometheus.MustNewConstMetric(c.metrics.coolingTime, prometheus.GaugeValue, usage.CoolingSeconds, append(labels, day)...)
+		}
+		for _, sensor := range therm.ActiveSensors {
+			ch <- prometheus.MustNewConstMetric(c.metrics.activeSensor, prometheus.GaugeValue, 1, therm.SerialNumber, sensor)
+		}
+	}
+
+	for _, protect := range readings.protects {
+		labels := []string{protect.SerialNumber, c.config.LabelSanitizer.Sanitize(protect.StructureName), c.config.LabelSanitizer.Sanitize(protect.WhereName)}
+
+		ch <- prometheus.MustNewConstMetric(c.metrics.smokeStatus, prometheus.GaugeValue, float64(protect.SmokeStatus), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.coStatus, prometheus.GaugeValue, float64(protect.COStatus), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.batteryHealth, prometheus.GaugeValue, float64(protect.BatteryHealth), labels...)
+		if c.requestsBucketType("widget_track") {
+			ch <- prometheus.MustNewConstMetric(c.metrics.protectOnline, prometheus.GaugeValue, b2f(protect.Online), labels...)
+		}
+		if !protect.LastManualTest.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.metrics.lastManualTest, prometheus.GaugeValue, float64(protect.LastManualTest.Unix()), labels...)
+		}
+		if !protect.LastSelfTest.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.metrics.lastSelfTest, prometheus.GaugeValue, float64(protect.LastSelfTest.Unix()), labels...)
+		}
+	}
 
-		ch <- prometheus.MustNewConstMetric(c.metrics.temp, prometheus.GaugeValue, sensor.Temperature, labels...)
-		ch <- prometheus.MustNewConstMetric(c.metrics.batteryLevel, prometheus.GaugeValue, float64(sensor.BatteryLevel), labels...)
+	for _, camera := range readings.cameras {
+		labels := []string{camera.SerialNumber, c.config.LabelSanitizer.Sanitize(camera.StructureName), c.config.LabelSanitizer.Sanitize(camera.WhereName)}
+
+		ch <- prometheus.MustNewConstMetric(c.metrics.cameraOnline, prometheus.GaugeValue, b2f(camera.Online), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.streaming, prometheus.GaugeValue, b2f(camera.StreamingEnabled), labels...)
+	}
+
+	for _, lock := range readings.locks {
+		labels := []string{lock.SerialNumber, c.config.LabelSanitizer.Sanitize(lock.StructureName), c.config.LabelSanitizer.Sanitize(lock.WhereName)}
+
+		ch <- prometheus.MustNewConstMetric(c.metrics.locked, prometheus.GaugeValue, b2f(lock.Locked), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.lockBattery, prometheus.GaugeValue, float64(lock.BatteryLevel), labels...)
 	}
 
 	for _, structure := range readings.structures {
-		labels := []string{structure.Id, structure.Name}
+		labels := []string{structure.Id, c.config.LabelSanitizer.Sanitize(structure.Name)}
 		if !math.IsNaN(structure.OutsideTemperature) {
-			ch <- prometheus.MustNewConstMetric(c.metrics.outsideTemp, prometheus.GaugeValue, structure.OutsideTemperature, labels...)
+			ch <- prometheus.MustNewConstMetric(c.metrics.outsideTemp, prometheus.GaugeValue, c.temperature(structure.OutsideTemperature), labels...)
+		}
+		if !math.IsNaN(structure.OutsideHumidity) {
+			ch <- prometheus.MustNewConstMetric(c.metrics.outsideHum, prometheus.GaugeValue, structure.OutsideHumidity, labels...)
+		}
+		if !math.IsNaN(structure.WindSpeed) {
+			ch <- prometheus.MustNewConstMetric(c.metrics.windSpeed, prometheus.GaugeValue, structure.WindSpeed, labels...)
+		}
+		if structure.Condition != "" {
+			ch <- prometheus.MustNewConstMetric(c.metrics.weatherInfo, prometheus.GaugeValue, 1, append(labels, structure.Condition)...)
+		}
+		if !structure.Sunrise.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.metrics.sunrise, prometheus.GaugeValue, float64(structure.Sunrise.Unix()), labels...)
+		}
+		if !structure.Sunset.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.metrics.sunset, prometheus.GaugeValue, float64(structure.Sunset.Unix()), labels...)
+		}
+		ch <- prometheus.MustNewConstMetric(c.metrics.away, prometheus.GaugeValue, b2f(structure.Away), labels...)
+		if !structure.AwayChangedAt.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.metrics.awaySince, prometheus.GaugeValue, float64(structure.AwayChangedAt.Unix()), labels...)
+		}
+		ch <- prometheus.MustNewConstMetric(c.metrics.rhrEnrolled, prometheus.GaugeValue, b2f(structure.RushHourEnrolled), labels...)
+		ch <- prometheus.MustNewConstMetric(c.metrics.rhrActive, prometheus.GaugeValue, b2f(structure.rushHourActive(now)), labels...)
+		// Past events are of no interest.
+		if now.Before(structure.RushHourEnd) {
+			ch <- prometheus.MustNewConstMetric(c.metrics.rhrStart, prometheus.GaugeValue, float64(structure.RushHourStart.Unix()), labels...)
+			ch <- prometheus.MustNewConstMetric(c.metrics.rhrEnd, prometheus.GaugeValue, float64(structure.RushHourEnd.Unix()), labels...)
+		}
+	}
+}
+
+// requestsBucketType returns whether the objects of the given type are requested from Nest app API.
+func (c *Collector) requestsBucketType(bucketType string) bool {
+	for _, t := range c.config.BucketTypes {
+		if t == bucketType {
+			return true
 		}
 	}
+	return false
+}
+
+// Structures returns the structures seen in the last successful scrape, empty before the first one.
+func (c *Collector) Structures() []Structure {
+	c.structuresMu.Lock()
+	defer c.structuresMu.Unlock()
+	return c.structures
+}
+
+// stale tells whether the sensor hasn't been updated for longer than the given duration at the given time.
+func (s NestTemperatureSensor) stale(now time.Time, after time.Duration) bool {
+	return s.LastUpdatedAt.Unix() > 0 && now.Sub(s.LastUpdatedAt) > after
+}
+
+// batteryLow tells whether the battery of the sensor needs replacing soon.
+func (s NestTemperatureSensor) batteryLow() bool {
+	return s.BatteryLevel < sensorBatteryLowLevel
 }
 
 type NestTemperatureSensor struct {
-	SerialNumber  string
-	StructureName string
-	WhereName     string
-	LastUpdatedAt time.Time
-	Temperature   float64
-	BatteryLevel  int64
+	SerialNumber string
+	// ThermostatSerial is the serial number of the thermostat the sensor is associated with, if any.
+	ThermostatSerial string
+	StructureName    string
+	WhereName        string
+	LastUpdatedAt    time.Time
+	Temperature      float64
+	BatteryLevel     int64
 }
 
 type Structure struct {
@@ -241,115 +836,931 @@ type Structure struct {
 	Name               string
 	WhereNames         map[string]string
 	OutsideTemperature float64
+	OutsideHumidity    float64
+	// WindSpeed is in meters per second.
+	WindSpeed float64
+	// Condition is the description of the current weather, such as "Cloudy".
+	Condition string
+	// Sunrise and Sunset are the times of today's sunrise and sunset at the structure. Zero if unknown.
+	Sunrise  time.Time
+	Sunset   time.Time
+	Location *time.Location
+	// PostalCode, CountryCode, Latitude and Longitude locate the structure. The coordinates are NaN if unknown.
+	PostalCode  string
+	CountryCode string
+	Latitude    float64
+	Longitude   float64
+	Away        bool
+	// AwayChangedAt is when the structure last went away or came back home. Zero if unknown.
+	AwayChangedAt time.Time
+	// RushHourEnrolled tells whether the structure takes part in Rush Hour Rewards. RushHourStart and RushHourEnd
+	// are the bounds of the current or upcoming Rush Hour Rewards event, zero if there is none.
+	RushHourEnrolled bool
+	RushHourStart    time.Time
+	RushHourEnd      time.Time
+}
+
+// Thermostat stores thermostat data received from Nest app API.
+type Thermostat struct {
+	SerialNumber       string
+	StructureName      string
+	WhereName          string
+	AmbientTemperature float64
+	// BackplateTemperature is the temperature measured inside the thermostat, NaN when it isn't reported.
+	BackplateTemperature float64
+	// TargetTemperature is NaN when the thermostat is off or in the heat-cool mode, which has two targets.
+	TargetTemperature float64
+	HeaterOn          bool
+	// AuxHeaterOn and EmergencyHeatOn tell whether a heat pump installation uses its auxiliary or emergency heat.
+	AuxHeaterOn     bool
+	EmergencyHeatOn bool
+	ACOn            bool
+	FanOn           bool
+	// FanTimerTimeout is when the running fan timer stops the fan. Zero if no timer is running.
+	FanTimerTimeout time.Time
+	// Leaf tells whether the thermostat shows the energy-saving Leaf.
+	Leaf bool
+	// Learning tells whether the thermostat learns its schedule automatically (Auto-Schedule).
+	Learning bool
+	// TargetReachedAt is when the thermostat expects to reach its target temperature. Zero if unknown.
+	TargetReachedAt time.Time
+	Online          bool
+	// LastConnection is when the thermostat last connected to the Nest service. Zero if unknown.
+	LastConnection time.Time
+	Capabilities   Capabilities
+	// ActiveSensors are the serial numbers of the sensors controlling the thermostat. This is the thermostat itself
+	// when it doesn't use any Temperature Sensor.
+	ActiveSensors []string
+	// Usage contains how long the thermostat has been heating and cooling "today" and "yesterday", when known.
+	Usage map[string]EnergyUsage
+	// HeatLink is nil unless the thermostat is installed with a Heat Link.
+	HeatLink *HeatLink
+	// Humidifier is nil unless the thermostat is wired to a humidifier or a dehumidifier.
+	Humidifier *Humidifier
+	// Schedule contains the setpoints of the thermostat's weekly schedule, in the time zone of Location.
+	Schedule []ScheduleEntry
+	Location *time.Location
+}
+
+// ScheduleEntry is a setpoint of a weekly thermostat schedule, starting at the given number of seconds after midnight.
+type ScheduleEntry struct {
+	Weekday     time.Weekday
+	Seconds     int64
+	Temperature float64
+}
+
+// nextSetpoint returns the next setpoint of the thermostat's schedule after the given time, and when it starts. It
+// returns false if the thermostat has no schedule.
+func (t Thermostat) nextSetpoint(now time.Time) (float64, time.Time, bool) {
+	now = now.In(t.Location)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, t.Location)
+
+	var next *ScheduleEntry
+	var nextAt time.Time
+	for i, entry := range t.Schedule {
+		daysAhead := (int(entry.Weekday) - int(now.Weekday()) + 7) % 7
+		at := midnight.AddDate(0, 0, daysAhead).Add(time.Duration(entry.Seconds) * time.Second)
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 7)
+		}
+		if next == nil || at.Before(nextAt) {
+			next = &t.Schedule[i]
+			nextAt = at
+		}
+	}
+	if next == nil {
+		return 0, time.Time{}, false
+	}
+
+	return next.Temperature, nextAt, true
+}
+
+// HeatLink stores the data of the Heat Link of a thermostat, as used in EU installations.
+type HeatLink struct {
+	// Connection is the connection status reported by the Nest app, zero when the Heat Link is disconnected.
+	Connection int64
+	// Temperature is NaN when the Heat Link doesn't report it.
+	Temperature float64
+}
+
+// Capabilities stores what the HVAC system wired to a thermostat can do.
+type Capabilities struct {
+	CanHeat       bool
+	CanCool       bool
+	HasFan        bool
+	HasHumidifier bool
+}
+
+// Humidifier stores the state of the humidifier or dehumidifier wired to a thermostat.
+type Humidifier struct {
+	// TargetHumidity is NaN when the thermostat doesn't control the humidity.
+	TargetHumidity float64
+	Humidifying    bool
+	Dehumidifying  bool
+}
+
+// EnergyUsage stores how long a thermostat has been heating and cooling during a day.
+type EnergyUsage struct {
+	HeatingSeconds float64
+	CoolingSeconds float64
+}
+
+// Protect stores Nest Protect data received from Nest app API.
+type Protect struct {
+	SerialNumber  string
+	StructureName string
+	WhereName     string
+	// SmokeStatus and COStatus are 0 when all is well, 1 on a heads-up warning and 2 on an emergency alarm.
+	SmokeStatus int64
+	COStatus    int64
+	// BatteryHealth is 0 when the battery is fine and 1 when it needs replacing.
+	BatteryHealth int64
+	Online        bool
+	// LastManualTest and LastSelfTest are when the Protect was last tested by pressing its button, and when it last
+	// tested itself. Zero if unknown.
+	LastManualTest time.Time
+	LastSelfTest   time.Time
+}
+
+// Camera stores Nest camera data received from Nest app API.
+type Camera struct {
+	SerialNumber     string
+	StructureName    string
+	WhereName        string
+	Online           bool
+	StreamingEnabled bool
+}
+
+// rushHourActive tells whether a Rush Hour Rewards event is in progress at the given time.
+func (s Structure) rushHourActive(now time.Time) bool {
+	return !now.Before(s.RushHourStart) && now.Before(s.RushHourEnd)
+}
+
+// Lock stores Nest x Yale lock data received from Nest app API.
+type Lock struct {
+	SerialNumber  string
+	StructureName string
+	WhereName     string
+	Locked        bool
+	BatteryLevel  int64
 }
 
 type Readings struct {
-	structures []Structure
-	sensors    []NestTemperatureSensor
+	structures  []Structure
+	sensors     []NestTemperatureSensor
+	thermostats []Thermostat
+	protects    []Protect
+	cameras     []Camera
+	locks       []Lock
+}
+
+// filterStructures returns the readings of only the given structures, identified by their names or IDs.
+func filterStructures(readings *Readings, structures []string) *Readings {
+	wanted := make(map[string]bool)
+	for _, structure := range structures {
+		wanted[structure] = true
+	}
+
+	// Everything but the structures themselves only knows the name of its structure.
+	filtered := &Readings{}
+	names := make(map[string]bool)
+	for _, structure := range readings.structures {
+		if wanted[structure.Id] || wanted[structure.Name] {
+			filtered.structures = append(filtered.structures, structure)
+			names[structure.Name] = true
+		}
+	}
+	for _, sensor := range readings.sensors {
+		if names[sensor.StructureName] {
+			filtered.sensors = append(filtered.sensors, sensor)
+		}
+	}
+	for _, therm := range readings.thermostats {
+		if names[therm.StructureName] {
+			filtered.thermostats = append(filtered.thermostats, therm)
+		}
+	}
+	for _, protect := range readings.protects {
+		if names[protect.StructureName] {
+			filtered.protects = append(filtered.protects, protect)
+		}
+	}
+	for _, camera := range readings.cameras {
+		if names[camera.StructureName] {
+			filtered.cameras = append(filtered.cameras, camera)
+		}
+	}
+	for _, lock := range readings.locks {
+		if names[lock.StructureName] {
+			filtered.locks = append(filtered.locks, lock)
+		}
+	}
+	return filtered
+}
+
+// tokenValidUntil returns when the current access token expires, zero if there is none yet.
+func (c *Collector) tokenValidUntil() time.Time {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	return c.accessTokenValidUntil
+}
+
+// token returns the access token and the user ID, re-authenticating first if the access token is about to expire
+// or has expired.
+func (c *Collector) token() (string, string, error) {
+	c.authMu.Lock()
+	accessToken, userId, validUntil := c.accessToken, c.userId, c.accessTokenValidUntil
+	c.authMu.Unlock()
+	if time.Now().Before(validUntil.Add(-2 * time.Minute)) {
+		return accessToken, userId, nil
+	}
+
+	// Access token about to expire or already expired. Concurrent scrapes share a single reauthentication.
+	_, err, _ := c.reauthGroup.Do("reauth", func() (interface{}, error) {
+		// Another scrape may have just re-authenticated.
+		c.authMu.Lock()
+		validUntil := c.accessTokenValidUntil
+		c.authMu.Unlock()
+		if time.Now().Before(validUntil.Add(-2 * time.Minute)) {
+			return nil, nil
+		}
+
+		ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Duration(c.config.AuthTimeout)*time.Millisecond)
+		defer cancel()
+		return nil, c.reauth(ctxTimeout)
+	})
+
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	// Error out only if the current token expired.
+	if err != nil && !time.Now().Before(c.accessTokenValidUntil) {
+		return "", "", fmt.Errorf("Failed to re-authenticate to Nest API: %w", err)
+	}
+	return c.accessToken, c.userId, nil
 }
 
 func (c *Collector) getReadings() (readings *Readings, err error) {
-	// Try to re-authenticate and obtain a new access token if the current one is about to expire
-	// or has expired.
-	if !time.Now().Before(c.accessTokenValidUntil.Add(-2 * time.Minute)) {
-		// Access token about to expire or already expired
-		ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Duration(c.config.Timeout)*time.Millisecond)
+	// While subscribed, the cached buckets are kept current by the subscription.
+	if c.subscribed() {
+		return readingsFrom(c.buckets.snapshot()), nil
+	}
+	return c.appLaunch()
+}
+
+// appLaunch fetches the readings from the app_launch endpoint of the Nest app API.
+func (c *Collector) appLaunch() (readings *Readings, err error) {
+	accessToken, userId, err := c.token()
+	if err != nil {
+		return nil, err
+	}
+
+	// Ask the Nest App API for the information on the objects we export.
+	// Only the buckets which changed since the last scrape are returned for the bucket versions we already know.
+	knownVersions, full := c.buckets.knownVersions(time.Now())
+	reqBody := fmt.Sprintf(`{"known_bucket_types":["%s"],"known_bucket_versions":%s}`, strings.Join(c.config.BucketTypes, `","`), knownVersions)
+
+	// Transient server errors and dropped connections are retried, so that a single one doesn't fail the scrape.
+	// The request only reads data, so retrying it is safe. All attempts together take at most the timeout, so that
+	// the retries don't make the scrape time out.
+	ctx := context.Background()
+	if c.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.config.Timeout)*time.Millisecond)
 		defer cancel()
-		err := c.reauth(ctxTimeout)
-		if err != nil {
-			// Error out only if the current token expired.
-			if !time.Now().Before(c.accessTokenValidUntil) {
-				return nil, fmt.Errorf("Failed to re-authenticate to Nest API: %w", err)
-			}
+	}
+	var body []byte
+	for attempt := 0; ; attempt++ {
+		var status int
+		body, status, err = c.postAppLaunch(ctx, accessToken, userId, reqBody)
+		if err == nil {
+			break
 		}
+		transient := status >= 500 || errors.Is(err, errFailedRequest) || errors.Is(err, errFailedReadingBody)
+		if !transient || attempt >= len(c.retryDelays) {
+			return nil, err
+		}
+		delay := c.retryDelays[attempt]
+		delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		atomic.AddUint64(&c.retries, 1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+
+	c.buckets.merge(parseAppLaunch(body), full, time.Now())
+	return readingsFrom(c.buckets.snapshot()), nil
+}
+
+// postAppLaunch makes an app_launch request, until the given context is done, returning the body of the response, or the status code of the
+// response along with the error.
+func (c *Collector) postAppLaunch(ctx context.Context, accessToken, userId, reqBody string) ([]byte, int, error) {
+	c.rateLimitMu.Lock()
+	backoffUntil := c.backoffUntil
+	c.rateLimitMu.Unlock()
+
+	// Don't make things worse by calling the API while backing off.
+	if time.Now().Before(backoffUntil) {
+		return nil, 0, errors.Wrap(errRateLimited, fmt.Sprintf("until %s", backoffUntil.Format(time.RFC3339)))
 	}
-	// We probably have a valid accecss token -- use it
 
-	// Ask the Nest App API for the information on structures, locations, and the Temperature
-	// Sensors ("kryptonite").
-	reqBody := "{\"known_bucket_types\":[\"structure\",\"where\",\"kryptonite\"],\"known_bucket_versions\":[]}"
-	req, err := http.NewRequest("POST",
-		fmt.Sprintf("https://home.nest.com/api/0.1/user/%s/app_launch", c.userId),
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		fmt.Sprintf("%s/api/0.1/user/%s/app_launch", c.config.APIURL, userId),
 		bytes.NewReader([]byte(reqBody)))
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", c.accessToken))
-	req.Header.Set("Cookie", fmt.Sprintf("G_ENABLED_IDPS=google; eu_cookie_accepted=1; viewer-volume=0.5; cztoken=%s; user_token=%s", c.accessToken, c.accessToken))
-	req.Header.Set("X-nl-user-id", c.userId)
+	if err != nil {
+		return nil, 0, errors.Wrap(errFailedRequest, err.Error())
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", accessToken))
+	req.Header.Set("Cookie", fmt.Sprintf("G_ENABLED_IDPS=google; eu_cookie_accepted=1; viewer-volume=0.5; cztoken=%s; user_token=%s", accessToken, accessToken))
+	req.Header.Set("X-nl-user-id", userId)
 	req.Header.Set("X-nl-protocol-version", "1")
+	req.Header.Set("Accept-Encoding", "gzip")
 
 	res, err := c.client.Do(req)
 	if err != nil {
-		return nil, errors.Wrap(errFailedRequest, err.Error())
+		return nil, 0, errors.Wrap(errFailedRequest, err.Error())
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		return nil, errors.Wrap(errNon200Response, fmt.Sprintf("code: %d", res.StatusCode))
+		if res.StatusCode == http.StatusTooManyRequests {
+			c.backOff(res.Header.Get("Retry-After"), time.Now())
+		}
+		return nil, res.StatusCode, errors.Wrap(errNon200Response, fmt.Sprintf("code: %d", res.StatusCode))
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	body, err := c.readBody(res)
 	if err != nil {
-		return nil, errors.Wrap(errFailedReadingBody, err.Error())
+		return nil, res.StatusCode, errors.Wrap(errFailedReadingBody, err.Error())
 	}
+	return body, res.StatusCode, nil
+}
 
-	// Populate our "structures" map from the returned "structure" and "where" objects.
-	structures := make(map[string]Structure)
-	gjson.Get(string(body), "updated_buckets").ForEach(func(_, obj gjson.Result) bool {
-		objKey := obj.Get("object_key").String()
-		if strings.HasPrefix(objKey, "structure.") {
-			if v := obj.Get("value"); v.Exists() {
-				id := strings.TrimPrefix(objKey, "structure.")
-				structures[id] = Structure{
-					Id:                 id,
-					Name:               v.Get("name").String(),
-					WhereNames:         make(map[string]string),
-					OutsideTemperature: math.NaN(),
-				}
+// backOff stops calling the API after a rate limited response received at the given time, until the time given by
+// the Retry-After header of the response, which can be either a number of seconds or an HTTP date.
+func (c *Collector) backOff(retryAfter string, now time.Time) {
+	backoff := defaultRateLimitBackoff
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		backoff = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(retryAfter); err == nil {
+		backoff = date.Sub(now)
+	}
+
+	c.rateLimitMu.Lock()
+	defer c.rateLimitMu.Unlock()
+	c.backoffUntil = now.Add(backoff)
+}
+
+// subscribeRetryInterval is how long to wait before subscribing again to bucket updates after a failure.
+const subscribeRetryInterval = 30 * time.Second
+
+// subscribeTimeout bounds a single long-poll for bucket updates.
+const subscribeTimeout = 10 * time.Minute
+
+// runSubscription keeps the cached buckets current by long-polling the Nest app API for their updates, so that
+// scrapes don't need to fetch them.
+func (c *Collector) runSubscription() {
+	// Closing Done cancels the long-poll in progress, so that a replaced Collector lets go of its connection.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.config.Done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := c.subscribe(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.setSubscribed(false)
+			c.logger.Log("level", "error", "message", "Failed subscribing to Nest app updates", "stack", errors.WithStack(err))
+			select {
+			case <-c.config.Done:
+				return
+			case <-time.After(subscribeRetryInterval):
 			}
 		}
+	}
+}
+
+// subscribe waits for the next bucket updates and merges them into the cache, until the given context is done. All
+// buckets are fetched first if it's time for that.
+func (c *Collector) subscribe(ctx context.Context) error {
+	if _, full := c.buckets.knownVersions(time.Now()); full {
+		if _, err := c.appLaunch(); err != nil {
+			return err
+		}
+	}
+
+	accessToken, userId, err := c.token()
+	if err != nil {
+		return err
+	}
+	transportURL, versions := c.buckets.subscription()
+	if transportURL == "" {
+		return fmt.Errorf("No transport URL in the app_launch response")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, subscribeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", transportURL+"/v6/subscribe",
+		bytes.NewReader([]byte(fmt.Sprintf(`{"objects":%s}`, versions))))
+	if err != nil {
+		return fmt.Errorf("Failed to create POST request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", accessToken))
+	req.Header.Set("X-nl-user-id", userId)
+	req.Header.Set("X-nl-protocol-version", "1")
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	res, err := c.subscribeClient.Do(req)
+	if err != nil {
+		return errors.Wrap(errFailedRequest, err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return errors.Wrap(errNon200Response, fmt.Sprintf("code: %d", res.StatusCode))
+	}
+
+	body, err := c.readBody(res)
+	if err != nil {
+		return errors.Wrap(errFailedReadingBody, err.Error())
+	}
+
+	c.buckets.merge(parseAppLaunch(body), false, time.Now())
+	c.setSubscribed(true)
+	return nil
+}
+
+// readBody reads the body of a response of the Nest app API, decompressing it if it's gzipped, and counts the
+// transferred and the decompressed bytes.
+func (c *Collector) readBody(res *http.Response) ([]byte, error) {
+	transferred := &countingReader{r: res.Body}
+	var r io.Reader = transferred
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(transferred)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	body, err := io.ReadAll(r)
+	atomic.AddUint64(&c.transferredBytes, transferred.n)
+	atomic.AddUint64(&c.responseBytes, uint64(len(body)))
+	return body, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += uint64(n)
+	return n, err
+}
+
+func (c *Collector) subscribed() bool {
+	c.subscribedMu.Lock()
+	defer c.subscribedMu.Unlock()
+	return c.isSubscribed
+}
+
+func (c *Collector) setSubscribed(subscribed bool) {
+	c.subscribedMu.Lock()
+	defer c.subscribedMu.Unlock()
+	c.isSubscribed = subscribed
+}
+
+// fullFetchInterval is how often all buckets are fetched anew instead of only the changed ones, so that the buckets
+// of removed devices don't linger.
+const fullFetchInterval = time.Hour
+
+// bucketCache keeps the buckets returned by the Nest app API between scrapes.
+type bucketCache struct {
+	mu sync.Mutex
+	// keys are the object keys of the buckets, in the order of the response in which they first appeared.
+	keys      []string
+	buckets   map[string]gjson.Result
+	fetchedAt time.Time
+	// weather is the weather_for_structures of the last response which had it.
+	weather gjson.Result
+	// transportURL is where bucket updates are subscribed to.
+	transportURL string
+}
+
+// knownVersions returns the JSON array of the known bucket versions for an app_launch request, and whether it is
+// empty, so that all buckets are fetched.
+func (b *bucketCache) knownVersions(now time.Time) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.buckets) == 0 || !now.Before(b.fetchedAt.Add(fullFetchInterval)) {
+		return "[]", true
+	}
+	return b.versionsLocked(), false
+}
+
+// versionsLocked returns the JSON array of the versions of all cached buckets. b.mu must be held.
+func (b *bucketCache) versionsLocked() string {
+	versions := make([]string, 0, len(b.keys))
+	for _, key := range b.keys {
+		obj := b.buckets[key]
+		versions = append(versions, fmt.Sprintf(`{"object_key":%q,"object_revision":%d,"object_timestamp":%d}`,
+			key, obj.Get("object_revision").Int(), obj.Get("object_timestamp").Int()))
+	}
+	return "[" + strings.Join(versions, ",") + "]"
+}
+
+// merge updates the cache with the buckets of an app_launch response, replacing the cache if the response contains
+// all buckets.
+func (b *bucketCache) merge(res appLaunchResponse, full bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if full || b.buckets == nil {
+		b.keys = nil
+		b.buckets = make(map[string]gjson.Result)
+		b.fetchedAt = now
+	}
+	for _, obj := range res.buckets {
+		key := obj.Get("object_key").String()
+		cached, found := b.buckets[key]
+		if !found {
+			b.keys = append(b.keys, key)
+		} else if cached.Get("object_revision").Int() > obj.Get("object_revision").Int() {
+			// A concurrent scrape already got a newer version.
+			continue
+		}
+		b.buckets[key] = obj
+	}
+	if res.weather.Exists() {
+		b.weather = res.weather
+	}
+	if res.transportURL != "" {
+		b.transportURL = res.transportURL
+	}
+}
+
+// snapshot returns all the cached buckets and the last weather.
+func (b *bucketCache) snapshot() appLaunchResponse {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	buckets := make([]gjson.Result, 0, len(b.keys))
+	for _, key := range b.keys {
+		buckets = append(buckets, b.buckets[key])
+	}
+	return appLaunchResponse{buckets: buckets, weather: b.weather, transportURL: b.transportURL}
+}
+
+// subscription returns the transport URL and the versions of all cached buckets, for subscribing to their updates.
+func (b *bucketCache) subscription() (string, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.transportURL, b.versionsLocked()
+}
+
+// appLaunchResponse is the part of an app_launch response used by the Collector.
+type appLaunchResponse struct {
+	buckets      []gjson.Result
+	weather      gjson.Result
+	transportURL string
+}
+
+// parseAppLaunch picks the part of an app_launch response used by the Collector in a single pass over its body.
+// Subscription responses, which list the updated buckets as objects, are parsed the same way.
+func parseAppLaunch(body []byte) appLaunchResponse {
+	var res appLaunchResponse
+	gjson.ParseBytes(body).ForEach(func(key, value gjson.Result) bool {
+		switch key.String() {
+		case "updated_buckets", "objects":
+			res.buckets = value.Array()
+		case "weather_for_structures":
+			res.weather = value
+		case "service_urls":
+			res.transportURL = value.Get("urls.transport_url").String()
+		}
 		return true
 	})
-	gjson.Get(string(body), "updated_buckets").ForEach(func(_, obj gjson.Result) bool {
+	return res
+}
+
+// bucket is an object of the Nest app API, such as a structure or a device, identified by its type and ID.
+type bucket struct {
+	id    string
+	value gjson.Result
+}
+
+// parseReadings parses the readings from the body of an app_launch response.
+func parseReadings(body []byte) *Readings {
+	return readingsFrom(parseAppLaunch(body))
+}
+
+// readingsFrom returns the readings from the buckets and the weather of an app_launch response.
+func readingsFrom(res appLaunchResponse) *Readings {
+	// Group the returned objects by their type, keeping the order of the response.
+	buckets := make(map[string][]bucket)
+	for _, obj := range res.buckets {
 		objKey := obj.Get("object_key").String()
-		if strings.HasPrefix(objKey, "where.") {
+		if i := strings.Index(objKey, "."); i > 0 {
 			if v := obj.Get("value"); v.Exists() {
-				id := strings.TrimPrefix(objKey, "where.")
-				structure, found := structures[id]
-				if found {
-					v.Get("wheres").ForEach(func(_, obj gjson.Result) bool {
-						if whereId := obj.Get("where_id"); whereId.Exists() {
-							structure.WhereNames[whereId.String()] = obj.Get("name").String()
-						}
-						return true
-					})
-				}
+				buckets[objKey[:i]] = append(buckets[objKey[:i]], bucket{id: objKey[i+1:], value: v})
 			}
 		}
-		return true
-	})
+	}
+
+	// Populate our "structures" map from the returned "structure" and "where" objects.
+	structures := make(map[string]Structure)
+	deviceStructures := make(map[string]string)
+	for _, b := range buckets["structure"] {
+		var awayChangedAt, rushHourStart, rushHourEnd time.Time
+		if ts := b.value.Get("away_timestamp").Int(); ts > 0 {
+			awayChangedAt = time.Unix(ts, 0)
+		}
+		if start, end := b.value.Get("peak_period_start_time").Int(), b.value.Get("peak_period_end_time").Int(); start > 0 && end > 0 {
+			rushHourStart = time.Unix(start, 0)
+			rushHourEnd = time.Unix(end, 0)
+		}
+		location := time.Local
+		if tz := b.value.Get("time_zone").String(); tz != "" {
+			if l, err := time.LoadLocation(tz); err == nil {
+				location = l
+			}
+		}
+		latitude, longitude := math.NaN(), math.NaN()
+		if lat, lon := b.value.Get("latitude"), b.value.Get("longitude"); lat.Exists() && lon.Exists() {
+			latitude, longitude = lat.Float(), lon.Float()
+		}
+		structures[b.id] = Structure{
+			Id:                 b.id,
+			Name:               b.value.Get("name").String(),
+			WhereNames:         make(map[string]string),
+			OutsideTemperature: math.NaN(),
+			OutsideHumidity:    math.NaN(),
+			WindSpeed:          math.NaN(),
+			Location:           location,
+			PostalCode:         b.value.Get("postal_code").String(),
+			CountryCode:        b.value.Get("country_code").String(),
+			Latitude:           latitude,
+			Longitude:          longitude,
+			Away:               b.value.Get("away").Bool(),
+			AwayChangedAt:      awayChangedAt,
+			RushHourEnrolled:   b.value.Get("rhr_enrollment").Bool(),
+			RushHourStart:      rushHourStart,
+			RushHourEnd:        rushHourEnd,
+		}
+		b.value.Get("devices").ForEach(func(_, device gjson.Result) bool {
+			deviceStructures[strings.TrimPrefix(device.String(), "device.")] = b.id
+			return true
+		})
+	}
+	for _, b := range buckets["where"] {
+		structure, found := structures[b.id]
+		if found {
+			b.value.Get("wheres").ForEach(func(_, obj gjson.Result) bool {
+				if whereId := obj.Get("where_id"); whereId.Exists() {
+					structure.WhereNames[whereId.String()] = obj.Get("name").String()
+				}
+				return true
+			})
+		}
+	}
 
-	// Populate our "sensors" list from the returned "kryptonite" objects.
+	// Populate our "sensors" list from the returned "kryptonite" objects. The "rcs_settings" of the thermostats list
+	// the sensors associated with them.
+	rcsSettings := make(map[string]gjson.Result)
+	sensorThermostats := make(map[string]string)
+	for _, b := range buckets["rcs_settings"] {
+		rcsSettings[b.id] = b.value
+		b.value.Get("associated_rcs_sensors").ForEach(func(_, sensor gjson.Result) bool {
+			sensorThermostats[strings.TrimPrefix(sensor.String(), "kryptonite.")] = b.id
+			return true
+		})
+	}
 	sensors := make([]NestTemperatureSensor, 0)
-	gjson.Get(string(body), "updated_buckets").ForEach(func(_, obj gjson.Result) bool {
-		objKey := obj.Get("object_key").String()
-		if strings.HasPrefix(objKey, "kryptonite.") {
-			if v := obj.Get("value"); v.Exists() {
-				structure := structures[v.Get("structure_id").String()]
-				sensors = append(sensors, NestTemperatureSensor{
-					SerialNumber:  v.Get("serial_number").String(),
-					LastUpdatedAt: time.Unix(v.Get("last_updated_at").Int(), 0),
-					Temperature:   v.Get("current_temperature").Float(),
-					BatteryLevel:  v.Get("battery_level").Int(),
-					StructureName: structure.Name,
-					WhereName:     structure.WhereNames[v.Get("where_id").String()],
-				})
+	for _, b := range buckets["kryptonite"] {
+		structure := structures[b.value.Get("structure_id").String()]
+		sensors = append(sensors, NestTemperatureSensor{
+			SerialNumber:     b.value.Get("serial_number").String(),
+			ThermostatSerial: sensorThermostats[b.id],
+			LastUpdatedAt:    time.Unix(b.value.Get("last_updated_at").Int(), 0),
+			Temperature:      b.value.Get("current_temperature").Float(),
+			BatteryLevel:     b.value.Get("battery_level").Int(),
+			StructureName:    structure.Name,
+			WhereName:        structure.WhereNames[b.value.Get("where_id").String()],
+		})
+	}
+
+	// Populate our "thermostats" list from the returned "device" objects and their "shared" counterparts, which
+	// contain the current readings of the thermostats.
+	shared := make(map[string]gjson.Result)
+	for _, b := range buckets["shared"] {
+		shared[b.id] = b.value
+	}
+	energy := make(map[string]gjson.Result)
+	for _, b := range buckets["energy_latest"] {
+		energy[b.id] = b.value
+	}
+	schedules := make(map[string]gjson.Result)
+	for _, b := range buckets["schedule"] {
+		schedules[b.id] = b.value
+	}
+	tracks := make(map[string]gjson.Result)
+	for _, b := range buckets["track"] {
+		tracks[b.id] = b.value
+	}
+	thermostats := make([]Thermostat, 0)
+	for _, b := range buckets["device"] {
+		sharedValue, found := shared[b.id]
+		if !found {
+			continue
+		}
+		structure := structures[deviceStructures[b.id]]
+		targetTemperature := math.NaN()
+		if targetType := sharedValue.Get("target_temperature_type").String(); targetType == "heat" || targetType == "cool" {
+			targetTemperature = sharedValue.Get("target_temperature").Float()
+		}
+		activeSensors := []string{b.id}
+		if active := rcsSettings[b.id].Get("active_rcs_sensors").Array(); len(active) > 0 {
+			activeSensors = nil
+			for _, sensor := range active {
+				activeSensors = append(activeSensors, strings.TrimPrefix(sensor.String(), "kryptonite."))
 			}
 		}
-		return true
-	})
+		// The energy usage history lists the days from the oldest to today.
+		usage := make(map[string]EnergyUsage)
+		days := energy[b.id].Get("days").Array()
+		for i, day := range []string{"today", "yesterday"} {
+			if i < len(days) {
+				usage[day] = EnergyUsage{
+					HeatingSeconds: days[len(days)-1-i].Get("total_heating_time").Float(),
+					CoolingSeconds: days[len(days)-1-i].Get("total_cooling_time").Float(),
+				}
+			}
+		}
+		var heatLink *HeatLink
+		if b.value.Get("heat_link_connection").Exists() {
+			heatLink = &HeatLink{
+				Connection:  b.value.Get("heat_link_connection").Int(),
+				Temperature: math.NaN(),
+			}
+			if v := b.value.Get("heat_link_temperature"); v.Exists() {
+				heatLink.Temperature = v.Float()
+			}
+		}
+		var humidifier *Humidifier
+		if b.value.Get("has_humidifier").Bool() || b.value.Get("has_dehumidifier").Bool() {
+			humidifier = &Humidifier{
+				TargetHumidity: math.NaN(),
+				Humidifying:    b.value.Get("humidifier_state").Bool(),
+				Dehumidifying:  b.value.Get("dehumidifier_state").Bool(),
+			}
+			if b.value.Get("target_humidity_enabled").Bool() {
+				humidifier.TargetHumidity = b.value.Get("target_humidity").Float()
+			}
+		}
+		// The schedule has the entries of each day, where day 0 is Monday.
+		var schedule []ScheduleEntry
+		schedules[b.id].Get("days").ForEach(func(day, entries gjson.Result) bool {
+			entries.ForEach(func(_, entry gjson.Result) bool {
+				if temp := entry.Get("temp"); temp.Exists() {
+					schedule = append(schedule, ScheduleEntry{
+						Weekday:     time.Weekday((day.Int() + 1) % 7),
+						Seconds:     entry.Get("time").Int(),
+						Temperature: temp.Float(),
+					})
+				}
+				return true
+			})
+			return true
+		})
+		location := structure.Location
+		if location == nil {
+			location = time.Local
+		}
+		var targetReachedAt time.Time
+		if ts := b.value.Get("time_to_target").Int(); ts > 0 {
+			targetReachedAt = time.Unix(ts, 0)
+		}
+		backplateTemperature := math.NaN()
+		if v := b.value.Get("backplate_temperature"); v.Exists() {
+			backplateTemperature = v.Float()
+		}
+		var fanTimerTimeout time.Time
+		if ts := b.value.Get("fan_timer_timeout").Int(); ts > 0 {
+			fanTimerTimeout = time.Unix(ts, 0)
+		}
+		var lastConnection time.Time
+		if ms := tracks[b.id].Get("last_connection").Int(); ms > 0 {
+			lastConnection = time.Unix(0, ms*int64(time.Millisecond))
+		}
+		thermostats = append(thermostats, Thermostat{
+			SerialNumber:         b.id,
+			StructureName:        structure.Name,
+			WhereName:            structure.WhereNames[b.value.Get("where_id").String()],
+			AmbientTemperature:   sharedValue.Get("current_temperature").Float(),
+			BackplateTemperature: backplateTemperature,
+			TargetTemperature:    targetTemperature,
+			HeaterOn:             sharedValue.Get("hvac_heater_state").Bool(),
+			AuxHeaterOn:          sharedValue.Get("hvac_aux_heater_state").Bool(),
+			EmergencyHeatOn:      sharedValue.Get("hvac_emer_heat_state").Bool(),
+			ACOn:                 sharedValue.Get("hvac_ac_state").Bool(),
+			FanOn:                sharedValue.Get("hvac_fan_state").Bool(),
+			FanTimerTimeout:      fanTimerTimeout,
+			Leaf:                 b.value.Get("leaf").Bool(),
+			Learning:             b.value.Get("learning_mode").Bool(),
+			TargetReachedAt:      targetReachedAt,
+			Online:               tracks[b.id].Get("online").Bool(),
+			LastConnection:       lastConnection,
+			Capabilities: Capabilities{
+				CanHeat:       b.value.Get("can_heat").Bool(),
+				CanCool:       b.value.Get("can_cool").Bool(),
+				HasFan:        b.value.Get("has_fan").Bool(),
+				HasHumidifier: b.value.Get("has_humidifier").Bool(),
+			},
+			ActiveSensors: activeSensors,
+			Usage:         usage,
+			HeatLink:      heatLink,
+			Humidifier:    humidifier,
+			Schedule:      schedule,
+			Location:      location,
+		})
+	}
 
-	// Populate the outside temperature for each structure from the returned weather info.
-	if weatherForStructures := gjson.Get(string(body), "weather_for_structures"); weatherForStructures.Exists() {
-		weatherForStructures.ForEach(func(key, value gjson.Result) bool {
+	// Populate our "protects" list from the returned "topaz" objects, which are online when their "widget_track"
+	// counterparts say so.
+	widgetTracks := make(map[string]gjson.Result)
+	for _, b := range buckets["widget_track"] {
+		widgetTracks[b.id] = b.value
+	}
+	protects := make([]Protect, 0)
+	for _, b := range buckets["topaz"] {
+		structure := structures[b.value.Get("structure_id").String()]
+		protect := Protect{
+			SerialNumber:  b.value.Get("serial_number").String(),
+			StructureName: structure.Name,
+			WhereName:     structure.WhereNames[b.value.Get("where_id").String()],
+			SmokeStatus:   b.value.Get("smoke_status").Int(),
+			COStatus:      b.value.Get("co_status").Int(),
+			BatteryHealth: b.value.Get("battery_health_state").Int(),
+			Online:        widgetTracks[b.id].Get("online").Bool(),
+		}
+		if ts := b.value.Get("latest_manual_test_end_utc_secs").Int(); ts > 0 {
+			protect.LastManualTest = time.Unix(ts, 0)
+		}
+		if ts := b.value.Get("last_audio_self_test_end_utc_secs").Int(); ts > 0 {
+			protect.LastSelfTest = time.Unix(ts, 0)
+		}
+		protects = append(protects, protect)
+	}
+
+	// Populate our "cameras" list from the returned "quartz" objects.
+	cameras := make([]Camera, 0)
+	for _, b := range buckets["quartz"] {
+		structure := structures[b.value.Get("structure_id").String()]
+		cameras = append(cameras, Camera{
+			SerialNumber:     b.value.Get("serial_number").String(),
+			StructureName:    structure.Name,
+			WhereName:        structure.WhereNames[b.value.Get("where_id").String()],
+			Online:           b.value.Get("is_online").Bool(),
+			StreamingEnabled: strings.HasSuffix(b.value.Get("streaming_state").String(), "-enabled"),
+		})
+	}
+
+	// Populate our "locks" list from the returned "yale" objects.
+	locks := make([]Lock, 0)
+	for _, b := range buckets["yale"] {
+		structure := structures[b.value.Get("structure_id").String()]
+		locks = append(locks, Lock{
+			SerialNumber:  b.value.Get("serial_number").String(),
+			StructureName: structure.Name,
+			WhereName:     structure.WhereNames[b.value.Get("where_id").String()],
+			Locked:        b.value.Get("bolt_locked").Bool(),
+			BatteryLevel:  b.value.Get("battery_level").Int(),
+		})
+	}
+
+	// Populate the outside weather for each structure from the returned weather info.
+	if res.weather.Exists() {
+		res.weather.ForEach(func(key, value gjson.Result) bool {
 			if strings.HasPrefix(key.String(), "structure.") {
 				structureId := strings.TrimPrefix(key.String(), "structure.")
 				structure, found := structures[structureId]
@@ -357,8 +1768,21 @@ func (c *Collector) getReadings() (readings *Readings, err error) {
 					if current := value.Get("current"); current.Exists() {
 						if tempC := current.Get("temp_c"); tempC.Exists() {
 							structure.OutsideTemperature = tempC.Float()
-							structures[structureId] = structure
 						}
+						if humidity := current.Get("humidity"); humidity.Exists() {
+							structure.OutsideHumidity = humidity.Float()
+						}
+						if windMph := current.Get("wind_mph"); windMph.Exists() {
+							structure.WindSpeed = windMph.Float() * metersPerSecondPerMph
+						}
+						structure.Condition = current.Get("condition").String()
+						if sunrise := current.Get("sunrise").Int(); sunrise > 0 {
+							structure.Sunrise = time.Unix(sunrise, 0)
+						}
+						if sunset := current.Get("sunset").Int(); sunset > 0 {
+							structure.Sunset = time.Unix(sunset, 0)
+						}
+						structures[structureId] = structure
 					}
 				}
 			}
@@ -367,13 +1791,33 @@ func (c *Collector) getReadings() (readings *Readings, err error) {
 	}
 
 	structuresList := make([]Structure, 0)
-	for _, structure := range structures {
-		structuresList = append(structuresList, structure)
+	for _, b := range buckets["structure"] {
+		structuresList = append(structuresList, structures[b.id])
 	}
 	return &Readings{
-		structures: structuresList,
-		sensors:    sensors,
-	}, nil
+		structures:  structuresList,
+		sensors:     sensors,
+		thermostats: thermostats,
+		protects:    protects,
+		cameras:     cameras,
+		locks:       locks,
+	}
+}
+
+// withTimestamp sets the timestamp of the metric to the given time if the Collector exports metric timestamps.
+func (c *Collector) withTimestamp(m prometheus.Metric, t time.Time) prometheus.Metric {
+	if !c.config.MetricTimestamps || t.Unix() <= 0 {
+		return m
+	}
+	return prometheus.NewMetricWithTimestamp(t, m)
+}
+
+// temperature converts a temperature in Celsius, as reported by Nest app API, to the unit of the exported metrics.
+func (c *Collector) temperature(celsiusTemp float64) float64 {
+	if c.config.Unit == fahrenheit {
+		return celsiusTemp*9/5 + 32
+	}
+	return celsiusTemp
 }
 
 func b2f(b bool) float64 {
@@ -0,0 +1,904 @@
+package nestapp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"pronestheus/test"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestServerResponses(t *testing.T) {
+	server := test.NestAppServer("NID=valid")
+
+	tests := []struct {
+		name                   string
+		cookies                string
+		issueJWTURL            string
+		wantErr                bool
+		wantGoogleAuthFailures uint64
+		wantJWTFailures        uint64
+	}{
+		{
+			name:        "valid response",
+			cookies:     "NID=valid",
+			issueJWTURL: server.URL + "/issue_jwt",
+		}, {
+			name:                   "logged out",
+			cookies:                "NID=expired",
+			issueJWTURL:            server.URL + "/issue_jwt",
+			wantErr:                true,
+			wantGoogleAuthFailures: 1,
+		}, {
+			name:            "failed Nest access token",
+			cookies:         "NID=valid",
+			issueJWTURL:     server.URL + "/nonexisting",
+			wantErr:         true,
+			wantJWTFailures: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{
+				Logger:      log.NewNopLogger(),
+				Timeout:     5000,
+				AuthURL:     server.URL + "/auth",
+				AuthCookies: test.cookies,
+				IssueJWTURL: test.issueJWTURL,
+				APIURL:      server.URL,
+			})
+			// Authentication only happens on the first scrape.
+			assert.NoError(t, err)
+
+			readings, err := c.getReadings()
+			assert.Equal(t, uint64(1), c.reauths)
+			assert.Equal(t, test.wantGoogleAuthFailures, c.googleAuthFailures)
+			assert.Equal(t, test.wantJWTFailures, c.jwtFailures)
+			if test.wantErr {
+				assert.Nil(t, readings)
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, readings.structures, 1)
+			assert.Len(t, readings.sensors, 1)
+			assert.Len(t, readings.thermostats, 2)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), c.tokenValidUntil(), time.Minute)
+			// The response is gzipped.
+			assert.Greater(t, c.transferredBytes, uint64(0))
+			assert.Less(t, c.transferredBytes, c.responseBytes)
+		})
+	}
+}
+
+func TestConcurrentReauth(t *testing.T) {
+	server := test.NestAppServer("NID=valid")
+	var authRequests int32
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/auth" {
+			atomic.AddInt32(&authRequests, 1)
+		}
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+
+	c, err := New(Config{
+		Logger:      log.NewNopLogger(),
+		Timeout:     5000,
+		AuthURL:     counting.URL + "/auth",
+		AuthCookies: "NID=valid",
+		IssueJWTURL: counting.URL + "/issue_jwt",
+		APIURL:      counting.URL,
+	})
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.getReadings()
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&authRequests))
+}
+
+func TestAuthTimeout(t *testing.T) {
+	server := test.NestAppServer("NID=valid")
+	slowAuth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/auth" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+
+	tests := []struct {
+		name        string
+		timeout     int
+		authTimeout int
+		wantErr     bool
+	}{
+		{
+			name:    "auth within the timeout",
+			timeout: 5000,
+		}, {
+			name:    "auth slower than the timeout",
+			timeout: 100,
+			wantErr: true,
+		}, {
+			name:        "auth within the auth timeout",
+			timeout:     100,
+			authTimeout: 5000,
+		}, {
+			name:        "auth slower than the auth timeout",
+			timeout:     5000,
+			authTimeout: 100,
+			wantErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{
+				Logger:      log.NewNopLogger(),
+				Timeout:     test.timeout,
+				AuthTimeout: test.authTimeout,
+				AuthURL:     slowAuth.URL + "/auth",
+				AuthCookies: "NID=valid",
+				IssueJWTURL: slowAuth.URL + "/issue_jwt",
+				APIURL:      slowAuth.URL,
+			})
+			assert.NoError(t, err)
+
+			_, err = c.getReadings()
+			if test.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, uint64(1), c.googleAuthFailures)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMetricPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		prefix     string
+		wantPrefix string
+	}{
+		{name: "default", wantPrefix: `fqName: "nest_`},
+		{name: "custom", prefix: "nestapp", wantPrefix: `fqName: "nestapp_`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{Logger: log.NewNopLogger(), MetricPrefix: test.prefix})
+			assert.NoError(t, err)
+
+			ch := make(chan *prometheus.Desc)
+			go func() {
+				c.Describe(ch)
+				close(ch)
+			}()
+			for desc := range ch {
+				assert.Contains(t, desc.String(), test.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestBucketTypes(t *testing.T) {
+	server := test.NestAppServer("NID=valid")
+	var reqBody []byte
+	recording := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/app_launch") {
+			reqBody, _ = io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(reqBody))
+		}
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+
+	tests := []struct {
+		name            string
+		bucketTypes     []string
+		wantBucketTypes []string
+	}{
+		{
+			name:            "default",
+			wantBucketTypes: bucketTypes,
+		}, {
+			name:            "custom",
+			bucketTypes:     []string{"structure", "where", "kryptonite"},
+			wantBucketTypes: []string{"structure", "where", "kryptonite"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{
+				Logger:      log.NewNopLogger(),
+				Timeout:     5000,
+				AuthURL:     recording.URL + "/auth",
+				AuthCookies: "NID=valid",
+				IssueJWTURL: recording.URL + "/issue_jwt",
+				APIURL:      recording.URL,
+				BucketTypes: test.bucketTypes,
+			})
+			assert.NoError(t, err)
+
+			_, err = c.getReadings()
+			assert.NoError(t, err)
+
+			var gotBucketTypes []string
+			for _, bucketType := range gjson.GetBytes(reqBody, "known_bucket_types").Array() {
+				gotBucketTypes = append(gotBucketTypes, bucketType.String())
+			}
+			assert.Equal(t, test.wantBucketTypes, gotBucketTypes)
+		})
+	}
+}
+
+func TestOnlineWithoutTrackBuckets(t *testing.T) {
+	server := test.NestAppServer("NID=valid")
+
+	tests := []struct {
+		name        string
+		bucketTypes []string
+		wantOnline  bool
+	}{
+		{
+			name:       "default",
+			wantOnline: true,
+		}, {
+			name:        "without track and widget_track",
+			bucketTypes: []string{"structure", "where", "device", "shared", "topaz"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{
+				Logger:      log.NewNopLogger(),
+				Timeout:     5000,
+				AuthURL:     server.URL + "/auth",
+				AuthCookies: "NID=valid",
+				IssueJWTURL: server.URL + "/issue_jwt",
+				APIURL:      server.URL,
+				BucketTypes: test.bucketTypes,
+			})
+			assert.NoError(t, err)
+
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(c)
+			families, err := registry.Gather()
+			assert.NoError(t, err)
+
+			names := map[string]bool{}
+			for _, family := range families {
+				names[family.GetName()] = true
+			}
+			assert.True(t, names["nest_app_thermostat_capabilities"])
+			assert.True(t, names["nest_app_protect_smoke_status"])
+			// Without the objects telling whether devices are online, they aren't reported as offline.
+			assert.Equal(t, test.wantOnline, names["nest_app_thermostat_online"])
+			assert.Equal(t, test.wantOnline, names["nest_app_protect_online"])
+		})
+	}
+}
+
+func TestServerErrorRetries(t *testing.T) {
+	server := test.NestAppServer("NID=valid")
+	var appLaunches int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first two app_launch requests fail.
+		if strings.HasSuffix(r.URL.Path, "/app_launch") && atomic.AddInt32(&appLaunches, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+
+	c, err := New(Config{
+		Logger:      log.NewNopLogger(),
+		Timeout:     5000,
+		AuthURL:     failing.URL + "/auth",
+		AuthCookies: "NID=valid",
+		IssueJWTURL: failing.URL + "/issue_jwt",
+		APIURL:      failing.URL,
+	})
+	assert.NoError(t, err)
+	c.retryDelays = []time.Duration{time.Millisecond, time.Millisecond}
+
+	readings, err := c.getReadings()
+	assert.NoError(t, err)
+	assert.Len(t, readings.thermostats, 2)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&appLaunches))
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&c.retries))
+
+	// Give up after the last retry.
+	atomic.StoreInt32(&appLaunches, -2)
+	_, err = c.getReadings()
+	assert.ErrorIs(t, err, errNon200Response)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&appLaunches))
+}
+
+func TestRetriesWithinTimeout(t *testing.T) {
+	server := test.NestAppServer("NID=valid")
+	var appLaunches int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/app_launch") {
+			atomic.AddInt32(&appLaunches, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+
+	c, err := New(Config{
+		Logger:      log.NewNopLogger(),
+		Timeout:     500,
+		AuthURL:     failing.URL + "/auth",
+		AuthCookies: "NID=valid",
+		IssueJWTURL: failing.URL + "/issue_jwt",
+		APIURL:      failing.URL,
+	})
+	assert.NoError(t, err)
+	c.retryDelays = []time.Duration{200 * time.Millisecond, 200 * time.Millisecond, 200 * time.Millisecond}
+
+	// The retries which would end after the timeout aren't made.
+	start := time.Now()
+	_, err = c.getReadings()
+	assert.ErrorIs(t, err, errNon200Response)
+	assert.Less(t, time.Since(start), 500*time.Millisecond+50*time.Millisecond)
+	assert.Less(t, atomic.LoadInt32(&appLaunches), int32(4))
+}
+
+func TestDroppedConnectionRetries(t *testing.T) {
+	server := test.NestAppServer("NID=valid")
+	var appLaunches int32
+	dropping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first app_launch request has its connection dropped without a response.
+		if strings.HasSuffix(r.URL.Path, "/app_launch") && atomic.AddInt32(&appLaunches, 1) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			assert.NoError(t, err)
+			conn.Close()
+			return
+		}
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+
+	c, err := New(Config{
+		Logger:      log.NewNopLogger(),
+		Timeout:     5000,
+		AuthURL:     dropping.URL + "/auth",
+		AuthCookies: "NID=valid",
+		IssueJWTURL: dropping.URL + "/issue_jwt",
+		APIURL:      dropping.URL,
+	})
+	assert.NoError(t, err)
+	c.retryDelays = []time.Duration{time.Millisecond}
+
+	readings, err := c.getReadings()
+	assert.NoError(t, err)
+	assert.Len(t, readings.thermostats, 2)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&appLaunches))
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&c.retries))
+}
+
+func TestRateLimited(t *testing.T) {
+	server := test.NestAppServer("NID=valid")
+	var appLaunches int32
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/app_launch") {
+			atomic.AddInt32(&appLaunches, 1)
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+
+	c, err := New(Config{
+		Logger:      log.NewNopLogger(),
+		Timeout:     5000,
+		AuthURL:     limited.URL + "/auth",
+		AuthCookies: "NID=valid",
+		IssueJWTURL: limited.URL + "/issue_jwt",
+		APIURL:      limited.URL,
+	})
+	assert.NoError(t, err)
+
+	_, err = c.getReadings()
+	assert.ErrorIs(t, err, errNon200Response)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), c.backoffUntil, 5*time.Second)
+
+	// No requests are made while backing off, and rate limited requests aren't retried.
+	_, err = c.getReadings()
+	assert.ErrorIs(t, err, errRateLimited)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&appLaunches))
+}
+
+func TestSubscribe(t *testing.T) {
+	server := test.NestAppServer("NID=valid")
+
+	c, err := New(Config{
+		Logger:      log.NewNopLogger(),
+		Timeout:     5000,
+		AuthURL:     server.URL + "/auth",
+		AuthCookies: "NID=valid",
+		IssueJWTURL: server.URL + "/issue_jwt",
+		APIURL:      server.URL,
+	})
+	assert.NoError(t, err)
+
+	// The first subscription fetches all readings, and then waits for their updates.
+	assert.NoError(t, c.subscribe(context.Background()))
+	assert.True(t, c.subscribed())
+
+	readings, err := c.getReadings()
+	assert.NoError(t, err)
+	assert.Len(t, readings.thermostats, 2)
+	assert.Equal(t, 21.5, readings.thermostats[0].AmbientTemperature)
+	assert.False(t, readings.thermostats[0].HeaterOn)
+	assert.Equal(t, 25.5, readings.thermostats[1].AmbientTemperature)
+	assert.Equal(t, 4.5, readings.structures[0].OutsideTemperature)
+}
+
+func TestSubscribeDone(t *testing.T) {
+	server := test.NestAppServer("NID=valid")
+	polling := make(chan struct{})
+	canceled := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v6/subscribe" {
+			// The server only notices the client going away once the body is read.
+			io.ReadAll(r.Body)
+			close(polling)
+			<-r.Context().Done()
+			close(canceled)
+			return
+		}
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+	// The transport URL of the app_launch response is the host of the request, so the long-poll comes here too.
+	defer hanging.Close()
+
+	done := make(chan struct{})
+	_, err := New(Config{
+		Logger:      log.NewNopLogger(),
+		Timeout:     5000,
+		AuthURL:     hanging.URL + "/auth",
+		AuthCookies: "NID=valid",
+		IssueJWTURL: hanging.URL + "/issue_jwt",
+		APIURL:      hanging.URL,
+		Subscribe:   true,
+		Done:        done,
+	})
+	assert.NoError(t, err)
+
+	select {
+	case <-polling:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no long-poll")
+	}
+
+	// Closing Done cancels the long-poll in progress.
+	close(done)
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("long-poll not canceled")
+	}
+}
+
+func TestBucketCache(t *testing.T) {
+	now := time.Unix(1610000000, 0)
+	var cache bucketCache
+
+	versions, full := cache.knownVersions(now)
+	assert.Equal(t, "[]", versions)
+	assert.True(t, full)
+
+	cache.merge(parseAppLaunch([]byte(`{"updated_buckets":[
+{"object_key":"structure.S","object_revision":1,"object_timestamp":100,"value":{"name":"Home"}},
+{"object_key":"shared.T","object_revision":5,"object_timestamp":100,"value":{"current_temperature":20}}
+]}`)), full, now)
+
+	versions, full = cache.knownVersions(now.Add(time.Minute))
+	assert.JSONEq(t, `[
+{"object_key":"structure.S","object_revision":1,"object_timestamp":100},
+{"object_key":"shared.T","object_revision":5,"object_timestamp":100}
+]`, versions)
+	assert.False(t, full)
+
+	// Only the changed buckets are returned, but the cache has all of them.
+	cache.merge(parseAppLaunch([]byte(`{"updated_buckets":[
+{"object_key":"shared.T","object_revision":6,"object_timestamp":200,"value":{"current_temperature":21}}
+],"weather_for_structures":{"structure.S":{"current":{"temp_c":4.5}}}}`)), full, now.Add(time.Minute))
+	snapshot := cache.snapshot()
+	assert.Len(t, snapshot.buckets, 2)
+	assert.JSONEq(t, `{"object_key":"structure.S","object_revision":1,"object_timestamp":100,"value":{"name":"Home"}}`, snapshot.buckets[0].Raw)
+	assert.JSONEq(t, `{"object_key":"shared.T","object_revision":6,"object_timestamp":200,"value":{"current_temperature":21}}`, snapshot.buckets[1].Raw)
+	assert.JSONEq(t, `{"structure.S":{"current":{"temp_c":4.5}}}`, snapshot.weather.Raw)
+
+	// All buckets are fetched anew from time to time.
+	versions, full = cache.knownVersions(now.Add(fullFetchInterval))
+	assert.Equal(t, "[]", versions)
+	assert.True(t, full)
+}
+
+func TestParseReadings(t *testing.T) {
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	assert.NoError(t, err)
+
+	readings := parseReadings(test.NestAppLaunch())
+
+	assert.Equal(t, []Structure{
+		{
+			Id:                 "STRUCTURE_ID",
+			Name:               "Home",
+			WhereNames:         map[string]string{"WHERE_LIVING_ROOM": "Living Room", "WHERE_BEDROOM": "Bedroom"},
+			OutsideTemperature: 4.5,
+			OutsideHumidity:    86,
+			WindSpeed:          4.4704,
+			Condition:          "Cloudy",
+			Sunrise:            time.Unix(1609992000, 0),
+			Sunset:             time.Unix(1610020800, 0),
+			Location:           amsterdam,
+			PostalCode:         "1012 JS",
+			CountryCode:        "NL",
+			Latitude:           52.3731,
+			Longitude:          4.8922,
+			Away:               true,
+			AwayChangedAt:      time.Unix(1609990000, 0),
+			RushHourEnrolled:   true,
+			RushHourStart:      time.Unix(1610035200, 0),
+			RushHourEnd:        time.Unix(1610046000, 0),
+		},
+	}, readings.structures)
+	assert.Equal(t, []NestTemperatureSensor{
+		{
+			SerialNumber:     "SENSOR_SERIAL",
+			ThermostatSerial: "THERMOSTAT_SERIAL",
+			StructureName:    "Home",
+			WhereName:        "Bedroom",
+			LastUpdatedAt:    time.Unix(1610000000, 0),
+			Temperature:      18.5,
+			BatteryLevel:     92,
+		},
+	}, readings.sensors)
+	assert.Equal(t, []Thermostat{
+		{
+			SerialNumber:         "THERMOSTAT_SERIAL",
+			StructureName:        "Home",
+			WhereName:            "Living Room",
+			AmbientTemperature:   20.5,
+			BackplateTemperature: 23.25,
+			TargetTemperature:    21,
+			HeaterOn:             true,
+			ACOn:                 false,
+			FanOn:                true,
+			FanTimerTimeout:      time.Unix(1610003600, 0),
+			Leaf:                 true,
+			Learning:             true,
+			TargetReachedAt:      time.Unix(1610001800, 0),
+			Online:               true,
+			LastConnection:       time.Unix(1610000123, 456000000),
+			Capabilities:         Capabilities{CanHeat: true, HasFan: true},
+			ActiveSensors:        []string{"SENSOR_SERIAL"},
+			Usage: map[string]EnergyUsage{
+				"today":     {HeatingSeconds: 1800},
+				"yesterday": {HeatingSeconds: 5400},
+			},
+			HeatLink: &HeatLink{Connection: 3, Temperature: 35.5},
+			Schedule: []ScheduleEntry{
+				{Weekday: time.Monday, Seconds: 25200, Temperature: 20},
+				{Weekday: time.Monday, Seconds: 79200, Temperature: 16},
+				{Weekday: time.Saturday, Seconds: 32400, Temperature: 21},
+			},
+			Location: amsterdam,
+		}, {
+			SerialNumber:         "THERMOSTAT_2_SERIAL",
+			StructureName:        "Home",
+			WhereName:            "Bedroom",
+			AmbientTemperature:   25.5,
+			BackplateTemperature: 27,
+			TargetTemperature:    24,
+			HeaterOn:             false,
+			AuxHeaterOn:          true,
+			ACOn:                 true,
+			Online:               false,
+			LastConnection:       time.Unix(1609000000, 0),
+			Capabilities:         Capabilities{CanHeat: true, CanCool: true, HasHumidifier: true},
+			ActiveSensors:        []string{"THERMOSTAT_2_SERIAL"},
+			Usage:                map[string]EnergyUsage{},
+			Humidifier:           &Humidifier{TargetHumidity: 40, Humidifying: true},
+			Location:             amsterdam,
+		},
+	}, readings.thermostats)
+	assert.Equal(t, []Protect{
+		{
+			SerialNumber:   "PROTECT_SERIAL",
+			StructureName:  "Home",
+			WhereName:      "Living Room",
+			SmokeStatus:    0,
+			COStatus:       0,
+			BatteryHealth:  1,
+			Online:         true,
+			LastManualTest: time.Unix(1600000000, 0),
+			LastSelfTest:   time.Unix(1609900000, 0),
+		},
+	}, readings.protects)
+	assert.Equal(t, []Camera{
+		{
+			SerialNumber:     "CAMERA_SERIAL",
+			StructureName:    "Home",
+			WhereName:        "Living Room",
+			Online:           true,
+			StreamingEnabled: false,
+		},
+	}, readings.cameras)
+	assert.Equal(t, []Lock{
+		{
+			SerialNumber:  "LOCK_SERIAL",
+			StructureName: "Home",
+			WhereName:     "Living Room",
+			Locked:        true,
+			BatteryLevel:  15,
+		},
+	}, readings.locks)
+}
+
+func TestFilterStructures(t *testing.T) {
+	readings := &Readings{
+		structures:  []Structure{{Id: "HOME_ID", Name: "Home"}, {Id: "PARENTS_ID", Name: "Parents"}},
+		sensors:     []NestTemperatureSensor{{SerialNumber: "SENSOR_1", StructureName: "Home"}, {SerialNumber: "SENSOR_2", StructureName: "Parents"}},
+		thermostats: []Thermostat{{SerialNumber: "THERMOSTAT_1", StructureName: "Parents"}},
+		protects:    []Protect{{SerialNumber: "PROTECT_1", StructureName: "Home"}},
+	}
+
+	filtered := filterStructures(readings, []string{"Home"})
+	assert.Equal(t, []Structure{{Id: "HOME_ID", Name: "Home"}}, filtered.structures)
+	assert.Equal(t, []NestTemperatureSensor{{SerialNumber: "SENSOR_1", StructureName: "Home"}}, filtered.sensors)
+	assert.Empty(t, filtered.thermostats)
+	assert.Len(t, filtered.protects, 1)
+
+	// Structures can be given by their IDs too.
+	filtered = filterStructures(readings, []string{"PARENTS_ID"})
+	assert.Equal(t, []Structure{{Id: "PARENTS_ID", Name: "Parents"}}, filtered.structures)
+	assert.Equal(t, []Thermostat{{SerialNumber: "THERMOSTAT_1", StructureName: "Parents"}}, filtered.thermostats)
+	assert.Empty(t, filtered.protects)
+}
+
+func TestTargetTemperature(t *testing.T) {
+	tests := []struct {
+		name       string
+		targetType string
+		want       float64
+	}{
+		{name: "heating", targetType: "heat", want: 21},
+		{name: "cooling", targetType: "cool", want: 21},
+		{name: "heat-cool", targetType: "range", want: math.NaN()},
+		{name: "off", targetType: "off", want: math.NaN()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := `{"updated_buckets": [
+				{"object_key": "device.SERIAL", "value": {}},
+				{"object_key": "shared.SERIAL", "value": {"target_temperature_type": "` + test.targetType + `", "target_temperature": 21}}
+			]}`
+			readings := parseReadings([]byte(body))
+
+			assert.Len(t, readings.thermostats, 1)
+			if math.IsNaN(test.want) {
+				assert.True(t, math.IsNaN(readings.thermostats[0].TargetTemperature))
+			} else {
+				assert.Equal(t, test.want, readings.thermostats[0].TargetTemperature)
+			}
+		})
+	}
+}
+
+func TestParseEmptyReadings(t *testing.T) {
+	readings := parseReadings([]byte(`{"updated_buckets": []}`))
+
+	assert.Empty(t, readings.structures)
+	assert.Empty(t, readings.sensors)
+	assert.Empty(t, readings.thermostats)
+	assert.Empty(t, readings.protects)
+	assert.Empty(t, readings.cameras)
+	assert.Empty(t, readings.locks)
+}
+
+func TestRushHourActive(t *testing.T) {
+	start := time.Unix(1610035200, 0)
+	structure := Structure{RushHourEnrolled: true, RushHourStart: start, RushHourEnd: start.Add(3 * time.Hour)}
+
+	assert.False(t, structure.rushHourActive(start.Add(-time.Minute)))
+	assert.True(t, structure.rushHourActive(start))
+	assert.True(t, structure.rushHourActive(start.Add(2*time.Hour)))
+	assert.False(t, structure.rushHourActive(start.Add(3*time.Hour)))
+	assert.False(t, Structure{}.rushHourActive(start))
+}
+
+func TestNextSetpoint(t *testing.T) {
+	therm := Thermostat{
+		Schedule: []ScheduleEntry{
+			{Weekday: time.Monday, Seconds: 7 * 3600, Temperature: 20},
+			{Weekday: time.Monday, Seconds: 22 * 3600, Temperature: 16},
+			{Weekday: time.Saturday, Seconds: 9 * 3600, Temperature: 21},
+		},
+		Location: time.UTC,
+	}
+	monday := time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		wantTemp float64
+		wantAt   time.Time
+	}{
+		{
+			name:     "later the same day",
+			now:      monday.Add(8 * time.Hour),
+			wantTemp: 16,
+			wantAt:   monday.Add(22 * time.Hour),
+		}, {
+			name:     "later in the week",
+			now:      monday.Add(23 * time.Hour),
+			wantTemp: 21,
+			wantAt:   monday.AddDate(0, 0, 5).Add(9 * time.Hour),
+		}, {
+			name:     "next week",
+			now:      monday.AddDate(0, 0, 6),
+			wantTemp: 20,
+			wantAt:   monday.AddDate(0, 0, 7).Add(7 * time.Hour),
+		}, {
+			name:     "at the start of a setpoint",
+			now:      monday.Add(7 * time.Hour),
+			wantTemp: 16,
+			wantAt:   monday.Add(22 * time.Hour),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			temp, at, found := therm.nextSetpoint(test.now)
+			assert.True(t, found)
+			assert.Equal(t, test.wantTemp, temp)
+			assert.True(t, test.wantAt.Equal(at))
+		})
+	}
+
+	_, _, found := Thermostat{Location: time.UTC}.nextSetpoint(monday)
+	assert.False(t, found)
+}
+
+func TestSensorStale(t *testing.T) {
+	updated := time.Unix(1610000000, 0)
+	sensor := NestTemperatureSensor{LastUpdatedAt: updated}
+
+	assert.False(t, sensor.stale(updated.Add(30*time.Minute), time.Hour))
+	assert.False(t, sensor.stale(updated.Add(time.Hour), time.Hour))
+	assert.True(t, sensor.stale(updated.Add(61*time.Minute), time.Hour))
+
+	// Sensors which never reported an update aren't considered stale.
+	assert.False(t, NestTemperatureSensor{LastUpdatedAt: time.Unix(0, 0)}.stale(updated, time.Hour))
+}
+
+func TestSensorBatteryLow(t *testing.T) {
+	assert.False(t, NestTemperatureSensor{BatteryLevel: 92}.batteryLow())
+	assert.False(t, NestTemperatureSensor{BatteryLevel: sensorBatteryLowLevel}.batteryLow())
+	assert.True(t, NestTemperatureSensor{BatteryLevel: sensorBatteryLowLevel - 1}.batteryLow())
+}
+
+func TestAuthCookies(t *testing.T) {
+	c := &Collector{config: Config{AuthCookies: "NID=inline"}}
+	cookies, err := c.authCookies()
+	assert.NoError(t, err)
+	assert.Equal(t, "NID=inline", cookies)
+
+	// The file takes precedence and is read anew every time.
+	file := filepath.Join(t.TempDir(), "cookies")
+	c.config.AuthCookiesFile = file
+	_, err = c.authCookies()
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(file, []byte("NID=first\n"), 0600))
+	cookies, err = c.authCookies()
+	assert.NoError(t, err)
+	assert.Equal(t, "NID=first", cookies)
+
+	assert.NoError(t, os.WriteFile(file, []byte("NID=second"), 0600))
+	cookies, err = c.authCookies()
+	assert.NoError(t, err)
+	assert.Equal(t, "NID=second", cookies)
+}
+
+func TestParseMasterTokenResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantToken string
+		wantErr   bool
+	}{
+		{
+			name:      "access token",
+			body:      "Auth=ya29.token\nissueAdvice=auto\nExpiry=1610003600\n",
+			wantToken: "ya29.token",
+		}, {
+			name:    "bad master token",
+			body:    "Error=BadAuthentication\n",
+			wantErr: true,
+		}, {
+			name:    "no access token",
+			body:    "issueAdvice=auto\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := parseMasterTokenResponse(test.body)
+			if test.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.wantToken, token)
+			}
+		})
+	}
+}
+
+func TestTemperature(t *testing.T) {
+	c := &Collector{config: Config{Unit: fahrenheit}}
+	assert.Equal(t, float64(68), c.temperature(20))
+
+	c = &Collector{config: Config{Unit: celsius}}
+	assert.Equal(t, float64(20), c.temperature(20))
+	assert.True(t, math.IsNaN(c.temperature(math.NaN())))
+}
+
+func BenchmarkParseReadings(b *testing.B) {
+	body := test.NestAppLaunch()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parseReadings(body)
+	}
+}
+
+// BenchmarkParseLargeReadings parses a response with a hundred Temperature Sensors, as a large home would have.
+func BenchmarkParseLargeReadings(b *testing.B) {
+	body := test.NestAppLaunch()
+	sensor := gjson.GetBytes(body, `updated_buckets.#(object_key=="kryptonite.SENSOR_SERIAL")`).Raw
+	sensors := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		sensors = append(sensors, strings.ReplaceAll(sensor, "SENSOR_SERIAL", fmt.Sprintf("SENSOR_%d", i)))
+	}
+	body = bytes.Replace(body, []byte(`"updated_buckets": [`), []byte(`"updated_buckets": [`+strings.Join(sensors, ",")+","), 1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parseReadings(body)
+	}
+}
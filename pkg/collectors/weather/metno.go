@@ -0,0 +1,126 @@
+package weather
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultMetNoURL = "https://api.met.no/weatherapi/locationforecast/2.0/compact"
+
+var errNoCoordinates = errors.New("weather provider needs the coordinates of the location")
+
+// metNo provides the weather from the MET Norway Locationforecast API, whose first time step is the current weather.
+type metNo struct {
+	client *http.Client
+	url    string
+	// userAgent identifies the exporter, as required by the terms of service of the API.
+	userAgent string
+	unit      string
+}
+
+func (p *metNo) weather(location Location) (*Weather, error) {
+	if math.IsNaN(location.Latitude) || math.IsNaN(location.Longitude) {
+		return nil, errNoCoordinates
+	}
+
+	// Coordinates with more than four decimals are rejected.
+	query := url.Values{}
+	query.Set("lat", strconv.FormatFloat(location.Latitude, 'f', 4, 64))
+	query.Set("lon", strconv.FormatFloat(location.Longitude, 'f', 4, 64))
+	req, err := http.NewRequest("GET", p.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, errors.Wrap(errFailedRequest, err.Error())
+	}
+	req.Header.Set("User-Agent", p.userAgent)
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(errFailedRequest, err.Error())
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(errFailedReadingBody, err.Error())
+	}
+
+	if res.StatusCode != 200 {
+		return nil, errors.Wrap(errNon200Response, fmt.Sprintf("MET Norway code: %d", res.StatusCode))
+	}
+
+	var data struct {
+		Properties struct {
+			Timeseries []struct {
+				Time time.Time `json:"time"`
+				Data struct {
+					Instant struct {
+						Details struct {
+							Temperature   float64 `json:"air_temperature"`
+							Pressure      float64 `json:"air_pressure_at_sea_level"`
+							Humidity      float64 `json:"relative_humidity"`
+							WindSpeed     float64 `json:"wind_speed"`
+							WindDirection float64 `json:"wind_from_direction"`
+							Cloudiness    float64 `json:"cloud_area_fraction"`
+						} `json:"details"`
+					} `json:"instant"`
+				} `json:"data"`
+			} `json:"timeseries"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, errors.Wrap(errFailedUnmarshalling, err.Error())
+	}
+	if len(data.Properties.Timeseries) == 0 {
+		return nil, errors.Wrap(errFailedUnmarshalling, "no time steps in MET Norway response")
+	}
+
+	// The forecast has no observed rain, snow, gusts or visibility.
+	current := data.Properties.Timeseries[0]
+	details := current.Data.Instant.Details
+	return &Weather{
+		Temperature:   fromCelsius(details.Temperature, p.unit),
+		Humidity:      details.Humidity,
+		Pressure:      details.Pressure,
+		ObservedAt:    current.Time,
+		WindSpeed:     details.WindSpeed,
+		WindDirection: details.WindDirection,
+		WindGust:      math.NaN(),
+		Cloudiness:    details.Cloudiness,
+		Rain:          math.NaN(),
+		Snow:          math.NaN(),
+		Visibility:    math.NaN(),
+	}, nil
+}
+
+// toCelsius converts the given temperature in the given unit to celsius.
+func toCelsius(temp float64, unit string) float64 {
+	switch unit {
+	case fahrenheit:
+		return (temp - 32) * 5 / 9
+	case "kelvin":
+		return temp - 273.15
+	default:
+		return temp
+	}
+}
+
+// fromCelsius converts the given temperature in celsius to the given unit.
+func fromCelsius(temp float64, unit string) float64 {
+	switch unit {
+	case fahrenheit:
+		return temp*9/5 + 32
+	case "kelvin":
+		return temp + 273.15
+	default:
+		return temp
+	}
+}
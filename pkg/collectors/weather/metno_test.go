@@ -0,0 +1,86 @@
+package weather
+
+import (
+	"errors"
+	"math"
+	"pronestheus/test"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetNo(t *testing.T) {
+	server := test.WeatherServerMetNo()
+	amsterdam := Location{Latitude: 52.37312, Longitude: 4.89221}
+
+	tests := []struct {
+		name      string
+		unit      string
+		userAgent string
+		location  Location
+		wantTemp  float64
+		wantErr   error
+	}{
+		{
+			name:      "celsius",
+			userAgent: "pronestheus test",
+			location:  amsterdam,
+			wantTemp:  20.5,
+		}, {
+			name:      "fahrenheit",
+			unit:      "fahrenheit",
+			userAgent: "pronestheus test",
+			location:  amsterdam,
+			wantTemp:  68.9,
+		}, {
+			name:     "no user agent",
+			location: amsterdam,
+			wantErr:  errNon200Response,
+		}, {
+			name:      "no coordinates",
+			userAgent: "pronestheus test",
+			location:  Location{Latitude: math.NaN(), Longitude: math.NaN(), City: "Amsterdam"},
+			wantErr:   errNoCoordinates,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{
+				Provider:  "metno",
+				MetNoURL:  server.URL,
+				UserAgent: test.userAgent,
+				Unit:      test.unit,
+				APIURL:    "https://example.com",
+				LocationProvider: func() (Location, bool) {
+					return test.location, true
+				},
+			})
+			assert.NoError(t, err)
+
+			weather, err := c.getWeatherReadings()
+			if test.wantErr != nil {
+				assert.Nil(t, weather)
+				assert.True(t, errors.Is(err, test.wantErr))
+				return
+			}
+			assert.NoError(t, err)
+			assert.InDelta(t, test.wantTemp, weather.Temperature, 0.001)
+			assert.Equal(t, float64(88.1), weather.Humidity)
+			assert.Equal(t, float64(1021.3), weather.Pressure)
+			assert.Equal(t, float64(3.2), weather.WindSpeed)
+			assert.Equal(t, float64(240.5), weather.WindDirection)
+			assert.Equal(t, float64(75.8), weather.Cloudiness)
+			assert.True(t, math.IsNaN(weather.Rain))
+			assert.True(t, math.IsNaN(weather.Visibility))
+			assert.True(t, weather.ObservedAt.Equal(time.Date(2020, 7, 17, 13, 0, 0, 0, time.UTC)))
+		})
+	}
+}
+
+func TestInvalidProvider(t *testing.T) {
+	c, err := New(Config{Provider: "yr", APIURL: "https://example.com"})
+	assert.Nil(t, c)
+	assert.True(t, errors.Is(err, errInvalidProvider))
+}
@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -15,51 +18,213 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// forecastHours are the hours ahead for which the forecast temperature is exported.
+var forecastHours = []int{1, 3, 6}
+
 const (
 	celsius    string = "celsius"
 	fahrenheit string = "fahrenheit"
+
+	openWeatherMap     = "openweathermap"
+	metNoProvider      = "metno"
+	weatherAPIProvider = "weatherapi"
+
+	metersPerSecondPerMph = 0.44704
+
+	defaultGeocodingURL = "http://api.openweathermap.org/geo/1.0/direct"
+	defaultOneCallURL   = "https://api.openweathermap.org/data/3.0/onecall"
 )
 
 var (
 	errNon200Response      = errors.New("openWeatherMap API responded with non-200 code")
 	errFailedParsingURL    = errors.New("failed parsing OpenWeatherMap API URL")
 	errInvalidTempUnit     = errors.New("invalid temperature unit; valid values: [celsius, fahrenheit]")
+	errInvalidUnits        = errors.New("invalid OpenWeatherMap units; valid values: [standard, metric, imperial]")
 	errFailedUnmarshalling = errors.New("failed unmarshalling OpenWeatherMap API response body")
 	errFailedRequest       = errors.New("failed OpenWeatherMap API request")
 	errFailedReadingBody   = errors.New("failed reading OpenWeatherMap API response body")
+	errUnknownCity         = errors.New("city not found by OpenWeatherMap geocoding")
+	errInvalidProvider     = errors.New("invalid weather provider; valid values: [openweathermap, metno, weatherapi]")
+	errInvalidAPIVersion   = errors.New("invalid OpenWeatherMap API version; valid values: [2.5, 3.0]")
 )
 
 // Weather stores weather data received from OpenWeatherMap API.
 type Weather struct {
-	Temperature float64 `json:"temp"`
-	Humidity    float64 `json:"humidity"`
-	Pressure    float64 `json:"pressure"`
+	Temperature float64   `json:"temp"`
+	Humidity    float64   `json:"humidity"`
+	Pressure    float64   `json:"pressure"`
+	ObservedAt  time.Time `json:"-"`
+	// WindSpeed and WindGust are in meters per second, WindGust is NaN when not reported. WindDirection is the
+	// direction the wind comes from, in degrees.
+	WindSpeed     float64 `json:"-"`
+	WindDirection float64 `json:"-"`
+	WindGust      float64 `json:"-"`
+	// Cloudiness is in percent. Rain and Snow are the volumes fallen during the last hour, in millimeters.
+	// OpenWeatherMap leaves them out when it didn't rain or snow, which gives 0. They're NaN with the providers
+	// which don't report them at all, MET Norway and WeatherAPI.com.
+	Cloudiness float64 `json:"-"`
+	Rain       float64 `json:"-"`
+	Snow       float64 `json:"-"`
+	// Visibility is in meters, NaN when the provider doesn't report it.
+	Visibility float64 `json:"-"`
+	// Sunrise and Sunset are today's sunrise and sunset at the location. Zero if unknown.
+	Sunrise time.Time `json:"-"`
+	Sunset  time.Time `json:"-"`
+	// LocationName and Country are the name and country of the location as resolved by the weather API. Empty if
+	// unknown.
+	LocationName string `json:"-"`
+	Country      string `json:"-"`
+	// OneCall is nil unless the One Call API is used.
+	OneCall *OneCallWeather `json:"-"`
+	// Forecast is nil unless the forecast API is used.
+	Forecast []ForecastTemperature `json:"-"`
+}
+
+// dewPoint returns the dew point in the given temperature unit: the one reported by the One Call API, or else the one
+// calculated from the temperature and humidity with the Magnus formula. NaN without humidity.
+func (w *Weather) dewPoint(unit string) float64 {
+	if w.OneCall != nil {
+		return w.OneCall.DewPoint
+	}
+	if w.Humidity <= 0 {
+		return math.NaN()
+	}
+
+	const b, c = 17.62, 243.12
+	temp := toCelsius(w.Temperature, unit)
+	gamma := math.Log(w.Humidity/100) + b*temp/(c+temp)
+	return fromCelsius(c*gamma/(b-gamma), unit)
+}
+
+// ForecastTemperature is the temperature forecast for the given number of hours after the observation.
+type ForecastTemperature struct {
+	Hours       int
+	Temperature float64
+}
+
+// OneCallWeather stores the current weather data only available from the OpenWeatherMap One Call API.
+type OneCallWeather struct {
+	UVIndex  float64 `json:"uvi"`
+	DewPoint float64 `json:"dew_point"`
+}
+
+// provider provides the current weather from a weather service other than OpenWeatherMap, which the Collector calls
+// itself.
+type provider interface {
+	// weather returns the current weather at the given location.
+	weather(location Location) (*Weather, error)
+}
+
+// Location is a place identified either by its coordinates or, if these are NaN, by its postal code or else by its
+// city.
+type Location struct {
+	Latitude    float64
+	Longitude   float64
+	PostalCode  string
+	CountryCode string
+	// City is a free-form city name, such as "Amsterdam" or "Amsterdam,NL", looked up with OpenWeatherMap geocoding.
+	City string
 }
 
 // Config provides the configuration necessary to create the Collector.
 type Config struct {
+	// Provider is the weather service: openweathermap, metno or weatherapi. Defaults to openweathermap. MET Norway
+	// and WeatherAPI.com only know the locations given by LocationProvider, MET Norway only by their coordinates.
+	Provider string
+	// UserAgent identifies the exporter to MET Norway, as required by its terms of service.
+	UserAgent string
+	// MetNoURL is the URL of the MET Norway Locationforecast API. Defaults to the compact forecast.
+	MetNoURL string
+	// WeatherAPIKey is the key of the WeatherAPI.com API.
+	WeatherAPIKey string
+	// WeatherAPIURL is the URL of the WeatherAPI.com current weather API. Defaults to the public one.
+	WeatherAPIURL string
 	Logger        log.Logger
 	Timeout       int
 	Unit          string
+	// Units, if set, are the units requested from OpenWeatherMap API, overriding Unit: standard for kelvin, metric
+	// for celsius or imperial for fahrenheit. The names of the temperature metrics follow them.
+	Units         string
 	APIURL        string
 	APIToken      string
 	APILocationID string
+	// MetricTimestamps makes the Collector export the metrics with the time of the weather observation instead of
+	// the time of the scrape.
+	MetricTimestamps bool
+	// APIVersion is the version of the OpenWeatherMap API: 2.5, calling the current weather API at APIURL, or 3.0,
+	// calling only the One Call API at OneCallURL. Defaults to 2.5. The One Call API only knows the locations given
+	// by LocationProvider, by their coordinates or city.
+	APIVersion string
+	// OneCallURL, if set, is the URL of the One Call API, called in addition to APIURL for the readings missing from
+	// the current weather, such as the UV index. With APIVersion 3.0 it defaults to the public One Call API.
+	OneCallURL string
+	// ForecastURL, if set, is the URL of the 5 day / 3 hour forecast API, called in addition to APIURL for the
+	// temperatures forecast 1, 3 and 6 hours ahead.
+	ForecastURL string
+	// GeocodingURL is the URL of the geocoding API, used to look up the coordinates of cities. Defaults to the
+	// OpenWeatherMap direct geocoding API.
+	GeocodingURL string
+	// LocationProvider, if set, provides the location of the weather readings, overriding APILocationID. When it
+	// returns false, APILocationID is used.
+	LocationProvider func() (Location, bool)
+	// CacheTTL is the time, in seconds, for which the weather readings are reused instead of calling the weather API
+	// again on each scrape. 0 disables the cache.
+	CacheTTL int
+	// LocationLabels adds the location and country labels, as resolved by the weather API, to the weather metrics.
+	LocationLabels bool
+	// ProviderLabel adds the provider label, with the name of Provider, to all metrics, so that the Collectors of
+	// several providers can be registered together.
+	ProviderLabel bool
 }
 
-// Collector implements the Collector interface, collecting weather data from OpenWeatherMap API.
+// Collector implements the Collector interface, collecting weather data from OpenWeatherMap API or another provider.
 type Collector struct {
-	client  *http.Client
-	url     string
-	logger  log.Logger
-	metrics *Metrics
+	client *http.Client
+	// provider is nil when the weather comes from OpenWeatherMap.
+	provider   provider
+	url        string
+	baseURL    string
+	token      string
+	units      string
+	oneCallURL string
+	// oneCallOnly is set with API version 3.0, where the One Call API replaces the current weather API.
+	oneCallOnly      bool
+	forecastURL      string
+	geocodingURL     string
+	locationProvider func() (Location, bool)
+	// cities caches the coordinates of the cities looked up by geocoding, as cities don't move.
+	citiesMu sync.Mutex
+	cities   map[string][2]float64
+	// cached are the last weather readings, reused until cacheTTL after cachedAt.
+	cacheMu          sync.Mutex
+	cacheTTL         time.Duration
+	cached           *Weather
+	cachedAt         time.Time
+	logger           log.Logger
+	metrics          *Metrics
+	metricTimestamps bool
+	locationLabels   bool
 }
 
 // Metrics contains the metrics collected by the Collector.
 type Metrics struct {
-	up       *prometheus.Desc
-	temp     *prometheus.Desc
-	humidity *prometheus.Desc
-	pressure *prometheus.Desc
+	up            *prometheus.Desc
+	temp          *prometheus.Desc
+	humidity      *prometheus.Desc
+	pressure      *prometheus.Desc
+	windSpeed     *prometheus.Desc
+	windDirection *prometheus.Desc
+	windGust      *prometheus.Desc
+	cloudiness    *prometheus.Desc
+	rain          *prometheus.Desc
+	snow          *prometheus.Desc
+	sunrise       *prometheus.Desc
+	sunset        *prometheus.Desc
+	uvIndex       *prometheus.Desc
+	dewPoint      *prometheus.Desc
+	visibility    *prometheus.Desc
+	observedAt    *prometheus.Desc
+	forecastTemp  *prometheus.Desc
 }
 
 // New creates a Collector using the given Config.
@@ -73,36 +238,124 @@ func New(cfg Config) (*Collector, error) {
 	default:
 		return nil, errInvalidTempUnit
 	}
+	switch cfg.Units {
+	case "":
+	case "standard", "metric", "imperial":
+		units = cfg.Units
+	default:
+		return nil, errInvalidUnits
+	}
 
 	rawurl := fmt.Sprintf("%s?id=%s&appid=%s&units=%s", cfg.APIURL, cfg.APILocationID, cfg.APIToken, units)
 	if _, err := url.ParseRequestURI(rawurl); err != nil {
 		return nil, errors.Wrap(errFailedParsingURL, err.Error())
 	}
 
+	if cfg.GeocodingURL == "" {
+		cfg.GeocodingURL = defaultGeocodingURL
+	}
+	switch cfg.APIVersion {
+	case "", "2.5":
+	case "3.0":
+		if cfg.OneCallURL == "" {
+			cfg.OneCallURL = defaultOneCallURL
+		}
+	default:
+		return nil, errInvalidAPIVersion
+	}
+	if cfg.MetNoURL == "" {
+		cfg.MetNoURL = defaultMetNoURL
+	}
+	if cfg.WeatherAPIURL == "" {
+		cfg.WeatherAPIURL = defaultWeatherAPIURL
+	}
+
 	client := &http.Client{
 		Timeout: time.Duration(cfg.Timeout) * time.Millisecond,
 	}
 
+	var provider provider
+	switch cfg.Provider {
+	case "", openWeatherMap:
+	case metNoProvider:
+		provider = &metNo{client: client, url: cfg.MetNoURL, userAgent: cfg.UserAgent, unit: temperatureUnit(units)}
+	case weatherAPIProvider:
+		provider = &weatherAPI{client: client, url: cfg.WeatherAPIURL, key: cfg.WeatherAPIKey, unit: temperatureUnit(units)}
+	default:
+		return nil, errInvalidProvider
+	}
+
+	providerLabel := ""
+	if cfg.ProviderLabel {
+		providerLabel = cfg.Provider
+		if providerLabel == "" {
+			providerLabel = openWeatherMap
+		}
+	}
+
 	collector := &Collector{
-		client:  client,
-		url:     rawurl,
-		logger:  cfg.Logger,
-		metrics: buildMetrics(cfg.Unit),
+		client:           client,
+		provider:         provider,
+		url:              rawurl,
+		baseURL:          cfg.APIURL,
+		token:            cfg.APIToken,
+		units:            units,
+		oneCallURL:       cfg.OneCallURL,
+		oneCallOnly:      cfg.APIVersion == "3.0",
+		forecastURL:      cfg.ForecastURL,
+		geocodingURL:     cfg.GeocodingURL,
+		cities:           make(map[string][2]float64),
+		locationProvider: cfg.LocationProvider,
+		cacheTTL:         time.Duration(cfg.CacheTTL) * time.Second,
+		logger:           cfg.Logger,
+		metrics:          buildMetrics(temperatureUnit(units), cfg.LocationLabels, providerLabel),
+		metricTimestamps: cfg.MetricTimestamps,
+		locationLabels:   cfg.LocationLabels,
 	}
 
 	return collector, nil
 }
 
-func buildMetrics(unit string) *Metrics {
-	if unit == "" {
-		unit = "celsius"
+// temperatureUnit returns the unit of the temperatures returned by OpenWeatherMap API in the given units.
+func temperatureUnit(units string) string {
+	switch units {
+	case "standard":
+		return "kelvin"
+	case "imperial":
+		return fahrenheit
+	default:
+		return celsius
+	}
+}
+
+func buildMetrics(unit string, locationLabels bool, provider string) *Metrics {
+	var labels []string
+	if locationLabels {
+		labels = []string{"location", "country"}
+	}
+	var constLabels prometheus.Labels
+	if provider != "" {
+		constLabels = prometheus.Labels{"provider": provider}
 	}
 
 	return &Metrics{
-		up:       prometheus.NewDesc(strings.Join([]string{"nest", "weather", "up"}, "_"), "Was talking to OpenWeatherMap API successful.", nil, nil),
-		temp:     prometheus.NewDesc(strings.Join([]string{"nest", "weather", "temperature", unit}, "_"), "Outside temperature.", nil, nil),
-		humidity: prometheus.NewDesc(strings.Join([]string{"nest", "weather", "humidity", "percent"}, "_"), "Outside humidity.", nil, nil),
-		pressure: prometheus.NewDesc(strings.Join([]string{"nest", "weather", "pressure", "hectopascal"}, "_"), "Outside pressure.", nil, nil),
+		up:            prometheus.NewDesc(strings.Join([]string{"nest", "weather", "up"}, "_"), "Was talking to the weather API successful.", nil, constLabels),
+		temp:          prometheus.NewDesc(strings.Join([]string{"nest", "weather", "temperature", unit}, "_"), "Outside temperature.", labels, constLabels),
+		humidity:      prometheus.NewDesc(strings.Join([]string{"nest", "weather", "humidity", "percent"}, "_"), "Outside humidity.", labels, constLabels),
+		pressure:      prometheus.NewDesc(strings.Join([]string{"nest", "weather", "pressure", "hectopascal"}, "_"), "Outside pressure.", labels, constLabels),
+		windSpeed:     prometheus.NewDesc(strings.Join([]string{"nest", "weather", "wind", "speed", "meters", "per", "second"}, "_"), "Wind speed.", labels, constLabels),
+		windDirection: prometheus.NewDesc(strings.Join([]string{"nest", "weather", "wind", "direction", "degrees"}, "_"), "Direction the wind comes from.", labels, constLabels),
+		windGust:      prometheus.NewDesc(strings.Join([]string{"nest", "weather", "wind", "gust", "meters", "per", "second"}, "_"), "Wind gust speed.", labels, constLabels),
+		cloudiness:    prometheus.NewDesc(strings.Join([]string{"nest", "weather", "cloudiness", "percent"}, "_"), "Cloudiness.", labels, constLabels),
+		rain:          prometheus.NewDesc(strings.Join([]string{"nest", "weather", "rain", "last", "hour", "millimeters"}, "_"), "Rain volume of the last hour.", labels, constLabels),
+		snow:          prometheus.NewDesc(strings.Join([]string{"nest", "weather", "snow", "last", "hour", "millimeters"}, "_"), "Snow volume of the last hour.", labels, constLabels),
+		sunrise:       prometheus.NewDesc(strings.Join([]string{"nest", "weather", "sunrise", "timestamp", "seconds"}, "_"), "Time of today's sunrise.", labels, constLabels),
+		sunset:        prometheus.NewDesc(strings.Join([]string{"nest", "weather", "sunset", "timestamp", "seconds"}, "_"), "Time of today's sunset.", labels, constLabels),
+		uvIndex:       prometheus.NewDesc(strings.Join([]string{"nest", "weather", "uv", "index"}, "_"), "UV index.", labels, constLabels),
+		dewPoint:      prometheus.NewDesc(strings.Join([]string{"nest", "weather", "dew", "point", unit}, "_"), "Dew point.", labels, constLabels),
+		visibility:    prometheus.NewDesc(strings.Join([]string{"nest", "weather", "visibility", "meters"}, "_"), "Visibility.", labels, constLabels),
+		observedAt:    prometheus.NewDesc(strings.Join([]string{"nest", "weather", "observation", "timestamp", "seconds"}, "_"), "Time of the weather observation reported by the weather API.", labels, constLabels),
+		forecastTemp:  prometheus.NewDesc(strings.Join([]string{"nest", "weather", "forecast", "temperature", unit}, "_"), "Outside temperature forecast for the given number of hours after the observation.", append([]string{"hours"}, labels...), constLabels),
 	}
 }
 
@@ -112,27 +365,202 @@ func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.metrics.temp
 	ch <- c.metrics.humidity
 	ch <- c.metrics.pressure
+	ch <- c.metrics.windSpeed
+	ch <- c.metrics.windDirection
+	ch <- c.metrics.windGust
+	ch <- c.metrics.cloudiness
+	ch <- c.metrics.rain
+	ch <- c.metrics.snow
+	ch <- c.metrics.sunrise
+	ch <- c.metrics.sunset
+	ch <- c.metrics.uvIndex
+	ch <- c.metrics.dewPoint
+	ch <- c.metrics.visibility
+	ch <- c.metrics.observedAt
+	ch <- c.metrics.forecastTemp
 }
 
 // Collect implements the prometheus.Describe interface.
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
-	weather, err := c.getWeatherReadings()
+	weather, err := c.readings()
 	if err != nil {
 		ch <- prometheus.MustNewConstMetric(c.metrics.up, prometheus.GaugeValue, 0)
-		c.logger.Log("level", "error", "message", "Failed collecting OpenWeatherMap data", "stack", errors.WithStack(err))
+		c.logger.Log("level", "error", "message", "Failed collecting weather data", "stack", errors.WithStack(err))
 		return
 	}
 
-	c.logger.Log("level", "debug", "message", "Successfully collected OpenWeatherMap data")
+	c.logger.Log("level", "debug", "message", "Successfully collected weather data")
 
 	ch <- prometheus.MustNewConstMetric(c.metrics.up, prometheus.GaugeValue, 1)
-	ch <- prometheus.MustNewConstMetric(c.metrics.temp, prometheus.GaugeValue, weather.Temperature)
-	ch <- prometheus.MustNewConstMetric(c.metrics.humidity, prometheus.GaugeValue, weather.Humidity)
-	ch <- prometheus.MustNewConstMetric(c.metrics.pressure, prometheus.GaugeValue, weather.Pressure)
+	var labels []string
+	if c.locationLabels {
+		labels = []string{weather.LocationName, weather.Country}
+	}
+	if !weather.ObservedAt.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.metrics.observedAt, prometheus.GaugeValue, float64(weather.ObservedAt.Unix()), labels...)
+	}
+	ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.temp, prometheus.GaugeValue, weather.Temperature, labels...), weather.ObservedAt)
+	ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.humidity, prometheus.GaugeValue, weather.Humidity, labels...), weather.ObservedAt)
+	ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.pressure, prometheus.GaugeValue, weather.Pressure, labels...), weather.ObservedAt)
+	ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.windSpeed, prometheus.GaugeValue, weather.WindSpeed, labels...), weather.ObservedAt)
+	ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.windDirection, prometheus.GaugeValue, weather.WindDirection, labels...), weather.ObservedAt)
+	if !math.IsNaN(weather.WindGust) {
+		ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.windGust, prometheus.GaugeValue, weather.WindGust, labels...), weather.ObservedAt)
+	}
+	ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.cloudiness, prometheus.GaugeValue, weather.Cloudiness, labels...), weather.ObservedAt)
+	if !math.IsNaN(weather.Rain) {
+		ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.rain, prometheus.GaugeValue, weather.Rain, labels...), weather.ObservedAt)
+	}
+	if !math.IsNaN(weather.Snow) {
+		ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.snow, prometheus.GaugeValue, weather.Snow, labels...), weather.ObservedAt)
+	}
+	if !weather.Sunrise.IsZero() {
+		ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.sunrise, prometheus.GaugeValue, float64(weather.Sunrise.Unix()), labels...), weather.ObservedAt)
+	}
+	if !weather.Sunset.IsZero() {
+		ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.sunset, prometheus.GaugeValue, float64(weather.Sunset.Unix()), labels...), weather.ObservedAt)
+	}
+	if weather.OneCall != nil {
+		ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.uvIndex, prometheus.GaugeValue, weather.OneCall.UVIndex, labels...), weather.ObservedAt)
+	}
+	if dewPoint := weather.dewPoint(temperatureUnit(c.units)); !math.IsNaN(dewPoint) {
+		ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.dewPoint, prometheus.GaugeValue, dewPoint, labels...), weather.ObservedAt)
+	}
+	if !math.IsNaN(weather.Visibility) {
+		ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.visibility, prometheus.GaugeValue, weather.Visibility, labels...), weather.ObservedAt)
+	}
+	for _, forecast := range weather.Forecast {
+		ch <- c.withTimestamp(prometheus.MustNewConstMetric(c.metrics.forecastTemp, prometheus.GaugeValue, forecast.Temperature, append([]string{strconv.Itoa(forecast.Hours)}, labels...)...), weather.ObservedAt)
+	}
+}
+
+// withTimestamp sets the timestamp of the metric to the given time if the Collector exports metric timestamps.
+func (c *Collector) withTimestamp(m prometheus.Metric, t time.Time) prometheus.Metric {
+	if !c.metricTimestamps || t.IsZero() {
+		return m
+	}
+	return prometheus.NewMetricWithTimestamp(t, m)
+}
+
+// requestURL returns the URL of the weather at the location given by the location provider, if any, or else at the
+// configured location ID.
+func (c *Collector) requestURL() (string, error) {
+	if c.locationProvider == nil {
+		return c.url, nil
+	}
+	location, ok := c.locationProvider()
+	if !ok {
+		return c.url, nil
+	}
+
+	query := url.Values{}
+	switch {
+	case !math.IsNaN(location.Latitude) && !math.IsNaN(location.Longitude):
+		query.Set("lat", strconv.FormatFloat(location.Latitude, 'f', -1, 64))
+		query.Set("lon", strconv.FormatFloat(location.Longitude, 'f', -1, 64))
+	case location.PostalCode != "":
+		zip := location.PostalCode
+		if location.CountryCode != "" {
+			zip += "," + location.CountryCode
+		}
+		query.Set("zip", zip)
+	case location.City != "":
+		coordinates, err := c.geocode(location.City)
+		if err != nil {
+			return "", err
+		}
+		query.Set("lat", strconv.FormatFloat(coordinates[0], 'f', -1, 64))
+		query.Set("lon", strconv.FormatFloat(coordinates[1], 'f', -1, 64))
+	default:
+		return c.url, nil
+	}
+	return fmt.Sprintf("%s?%s&appid=%s&units=%s", c.baseURL, query.Encode(), c.token, c.units), nil
+}
+
+// geocode returns the latitude and longitude of the given city, looking them up only the first time.
+func (c *Collector) geocode(city string) ([2]float64, error) {
+	c.citiesMu.Lock()
+	defer c.citiesMu.Unlock()
+	if coordinates, ok := c.cities[city]; ok {
+		return coordinates, nil
+	}
+
+	query := url.Values{}
+	query.Set("q", city)
+	query.Set("limit", "1")
+	query.Set("appid", c.token)
+	res, err := c.client.Get(c.geocodingURL + "?" + query.Encode())
+	if err != nil {
+		return [2]float64{}, errors.Wrap(errFailedRequest, err.Error())
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return [2]float64{}, errors.Wrap(errFailedReadingBody, err.Error())
+	}
+
+	if res.StatusCode != 200 {
+		return [2]float64{}, errors.Wrap(errNon200Response, fmt.Sprintf("geocoding code: %d", res.StatusCode))
+	}
+
+	var places []struct {
+		Latitude  float64 `json:"lat"`
+		Longitude float64 `json:"lon"`
+	}
+	if err := json.Unmarshal(body, &places); err != nil {
+		return [2]float64{}, errors.Wrap(errFailedUnmarshalling, err.Error())
+	}
+	if len(places) == 0 {
+		return [2]float64{}, errors.Wrap(errUnknownCity, city)
+	}
+
+	coordinates := [2]float64{places[0].Latitude, places[0].Longitude}
+	c.cities[city] = coordinates
+	return coordinates, nil
+}
+
+// readings returns the cached weather readings if they're younger than the cache TTL, or else fresh ones. Failures
+// aren't cached.
+func (c *Collector) readings() (*Weather, error) {
+	if c.cacheTTL <= 0 {
+		return c.getWeatherReadings()
+	}
+
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	if c.cached != nil && time.Since(c.cachedAt) < c.cacheTTL {
+		return c.cached, nil
+	}
+
+	weather, err := c.getWeatherReadings()
+	if err != nil {
+		return nil, err
+	}
+	c.cached, c.cachedAt = weather, time.Now()
+	return weather, nil
 }
 
 func (c *Collector) getWeatherReadings() (weather *Weather, err error) {
-	res, err := c.client.Get(c.url)
+	if c.provider != nil {
+		location := Location{Latitude: math.NaN(), Longitude: math.NaN()}
+		if c.locationProvider != nil {
+			if provided, ok := c.locationProvider(); ok {
+				location = provided
+			}
+		}
+		return c.provider.weather(location)
+	}
+	if c.oneCallOnly {
+		return c.getOneCallWeather()
+	}
+
+	requestURL, err := c.requestURL()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.client.Get(requestURL)
 	if err != nil {
 		return nil, errors.Wrap(errFailedRequest, err.Error())
 	}
@@ -160,5 +588,312 @@ func (c *Collector) getWeatherReadings() (weather *Weather, err error) {
 		return nil, errors.Wrap(errFailedUnmarshalling, err.Error())
 	}
 
+	// Wind speeds are in miles per hour with imperial units, and the gust is only there when there are gusts.
+	var wind struct {
+		Speed     float64  `json:"speed"`
+		Direction float64  `json:"deg"`
+		Gust      *float64 `json:"gust"`
+	}
+	if raw, ok := data["wind"]; ok {
+		if err := json.Unmarshal(raw, &wind); err != nil {
+			return nil, errors.Wrap(errFailedUnmarshalling, err.Error())
+		}
+	}
+	speedFactor := 1.0
+	if c.units == "imperial" {
+		speedFactor = metersPerSecondPerMph
+	}
+	weather.WindSpeed = wind.Speed * speedFactor
+	weather.WindDirection = wind.Direction
+	weather.WindGust = math.NaN()
+	if wind.Gust != nil {
+		weather.WindGust = *wind.Gust * speedFactor
+	}
+
+	// Rain and snow are only there when it rained or snowed, always in millimeters. The sunrise and sunset are in
+	// sys.
+	var sys struct {
+		Country string `json:"country"`
+		Sunrise int64  `json:"sunrise"`
+		Sunset  int64  `json:"sunset"`
+	}
+	var clouds struct {
+		All float64 `json:"all"`
+	}
+	var rain, snow struct {
+		LastHour float64 `json:"1h"`
+	}
+	for key, v := range map[string]interface{}{"sys": &sys, "clouds": &clouds, "rain": &rain, "snow": &snow} {
+		if raw, ok := data[key]; ok {
+			if err := json.Unmarshal(raw, v); err != nil {
+				return nil, errors.Wrap(errFailedUnmarshalling, err.Error())
+			}
+		}
+	}
+	weather.Cloudiness = clouds.All
+	weather.Rain = rain.LastHour
+	weather.Snow = snow.LastHour
+	if sys.Sunrise > 0 {
+		weather.Sunrise = time.Unix(sys.Sunrise, 0)
+	}
+	if sys.Sunset > 0 {
+		weather.Sunset = time.Unix(sys.Sunset, 0)
+	}
+
+	// The name of the location is optional.
+	weather.Country = sys.Country
+	json.Unmarshal(data["name"], &weather.LocationName)
+
+	// The time of the observation and the visibility are optional.
+	var observedAt int64
+	if err := json.Unmarshal(data["dt"], &observedAt); err == nil && observedAt > 0 {
+		weather.ObservedAt = time.Unix(observedAt, 0)
+	}
+	weather.Visibility = math.NaN()
+	var visibility float64
+	if err := json.Unmarshal(data["visibility"], &visibility); err == nil {
+		weather.Visibility = visibility
+	}
+
+	// The One Call API needs the coordinates, which the current weather gives for any kind of location.
+	// So does the forecast API, whose forecasts are relative to the observation.
+	if c.oneCallURL != "" || c.forecastURL != "" {
+		var coord struct {
+			Latitude  float64 `json:"lat"`
+			Longitude float64 `json:"lon"`
+		}
+		if err := json.Unmarshal(data["coord"], &coord); err != nil {
+			return nil, errors.Wrap(errFailedUnmarshalling, err.Error())
+		}
+		if c.oneCallURL != "" {
+			weather.OneCall, err = c.getOneCall(coord.Latitude, coord.Longitude)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if c.forecastURL != "" {
+			from := weather.ObservedAt
+			if from.IsZero() {
+				from = time.Now()
+			}
+			weather.Forecast, err = c.getForecast(coord.Latitude, coord.Longitude, from)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return weather, nil
+}
+
+func (c *Collector) getOneCall(latitude, longitude float64) (*OneCallWeather, error) {
+	body, err := c.requestOneCall(latitude, longitude)
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		Current *OneCallWeather `json:"current"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, errors.Wrap(errFailedUnmarshalling, err.Error())
+	}
+	if data.Current == nil {
+		return nil, errors.Wrap(errFailedUnmarshalling, "no current weather in One Call response")
+	}
+	return data.Current, nil
+}
+
+// getForecast returns the temperatures forecast forecastHours after the given time, interpolated between the 3 hour
+// steps of the forecast. Hours beyond the last step are left out.
+func (c *Collector) getForecast(latitude, longitude float64, from time.Time) ([]ForecastTemperature, error) {
+	query := url.Values{}
+	query.Set("lat", strconv.FormatFloat(latitude, 'f', -1, 64))
+	query.Set("lon", strconv.FormatFloat(longitude, 'f', -1, 64))
+	query.Set("appid", c.token)
+	query.Set("units", c.units)
+	res, err := c.client.Get(c.forecastURL + "?" + query.Encode())
+	if err != nil {
+		return nil, errors.Wrap(errFailedRequest, err.Error())
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(errFailedReadingBody, err.Error())
+	}
+
+	if res.StatusCode != 200 {
+		return nil, errors.Wrap(errNon200Response, fmt.Sprintf("forecast code: %d", res.StatusCode))
+	}
+
+	var data struct {
+		List []struct {
+			Time int64 `json:"dt"`
+			Main struct {
+				Temperature float64 `json:"temp"`
+			} `json:"main"`
+		} `json:"list"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, errors.Wrap(errFailedUnmarshalling, err.Error())
+	}
+	if len(data.List) == 0 {
+		return nil, errors.Wrap(errFailedUnmarshalling, "no time steps in forecast response")
+	}
+
+	forecast := []ForecastTemperature{}
+	for _, hours := range forecastHours {
+		at := from.Add(time.Duration(hours) * time.Hour).Unix()
+		if at <= data.List[0].Time {
+			forecast = append(forecast, ForecastTemperature{Hours: hours, Temperature: data.List[0].Main.Temperature})
+			continue
+		}
+		for i := 1; i < len(data.List); i++ {
+			prev, next := data.List[i-1], data.List[i]
+			if at > next.Time || next.Time <= prev.Time {
+				continue
+			}
+			fraction := float64(at-prev.Time) / float64(next.Time-prev.Time)
+			temp := prev.Main.Temperature + fraction*(next.Main.Temperature-prev.Main.Temperature)
+			forecast = append(forecast, ForecastTemperature{Hours: hours, Temperature: temp})
+			break
+		}
+	}
+	return forecast, nil
+}
+
+// getOneCallWeather returns the current weather from the One Call API alone, at the coordinates or city given by the
+// location provider.
+func (c *Collector) getOneCallWeather() (*Weather, error) {
+	var location Location
+	ok := false
+	if c.locationProvider != nil {
+		location, ok = c.locationProvider()
+	}
+	if !ok {
+		return nil, errNoCoordinates
+	}
+
+	latitude, longitude := location.Latitude, location.Longitude
+	if math.IsNaN(latitude) || math.IsNaN(longitude) {
+		if location.City == "" {
+			return nil, errNoCoordinates
+		}
+		coordinates, err := c.geocode(location.City)
+		if err != nil {
+			return nil, err
+		}
+		latitude, longitude = coordinates[0], coordinates[1]
+	}
+
+	body, err := c.requestOneCall(latitude, longitude)
+	if err != nil {
+		return nil, err
+	}
+
+	// As in the current weather API, wind speeds are in miles per hour with imperial units, and rain and snow are
+	// only there when it rained or snowed.
+	var data struct {
+		Current *struct {
+			OneCallWeather
+			ObservedAt    int64    `json:"dt"`
+			Sunrise       int64    `json:"sunrise"`
+			Sunset        int64    `json:"sunset"`
+			Temperature   float64  `json:"temp"`
+			Humidity      float64  `json:"humidity"`
+			Pressure      float64  `json:"pressure"`
+			Cloudiness    float64  `json:"clouds"`
+			WindSpeed     float64  `json:"wind_speed"`
+			WindDirection float64  `json:"wind_deg"`
+			WindGust      *float64 `json:"wind_gust"`
+			Visibility    *float64 `json:"visibility"`
+			Rain          struct {
+				LastHour float64 `json:"1h"`
+			} `json:"rain"`
+			Snow struct {
+				LastHour float64 `json:"1h"`
+			} `json:"snow"`
+		} `json:"current"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, errors.Wrap(errFailedUnmarshalling, err.Error())
+	}
+	if data.Current == nil {
+		return nil, errors.Wrap(errFailedUnmarshalling, "no current weather in One Call response")
+	}
+
+	current := data.Current
+	speedFactor := 1.0
+	if c.units == "imperial" {
+		speedFactor = metersPerSecondPerMph
+	}
+	oneCall := current.OneCallWeather
+	weather := &Weather{
+		Temperature:   current.Temperature,
+		Humidity:      current.Humidity,
+		Pressure:      current.Pressure,
+		WindSpeed:     current.WindSpeed * speedFactor,
+		WindDirection: current.WindDirection,
+		WindGust:      math.NaN(),
+		Cloudiness:    current.Cloudiness,
+		Rain:          current.Rain.LastHour,
+		Snow:          current.Snow.LastHour,
+		Visibility:    math.NaN(),
+		OneCall:       &oneCall,
+	}
+	if current.WindGust != nil {
+		weather.WindGust = *current.WindGust * speedFactor
+	}
+	if current.Visibility != nil {
+		weather.Visibility = *current.Visibility
+	}
+	if current.ObservedAt > 0 {
+		weather.ObservedAt = time.Unix(current.ObservedAt, 0)
+	}
+	if current.Sunrise > 0 {
+		weather.Sunrise = time.Unix(current.Sunrise, 0)
+	}
+	if current.Sunset > 0 {
+		weather.Sunset = time.Unix(current.Sunset, 0)
+	}
+
+	if c.forecastURL != "" {
+		from := weather.ObservedAt
+		if from.IsZero() {
+			from = time.Now()
+		}
+		weather.Forecast, err = c.getForecast(latitude, longitude, from)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return weather, nil
 }
+
+// requestOneCall returns the body of the One Call API response with the current weather at the given coordinates.
+func (c *Collector) requestOneCall(latitude, longitude float64) ([]byte, error) {
+	query := url.Values{}
+	query.Set("lat", strconv.FormatFloat(latitude, 'f', -1, 64))
+	query.Set("lon", strconv.FormatFloat(longitude, 'f', -1, 64))
+	query.Set("exclude", "minutely,hourly,daily,alerts")
+	query.Set("appid", c.token)
+	query.Set("units", c.units)
+	res, err := c.client.Get(c.oneCallURL + "?" + query.Encode())
+	if err != nil {
+		return nil, errors.Wrap(errFailedRequest, err.Error())
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(errFailedReadingBody, err.Error())
+	}
+
+	if res.StatusCode != 200 {
+		return nil, errors.Wrap(errNon200Response, fmt.Sprintf("One Call code: %d", res.StatusCode))
+	}
+	return body, nil
+}
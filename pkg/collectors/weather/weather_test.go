@@ -2,9 +2,13 @@ package weather
 
 import (
 	"errors"
+	"math"
 	"pronestheus/test"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -12,6 +16,7 @@ func TestServerResponses(t *testing.T) {
 	tests := []struct {
 		name    string
 		url     string
+		unit    string
 		wantErr error
 		want    *Weather
 	}{
@@ -20,18 +25,38 @@ func TestServerResponses(t *testing.T) {
 			url:     test.WeatherServerMetric().URL,
 			wantErr: nil,
 			want: &Weather{
-				Humidity:    float64(88),
-				Pressure:    float64(1021),
-				Temperature: float64(20.26),
+				Humidity:     float64(88),
+				Pressure:     float64(1021),
+				Temperature:  float64(20.26),
+				ObservedAt:   time.Unix(1594992007, 0),
+				WindSpeed:    1,
+				WindGust:     3.5,
+				Cloudiness:   75,
+				Rain:         0.42,
+				Visibility:   10000,
+				Sunrise:      time.Unix(1594957160, 0),
+				Sunset:       time.Unix(1595015609, 0),
+				LocationName: "Amsterdam",
+				Country:      "NL",
 			},
 		}, {
 			name:    "valid response fahrenheit",
 			url:     test.WeatherServerImperial().URL,
+			unit:    "fahrenheit",
 			wantErr: nil,
 			want: &Weather{
-				Humidity:    float64(88),
-				Pressure:    float64(1021),
-				Temperature: float64(68.36),
+				Humidity:     float64(88),
+				Pressure:     float64(1021),
+				Temperature:  float64(68.36),
+				ObservedAt:   time.Unix(1594992489, 0),
+				WindSpeed:    2.24 * metersPerSecondPerMph,
+				WindGust:     7.83 * metersPerSecondPerMph,
+				Cloudiness:   75,
+				Visibility:   10000,
+				Sunrise:      time.Unix(1594957160, 0),
+				Sunset:       time.Unix(1595015609, 0),
+				LocationName: "Amsterdam",
+				Country:      "NL",
 			},
 		}, {
 			name:    "missing location id",
@@ -60,6 +85,7 @@ func TestServerResponses(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			c, err := New(Config{
 				APIURL: test.url,
+				Unit:   test.unit,
 			})
 			assert.NoError(t, err)
 
@@ -76,6 +102,195 @@ func TestServerResponses(t *testing.T) {
 	}
 }
 
+func TestOneCall(t *testing.T) {
+	server := test.WeatherServerOneCall()
+
+	c, err := New(Config{
+		APIURL:     server.URL + "/weather",
+		OneCallURL: server.URL + "/onecall",
+	})
+	assert.NoError(t, err)
+
+	weather, err := c.getWeatherReadings()
+	assert.NoError(t, err)
+	assert.Equal(t, float64(20.26), weather.Temperature)
+	assert.Equal(t, &OneCallWeather{UVIndex: 4.35, DewPoint: 18.2}, weather.OneCall)
+
+	// Without a One Call subscription the whole scrape fails, rather than silently missing readings.
+	c.oneCallURL = server.URL + "/missing"
+	_, err = c.getWeatherReadings()
+	assert.True(t, errors.Is(err, errNon200Response))
+}
+
+func TestAPIVersion(t *testing.T) {
+	server := test.WeatherServerOneCall()
+	amsterdam := func() (Location, bool) {
+		return Location{Latitude: 52.37, Longitude: 4.89}, true
+	}
+
+	tests := []struct {
+		name             string
+		version          string
+		locationProvider func() (Location, bool)
+		wantErr          error
+	}{
+		{
+			name:    "2.5",
+			version: "2.5",
+		}, {
+			name:             "3.0",
+			version:          "3.0",
+			locationProvider: amsterdam,
+		}, {
+			name:    "3.0 without coordinates",
+			version: "3.0",
+			wantErr: errNoCoordinates,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{
+				APIVersion:       test.version,
+				APIURL:           server.URL + "/weather",
+				OneCallURL:       server.URL + "/onecall",
+				LocationProvider: test.locationProvider,
+			})
+			assert.NoError(t, err)
+
+			weather, err := c.getWeatherReadings()
+			if test.wantErr != nil {
+				assert.Nil(t, weather)
+				assert.True(t, errors.Is(err, test.wantErr))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, float64(20.26), weather.Temperature)
+			assert.Equal(t, float64(88), weather.Humidity)
+			assert.Equal(t, float64(1021), weather.Pressure)
+			assert.Equal(t, float64(3.5), weather.WindGust)
+			assert.Equal(t, float64(75), weather.Cloudiness)
+			assert.Equal(t, float64(0.42), weather.Rain)
+			assert.Equal(t, float64(10000), weather.Visibility)
+			assert.Equal(t, time.Unix(1594992007, 0), weather.ObservedAt)
+			assert.Equal(t, time.Unix(1595015609, 0), weather.Sunset)
+			assert.Equal(t, &OneCallWeather{UVIndex: 4.35, DewPoint: 18.2}, weather.OneCall)
+		})
+	}
+
+	c, err := New(Config{APIVersion: "4.0", APIURL: server.URL})
+	assert.Nil(t, c)
+	assert.True(t, errors.Is(err, errInvalidAPIVersion))
+}
+
+func TestForecast(t *testing.T) {
+	server := test.WeatherServerOneCall()
+
+	c, err := New(Config{
+		APIURL:      server.URL + "/weather",
+		ForecastURL: server.URL + "/forecast",
+	})
+	assert.NoError(t, err)
+
+	// The forecast is interpolated from the observation at 1594992007 on.
+	weather, err := c.getWeatherReadings()
+	assert.NoError(t, err)
+	assert.Len(t, weather.Forecast, 3)
+	for i, want := range []float64{20.6676, 21.6676, 19.6647} {
+		assert.Equal(t, forecastHours[i], weather.Forecast[i].Hours)
+		assert.InDelta(t, want, weather.Forecast[i].Temperature, 0.001)
+	}
+
+	c.forecastURL = server.URL + "/missing"
+	_, err = c.getWeatherReadings()
+	assert.True(t, errors.Is(err, errNon200Response))
+}
+
+func TestDewPoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		unit    string
+		weather Weather
+		want    float64
+	}{
+		{
+			name:    "celsius",
+			unit:    "celsius",
+			weather: Weather{Temperature: 20, Humidity: 50},
+			want:    9.255,
+		}, {
+			name:    "fahrenheit",
+			unit:    "fahrenheit",
+			weather: Weather{Temperature: 68, Humidity: 50},
+			want:    48.659,
+		}, {
+			name:    "reported by One Call",
+			unit:    "celsius",
+			weather: Weather{Temperature: 20, Humidity: 50, OneCall: &OneCallWeather{DewPoint: 9.1}},
+			want:    9.1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.InDelta(t, test.want, test.weather.dewPoint(test.unit), 0.001)
+		})
+	}
+
+	assert.True(t, math.IsNaN((&Weather{Temperature: 20}).dewPoint("celsius")))
+}
+
+func TestCache(t *testing.T) {
+	server := test.WeatherServerMetric()
+
+	c, err := New(Config{APIURL: server.URL, CacheTTL: 60})
+	assert.NoError(t, err)
+
+	weather, err := c.readings()
+	assert.NoError(t, err)
+
+	// Within the TTL the API isn't called again.
+	server.Close()
+	cached, err := c.readings()
+	assert.NoError(t, err)
+	assert.Same(t, weather, cached)
+
+	c.cachedAt = c.cachedAt.Add(-time.Minute)
+	_, err = c.readings()
+	assert.True(t, errors.Is(err, errFailedRequest))
+}
+
+func TestProviderLabel(t *testing.T) {
+	owm, metNo := test.WeatherServerMetric(), test.WeatherServerMetNo()
+	location := func() (Location, bool) {
+		return Location{Latitude: 52.37312, Longitude: 4.89221}, true
+	}
+
+	registry := prometheus.NewRegistry()
+	for _, cfg := range []Config{
+		{APIURL: owm.URL, Logger: log.NewNopLogger(), ProviderLabel: true},
+		{Provider: "metno", MetNoURL: metNo.URL, UserAgent: "pronestheus test", APIURL: owm.URL, Logger: log.NewNopLogger(), LocationProvider: location, ProviderLabel: true},
+	} {
+		c, err := New(cfg)
+		assert.NoError(t, err)
+		assert.NoError(t, registry.Register(c))
+	}
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "nest_weather_up" {
+			continue
+		}
+		var providers []string
+		for _, m := range family.GetMetric() {
+			assert.Equal(t, float64(1), m.GetGauge().GetValue())
+			providers = append(providers, m.GetLabel()[0].GetValue())
+		}
+		assert.ElementsMatch(t, []string{"openweathermap", "metno"}, providers)
+	}
+}
+
 func TestAPIURLParsing(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -116,10 +331,12 @@ func TestAPIURLParsing(t *testing.T) {
 
 func TestAPIURLUnits(t *testing.T) {
 	tests := []struct {
-		name    string
-		unit    string
-		wantURL string
-		wantErr error
+		name     string
+		unit     string
+		units    string
+		wantURL  string
+		wantTemp string
+		wantErr  error
 	}{
 		{
 			name:    "valid celsius",
@@ -141,6 +358,21 @@ func TestAPIURLUnits(t *testing.T) {
 			unit:    "furlong",
 			wantURL: "",
 			wantErr: errInvalidTempUnit,
+		}, {
+			name:     "standard units",
+			unit:     "celsius",
+			units:    "standard",
+			wantURL:  "https://example.com?id=123&appid=abc&units=standard",
+			wantTemp: "nest_weather_temperature_kelvin",
+		}, {
+			name:     "imperial units",
+			units:    "imperial",
+			wantURL:  "https://example.com?id=123&appid=abc&units=imperial",
+			wantTemp: "nest_weather_temperature_fahrenheit",
+		}, {
+			name:    "invalid units",
+			units:   "scientific",
+			wantErr: errInvalidUnits,
 		},
 	}
 
@@ -151,6 +383,7 @@ func TestAPIURLUnits(t *testing.T) {
 				APILocationID: "123",
 				APIToken:      "abc",
 				Unit:          test.unit,
+				Units:         test.units,
 			})
 
 			if test.wantErr != nil {
@@ -159,6 +392,76 @@ func TestAPIURLUnits(t *testing.T) {
 			} else {
 				assert.Equal(t, c.url, test.wantURL)
 				assert.NoError(t, err)
+				if test.wantTemp != "" {
+					assert.Contains(t, c.metrics.temp.String(), test.wantTemp)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestURL(t *testing.T) {
+	geocoding := test.WeatherServerGeocoding()
+
+	tests := []struct {
+		name     string
+		location Location
+		found    bool
+		wantURL  string
+		wantErr  error
+	}{
+		{
+			name:     "no location yet",
+			location: Location{},
+			found:    false,
+			wantURL:  "https://example.com?id=123&appid=abc&units=metric",
+		}, {
+			name:     "coordinates",
+			location: Location{Latitude: 52.3731, Longitude: 4.8922, PostalCode: "1012 JS", CountryCode: "NL"},
+			found:    true,
+			wantURL:  "https://example.com?lat=52.3731&lon=4.8922&appid=abc&units=metric",
+		}, {
+			name:     "postal code",
+			location: Location{Latitude: math.NaN(), Longitude: math.NaN(), PostalCode: "1012 JS", CountryCode: "NL"},
+			found:    true,
+			wantURL:  "https://example.com?zip=1012+JS%2CNL&appid=abc&units=metric",
+		}, {
+			name:     "city",
+			location: Location{Latitude: math.NaN(), Longitude: math.NaN(), City: "Amsterdam,NL"},
+			found:    true,
+			wantURL:  "https://example.com?lat=52.3727598&lon=4.8936041&appid=abc&units=metric",
+		}, {
+			name:     "unknown city",
+			location: Location{Latitude: math.NaN(), Longitude: math.NaN(), City: "Atlantis"},
+			found:    true,
+			wantErr:  errUnknownCity,
+		}, {
+			name:     "unknown location",
+			location: Location{Latitude: math.NaN(), Longitude: math.NaN()},
+			found:    true,
+			wantURL:  "https://example.com?id=123&appid=abc&units=metric",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{
+				APIURL:        "https://example.com",
+				APILocationID: "123",
+				APIToken:      "abc",
+				GeocodingURL:  geocoding.URL,
+				LocationProvider: func() (Location, bool) {
+					return test.location, test.found
+				},
+			})
+			assert.NoError(t, err)
+
+			url, err := c.requestURL()
+			if test.wantErr != nil {
+				assert.True(t, errors.Is(err, test.wantErr))
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.wantURL, url)
 			}
 		})
 	}
@@ -0,0 +1,115 @@
+package weather
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWeatherAPIURL = "https://api.weatherapi.com/v1/current.json"
+
+	metersPerSecondPerKph = 1 / 3.6
+)
+
+var errNoLocation = errors.New("weather provider needs the coordinates, postal code or city of the location")
+
+// weatherAPI provides the weather from the WeatherAPI.com current weather API.
+type weatherAPI struct {
+	client *http.Client
+	url    string
+	key    string
+	unit   string
+}
+
+func (p *weatherAPI) weather(location Location) (*Weather, error) {
+	// The API finds locations by their coordinates, postal code or name alike.
+	var q string
+	switch {
+	case !math.IsNaN(location.Latitude) && !math.IsNaN(location.Longitude):
+		q = strconv.FormatFloat(location.Latitude, 'f', -1, 64) + "," + strconv.FormatFloat(location.Longitude, 'f', -1, 64)
+	case location.PostalCode != "":
+		q = location.PostalCode
+	case location.City != "":
+		q = location.City
+	default:
+		return nil, errNoLocation
+	}
+
+	query := url.Values{}
+	query.Set("key", p.key)
+	query.Set("q", q)
+	res, err := p.client.Get(p.url + "?" + query.Encode())
+	if err != nil {
+		return nil, errors.Wrap(errFailedRequest, err.Error())
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(errFailedReadingBody, err.Error())
+	}
+
+	if res.StatusCode != 200 {
+		return nil, errors.Wrap(errNon200Response, fmt.Sprintf("WeatherAPI.com code: %d", res.StatusCode))
+	}
+
+	var data struct {
+		Location struct {
+			Name    string `json:"name"`
+			Country string `json:"country"`
+		} `json:"location"`
+		Current *struct {
+			LastUpdated   int64    `json:"last_updated_epoch"`
+			Temperature   float64  `json:"temp_c"`
+			Humidity      float64  `json:"humidity"`
+			Pressure      float64  `json:"pressure_mb"`
+			WindSpeed     float64  `json:"wind_kph"`
+			WindDirection float64  `json:"wind_degree"`
+			WindGust      *float64 `json:"gust_kph"`
+			Visibility    *float64 `json:"vis_km"`
+			Cloudiness    float64  `json:"cloud"`
+		} `json:"current"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, errors.Wrap(errFailedUnmarshalling, err.Error())
+	}
+	if data.Current == nil {
+		return nil, errors.Wrap(errFailedUnmarshalling, "no current weather in WeatherAPI.com response")
+	}
+
+	// The precipitation isn't split into rain and snow.
+	current := data.Current
+	weather := &Weather{
+		Temperature:   fromCelsius(current.Temperature, p.unit),
+		Humidity:      current.Humidity,
+		Pressure:      current.Pressure,
+		WindSpeed:     current.WindSpeed * metersPerSecondPerKph,
+		WindDirection: current.WindDirection,
+		WindGust:      math.NaN(),
+		Cloudiness:    current.Cloudiness,
+		Rain:          math.NaN(),
+		Snow:          math.NaN(),
+		Visibility:    math.NaN(),
+		LocationName:  data.Location.Name,
+		Country:       data.Location.Country,
+	}
+	if current.WindGust != nil {
+		weather.WindGust = *current.WindGust * metersPerSecondPerKph
+	}
+	if current.Visibility != nil {
+		weather.Visibility = *current.Visibility * 1000
+	}
+	if current.LastUpdated > 0 {
+		weather.ObservedAt = time.Unix(current.LastUpdated, 0)
+	}
+	return weather, nil
+}
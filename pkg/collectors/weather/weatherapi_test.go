@@ -0,0 +1,88 @@
+package weather
+
+import (
+	"errors"
+	"math"
+	"pronestheus/test"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeatherAPI(t *testing.T) {
+	server := test.WeatherServerWeatherAPI()
+	amsterdam := Location{Latitude: 52.37312, Longitude: 4.89221}
+
+	tests := []struct {
+		name     string
+		unit     string
+		key      string
+		location Location
+		wantTemp float64
+		wantErr  error
+	}{
+		{
+			name:     "coordinates",
+			key:      "key",
+			location: amsterdam,
+			wantTemp: 20.5,
+		}, {
+			name:     "city",
+			key:      "key",
+			location: Location{Latitude: math.NaN(), Longitude: math.NaN(), City: "Amsterdam"},
+			wantTemp: 20.5,
+		}, {
+			name:     "fahrenheit",
+			unit:     "fahrenheit",
+			key:      "key",
+			location: amsterdam,
+			wantTemp: 68.9,
+		}, {
+			name:     "no key",
+			location: amsterdam,
+			wantErr:  errNon200Response,
+		}, {
+			name:     "no location",
+			key:      "key",
+			location: Location{Latitude: math.NaN(), Longitude: math.NaN()},
+			wantErr:  errNoLocation,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(Config{
+				Provider:      "weatherapi",
+				WeatherAPIURL: server.URL,
+				WeatherAPIKey: test.key,
+				Unit:          test.unit,
+				APIURL:        "https://example.com",
+				LocationProvider: func() (Location, bool) {
+					return test.location, true
+				},
+			})
+			assert.NoError(t, err)
+
+			weather, err := c.getWeatherReadings()
+			if test.wantErr != nil {
+				assert.Nil(t, weather)
+				assert.True(t, errors.Is(err, test.wantErr))
+				return
+			}
+			assert.NoError(t, err)
+			assert.InDelta(t, test.wantTemp, weather.Temperature, 0.001)
+			assert.Equal(t, float64(88), weather.Humidity)
+			assert.Equal(t, float64(1021), weather.Pressure)
+			assert.InDelta(t, 3.2, weather.WindSpeed, 0.001)
+			assert.InDelta(t, 5.3, weather.WindGust, 0.001)
+			assert.Equal(t, float64(240), weather.WindDirection)
+			assert.Equal(t, float64(75), weather.Cloudiness)
+			assert.True(t, math.IsNaN(weather.Rain))
+			assert.Equal(t, float64(10000), weather.Visibility)
+			assert.Equal(t, "Amsterdam", weather.LocationName)
+			assert.Equal(t, "Netherlands", weather.Country)
+			assert.True(t, weather.ObservedAt.Equal(time.Unix(1594992600, 0)))
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	unixSocketPrefix  = "unix://"
+	defaultSocketMode = 0660
+)
+
+// listen listens on the given address: a TCP address such as :9777, or a Unix domain socket such as
+// unix:///run/pronestheus.sock, which gets the given permissions. A socket left over from a previous run is replaced.
+func listen(addr string, socketMode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, unixSocketPrefix)
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, socketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// parseSocketMode parses the octal permissions of the Unix domain socket, such as 0660.
+func parseSocketMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, errInvalidSocketMode
+	}
+	return os.FileMode(perm), nil
+}
@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pronestheus.sock")
+
+	// A stale socket of a previous run is replaced.
+	stale, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listen("unix://"+path, 0600)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	res, err := client.Get("http://localhost/")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+}
+
+func TestListenNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pronestheus.sock")
+	assert.NoError(t, os.WriteFile(path, nil, 0600))
+
+	// Files other than sockets are never removed.
+	_, err := listen("unix://"+path, 0600)
+	assert.Error(t, err)
+	assert.FileExists(t, path)
+}
+
+func TestParseSocketMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    os.FileMode
+		wantErr error
+	}{
+		{mode: "0660", want: 0660},
+		{mode: "666", want: 0666},
+		{mode: "0999", wantErr: errInvalidSocketMode},
+		{mode: "01777", wantErr: errInvalidSocketMode},
+		{mode: "rw", wantErr: errInvalidSocketMode},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			mode, err := parseSocketMode(test.mode)
+			assert.ErrorIs(t, err, test.wantErr)
+			assert.Equal(t, test.want, mode)
+		})
+	}
+}
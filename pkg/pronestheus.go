@@ -2,99 +2,334 @@ package pkg
 
 import (
 	"errors"
+	"math"
 	"net/http"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 
 	"golang.org/x/oauth2"
 
 	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 
 	"pronestheus/pkg/collectors/nest"
 	"pronestheus/pkg/collectors/nestapp"
 	"pronestheus/pkg/collectors/weather"
+	"pronestheus/pkg/sanitize"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 // ExporterConfig contains configuration for the Exporter.
 type ExporterConfig struct {
 	ListenAddr            *string
+	ListenSocketMode      *string
 	MetricsPath           *string
+	WebConfigFile         *string
 	Timeout               *int
+	TemperatureUnit       *string
+	GoMetrics             *bool
+	ProcessMetrics        *bool
+	MetricTimestamps      *bool
+	MetricPrefix          *string
+	ConstLabels           *[]string
 	NestURL               *string
+	NestTimeout           *int
 	NestOAuthClientID     *string
 	NestOAuthClientSecret *string
 	NestOAuthToken        *oauth2.Token // Only used to mock a dummy token in tests
 	NestProjectID         *string
 	NestRefreshToken      *string
+	NestProjects          *[]string // Additional projects, as PROJECT_ID,CLIENT_ID,CLIENT_SECRET,REFRESH_TOKEN
 	NestLabelSpaceToDash  *bool
+	LabelReplace          *[]string
+	LabelLowercase        *bool
+	NestIncludeDevices    *[]string
+	NestExcludeDevices    *[]string
+	NestKeepOffline       *bool
+	NestSamplingInterval  *int
+	NestShortIDs          *bool
+	NestLabels            *[]string
+	NestV2MetricNames     *bool
+	NestMetricPrefix      *string
 	WeatherLocation       *string
 	WeatherURL            *string
 	WeatherToken          *string
+	WeatherOneCallURL     *string
+	WeatherForecastURL    *string
+	WeatherUnits          *string
+	WeatherAPIVersion     *string
+	WeatherProvider       *[]string
+	WeatherUserAgent      *string
+	WeatherTimeout        *int
+	WeatherAPIKey         *string
+	WeatherLocationNest   *bool
+	WeatherCoordinates    *string
+	WeatherCity           *string
+	WeatherCacheTTL       *int
+	WeatherLocationLabels *bool
 	NestGoogleAuthURL     *string
 	NestGoogleAuthCookies *string
+	NestGoogleCookiesFile *string
+	NestGoogleMasterToken *string
+	NestGoogleEmail       *string
+	NestGoogleAndroidID   *string
+	NestAppAPIHost        *string
+	NestAppAuthPolicy     *string
+	NestAppTimeout        *int
+	NestAppAuthTimeout    *int
+	NestAppSensorStale    *int
+	NestAppSensorMaxAge   *int
+	NestAppSubscribe      *bool
+	NestAppStructures     *[]string
+	NestAppBucketTypes    *[]string
+	NestAppMetricPrefix   *string
 }
 
 // Exporter is a Prometheus exporter.
 type Exporter struct {
-	logger      log.Logger
-	listenAddr  string
-	metricsPath string
+	logger        log.Logger
+	listenAddr    string
+	socketMode    os.FileMode
+	metricsPath   string
+	webConfigFile string
+	mux           *http.ServeMux
+	registry      *prometheus.Registry
+	// registryMu makes scrapes wait while collectors are swapped on reload, so that they see either the old or the
+	// new collectors.
+	registryMu sync.RWMutex
+
+	// reloadMu guards the configuration and the collectors registered for it against concurrent reloads.
+	reloadMu   sync.Mutex
+	cfg        *ExporterConfig
+	groups     map[string]*collectorGroup
+	loadConfig func() (*ExporterConfig, error)
 }
 
 var logger log.Logger
 
+// timeout returns the given timeout of a collector, in milliseconds, or the global timeout if it isn't set.
+func (cfg *ExporterConfig) timeout(timeout *int) int {
+	if timeout != nil && *timeout > 0 {
+		return *timeout
+	}
+	return *cfg.Timeout
+}
+
+// temperatureUnit returns the configured unit of the exported temperatures. Empty means Celsius.
+func (cfg *ExporterConfig) temperatureUnit() string {
+	if cfg.TemperatureUnit == nil {
+		return ""
+	}
+	return *cfg.TemperatureUnit
+}
+
+// metricTimestamps returns whether metrics are exported with the timestamps of the upstream data.
+func (cfg *ExporterConfig) metricTimestamps() bool {
+	return cfg.MetricTimestamps != nil && *cfg.MetricTimestamps
+}
+
+var (
+	errInvalidNestProject       = errors.New("invalid Nest project; expected PROJECT_ID,CLIENT_ID,CLIENT_SECRET,REFRESH_TOKEN")
+	errWeatherLocationNoNestApp = errors.New("OpenWeatherMap location from Nest requested, but the Nest app API is not configured")
+	errInvalidWeatherCoords     = errors.New("invalid OpenWeatherMap coordinates; expected LATITUDE,LONGITUDE")
+	errInvalidSocketMode        = errors.New("invalid listen socket mode; expected octal permissions such as 0660")
+	errInvalidMetricPrefix      = errors.New("invalid metric prefix; expected letters, digits, underscores and colons")
+	errInvalidConstLabel        = errors.New("invalid constant label; expected NAME=VALUE")
+)
+
 // NewExporter creates a Prometheus exporter using the ExporterConfig and registers the collectors.
 func NewExporter(cfg *ExporterConfig) (*Exporter, error) {
 	logger = log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
 	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 
-	if err := registerNestCollector(cfg); err != nil {
-		return nil, err
+	exporter := &Exporter{
+		logger:      logger,
+		listenAddr:  *cfg.ListenAddr,
+		socketMode:  defaultSocketMode,
+		metricsPath: *cfg.MetricsPath,
+		groups:      map[string]*collectorGroup{},
+		registry:    prometheus.NewRegistry(),
 	}
-
-	if err := registerWeatherCollector(cfg); err != nil {
-		return nil, err
+	if cfg.ListenSocketMode != nil && *cfg.ListenSocketMode != "" {
+		socketMode, err := parseSocketMode(*cfg.ListenSocketMode)
+		if err != nil {
+			return nil, err
+		}
+		exporter.socketMode = socketMode
 	}
-
-	if err := registerNestAppCollector(cfg); err != nil {
+	if cfg.WebConfigFile != nil && *cfg.WebConfigFile != "" {
+		// Fail early on an invalid web config instead of on the first connection.
+		if err := web.Validate(*cfg.WebConfigFile); err != nil {
+			return nil, err
+		}
+		exporter.webConfigFile = *cfg.WebConfigFile
+	}
+	if err := exporter.registerCollectors(cfg, allCollectorGroups); err != nil {
 		return nil, err
 	}
 
-	return &Exporter{
-		logger:      logger,
-		listenAddr:  *cfg.ListenAddr,
-		metricsPath: *cfg.MetricsPath,
-	}, nil
+	// A mux of its own, so that no other package can add routes to the exporter.
+	exporter.mux = http.NewServeMux()
+	exporter.mux.HandleFunc("/", exporter.handleLandingPage)
+	exporter.mux.Handle(exporter.metricsPath, promhttp.InstrumentMetricHandler(
+		exporter.registry, promhttp.HandlerFor(prometheus.GathererFunc(exporter.gather), promhttp.HandlerOpts{}),
+	))
+
+	return exporter, nil
+}
+
+// gather gathers the metrics of the registry, waiting for collectors being swapped on reload.
+func (e *Exporter) gather() ([]*dto.MetricFamily, error) {
+	e.registryMu.RLock()
+	defer e.registryMu.RUnlock()
+	return e.registry.Gather()
+}
+
+// Handler returns the handler of the landing page, the metrics and the reload endpoint, for serving the exporter
+// under another router instead of with Run.
+func (e *Exporter) Handler() http.Handler {
+	return e.mux
+}
+
+func (e *Exporter) handleLandingPage(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(`<html>
+		<head><title>ProNestheus</title></head>
+		<body>
+		<h1>ProNestheus - Nest Thermostat Prometheus Exporter</h1>
+		<p><a href="` + e.metricsPath + `">Metrics</a></p>
+		</body>
+		</html>`))
 }
 
 // Run starts the exporter server and listens for incoming scraping requests.
 func (e *Exporter) Run() error {
 	e.logger.Log("level", "debug", "msg", "Started ProNestheus - Nest Thermostat Prometheus Exporter")
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-			<head><title>ProNestheus</title></head>
-			<body>
-			<h1>ProNestheus - Nest Thermostat Prometheus Exporter</h1>
-			<p><a href="` + e.metricsPath + `">Metrics</a></p>
-			</body>
-			</html>`))
-	})
+	if e.loadConfig != nil {
+		go e.reloadOnSignal()
+	}
+
+	listener, err := listen(e.listenAddr, e.socketMode)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	// Connections are queued by the listener until served, so systemd can be told that the exporter is ready already.
+	done := make(chan struct{})
+	defer close(done)
+	e.notifySystemd(done)
+
+	// The web config enables TLS, and is re-read for every new connection.
+	return web.Serve(listener, &http.Server{Handler: e.mux}, &web.FlagConfig{WebConfigFile: &e.webConfigFile}, e.logger)
+}
+
+func newLabelSanitizer(cfg *ExporterConfig) (*sanitize.Sanitizer, error) {
+	var rules []string
+	if cfg.LabelReplace != nil {
+		rules = *cfg.LabelReplace
+	}
+	lowercase := false
+	if cfg.LabelLowercase != nil {
+		lowercase = *cfg.LabelLowercase
+	}
+
+	return sanitize.New(rules, lowercase)
+}
+
+// labelNameRegexp matches the valid names of labels. Names starting with __ are reserved by Prometheus.
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// constLabelsRegisterer returns the registry, wrapped to add the configured constant labels to all metrics.
+func constLabelsRegisterer(cfg *ExporterConfig, registry prometheus.Registerer) (prometheus.Registerer, error) {
+	if cfg.ConstLabels == nil || len(*cfg.ConstLabels) == 0 {
+		return registry, nil
+	}
+
+	labels := prometheus.Labels{}
+	for _, label := range *cfg.ConstLabels {
+		name, value, ok := strings.Cut(label, "=")
+		if !ok || !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, errInvalidConstLabel
+		}
+		labels[name] = value
+	}
+	return prometheus.WrapRegistererWith(labels, registry), nil
+}
+
+// metricPrefixRegexp matches the prefixes which keep metric names valid.
+var metricPrefixRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// metricsRegisterer returns the registerer of the Nest and weather collectors: the registry, wrapped to prefix the
+// metric names if configured.
+func metricsRegisterer(cfg *ExporterConfig, registry prometheus.Registerer) (prometheus.Registerer, error) {
+	if cfg.MetricPrefix == nil || *cfg.MetricPrefix == "" {
+		return registry, nil
+	}
+	if !metricPrefixRegexp.MatchString(*cfg.MetricPrefix) {
+		return nil, errInvalidMetricPrefix
+	}
+	return prometheus.WrapRegistererWithPrefix(*cfg.MetricPrefix, registry), nil
+}
 
-	http.Handle(e.metricsPath, promhttp.Handler())
-	return http.ListenAndServe(e.listenAddr, nil)
+// registerRuntimeCollectors registers the collectors of the go_* and process_* metrics of the exporter itself, unless
+// disabled.
+func registerRuntimeCollectors(cfg *ExporterConfig, group *collectorGroup) {
+	if cfg.GoMetrics == nil || *cfg.GoMetrics {
+		group.MustRegister(collectors.NewGoCollector())
+	}
+	if cfg.ProcessMetrics == nil || *cfg.ProcessMetrics {
+		group.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
 }
 
-func registerNestCollector(cfg *ExporterConfig) error {
+func registerNestCollector(cfg *ExporterConfig, labelSanitizer *sanitize.Sanitizer, group *collectorGroup) error {
 	replaceSpacesWithDashesInLabel := false
 	if cfg.NestLabelSpaceToDash != nil {
 		replaceSpacesWithDashesInLabel = *cfg.NestLabelSpaceToDash
 	}
+	keepOfflineReadings := false
+	if cfg.NestKeepOffline != nil {
+		keepOfflineReadings = *cfg.NestKeepOffline
+	}
+	shortIDs := false
+	if cfg.NestShortIDs != nil {
+		shortIDs = *cfg.NestShortIDs
+	}
+	samplingInterval := 0
+	if cfg.NestSamplingInterval != nil {
+		samplingInterval = *cfg.NestSamplingInterval
+	}
+	v2MetricNames := false
+	if cfg.NestV2MetricNames != nil {
+		v2MetricNames = *cfg.NestV2MetricNames
+	}
+	metricPrefix := ""
+	if cfg.NestMetricPrefix != nil {
+		metricPrefix = *cfg.NestMetricPrefix
+	}
+	var labels []string
+	if cfg.NestLabels != nil {
+		labels = *cfg.NestLabels
+	}
+	var includeDevices, excludeDevices []string
+	if cfg.NestIncludeDevices != nil {
+		includeDevices = *cfg.NestIncludeDevices
+	}
+	if cfg.NestExcludeDevices != nil {
+		excludeDevices = *cfg.NestExcludeDevices
+	}
 	nestConfig := nest.Config{
 		Logger:                         logger,
-		Timeout:                        *cfg.Timeout,
+		Timeout:                        cfg.timeout(cfg.NestTimeout),
+		Unit:                           cfg.temperatureUnit(),
 		APIURL:                         *cfg.NestURL,
 		OAuthClientID:                  *cfg.NestOAuthClientID,
 		OAuthClientSecret:              *cfg.NestOAuthClientSecret,
@@ -102,60 +337,298 @@ func registerNestCollector(cfg *ExporterConfig) error {
 		ProjectID:                      *cfg.NestProjectID,
 		OAuthToken:                     cfg.NestOAuthToken,
 		ReplaceSpacesWithDashesInLabel: replaceSpacesWithDashesInLabel,
+		LabelSanitizer:                 labelSanitizer,
+		IncludeDevices:                 includeDevices,
+		ExcludeDevices:                 excludeDevices,
+		KeepOfflineReadings:            keepOfflineReadings,
+		SamplingInterval:               samplingInterval,
+		ShortIDs:                       shortIDs,
+		Labels:                         labels,
+		V2MetricNames:                  v2MetricNames,
+		MetricPrefix:                   metricPrefix,
+		Done:                           group.done,
+	}
+
+	// With a single project, keep the metrics without the project label.
+	if cfg.NestProjects == nil || len(*cfg.NestProjects) == 0 {
+		return registerNestProject(nestConfig, group)
+	}
+
+	projectConfigs := []nest.Config{}
+	if nestConfig.ProjectID != "" {
+		projectConfigs = append(projectConfigs, nestConfig)
+	}
+	for _, project := range *cfg.NestProjects {
+		fields := strings.Split(project, ",")
+		if len(fields) != 4 || fields[0] == "" {
+			return errInvalidNestProject
+		}
+
+		projectConfig := nestConfig
+		projectConfig.ProjectID = fields[0]
+		projectConfig.OAuthClientID = fields[1]
+		projectConfig.OAuthClientSecret = fields[2]
+		projectConfig.RefreshToken = fields[3]
+		projectConfigs = append(projectConfigs, projectConfig)
+	}
+
+	// Each project gets its own collector, with its metrics distinguished by the project label.
+	for _, projectConfig := range projectConfigs {
+		registerer := prometheus.WrapRegistererWith(prometheus.Labels{"project": projectConfig.ProjectID}, group)
+		if err := registerNestProject(projectConfig, registerer); err != nil {
+			return err
+		}
 	}
 
+	return nil
+}
+
+func registerNestProject(nestConfig nest.Config, registerer prometheus.Registerer) error {
 	nestCollector, err := nest.New(nestConfig)
 	if err != nil {
 		return err
 	}
 
-	return prometheus.Register(nestCollector)
+	return registerer.Register(nestCollector)
 }
 
-func registerWeatherCollector(cfg *ExporterConfig) error {
-	// Don't create weather collector if WeatherToken is empty.
-	if *cfg.WeatherToken == "" {
+// registerWeatherCollectors registers a weather collector for each of the weather providers. With more than one, their
+// metrics are told apart by the provider label.
+func registerWeatherCollectors(cfg *ExporterConfig, nestAppCollector *nestapp.Collector, group *collectorGroup) error {
+	providers := []string{"openweathermap"}
+	if cfg.WeatherProvider != nil && len(*cfg.WeatherProvider) > 0 {
+		providers = *cfg.WeatherProvider
+	}
+	userAgent, apiKey := "", ""
+	if cfg.WeatherUserAgent != nil {
+		userAgent = *cfg.WeatherUserAgent
+	}
+	if cfg.WeatherAPIKey != nil {
+		apiKey = *cfg.WeatherAPIKey
+	}
+
+	// Don't create weather collectors for providers whose token or key is empty, unless they don't need one.
+	var enabled []string
+	for _, provider := range providers {
+		switch provider {
+		case "openweathermap":
+			if *cfg.WeatherToken == "" {
+				continue
+			}
+		case "weatherapi":
+			if apiKey == "" {
+				continue
+			}
+		}
+		enabled = append(enabled, provider)
+	}
+	if len(enabled) == 0 {
 		return nil
 	}
 
+	var locationProvider func() (weather.Location, bool)
+	if cfg.WeatherLocationNest != nil && *cfg.WeatherLocationNest {
+		if nestAppCollector == nil {
+			return errWeatherLocationNoNestApp
+		}
+		locationProvider = func() (weather.Location, bool) {
+			return nestStructureLocation(nestAppCollector.Structures())
+		}
+	} else if location, ok, err := weatherLocation(cfg); err != nil {
+		return err
+	} else if ok {
+		locationProvider = func() (weather.Location, bool) {
+			return location, true
+		}
+	}
+
+	oneCallURL, forecastURL := "", ""
+	if cfg.WeatherOneCallURL != nil {
+		oneCallURL = *cfg.WeatherOneCallURL
+	}
+	if cfg.WeatherForecastURL != nil {
+		forecastURL = *cfg.WeatherForecastURL
+	}
+	units, apiVersion := "", ""
+	if cfg.WeatherUnits != nil {
+		units = *cfg.WeatherUnits
+	}
+	if cfg.WeatherAPIVersion != nil {
+		apiVersion = *cfg.WeatherAPIVersion
+	}
+	cacheTTL := 0
+	if cfg.WeatherCacheTTL != nil {
+		cacheTTL = *cfg.WeatherCacheTTL
+	}
+	locationLabels := cfg.WeatherLocationLabels != nil && *cfg.WeatherLocationLabels
+
 	weatherConfig := weather.Config{
-		Logger:        logger,
-		Timeout:       *cfg.Timeout,
-		APIURL:        *cfg.WeatherURL,
-		APIToken:      *cfg.WeatherToken,
-		APILocationID: *cfg.WeatherLocation,
+		UserAgent:        userAgent,
+		WeatherAPIKey:    apiKey,
+		Logger:           logger,
+		Timeout:          cfg.timeout(cfg.WeatherTimeout),
+		Unit:             cfg.temperatureUnit(),
+		Units:            units,
+		APIURL:           *cfg.WeatherURL,
+		APIToken:         *cfg.WeatherToken,
+		APILocationID:    *cfg.WeatherLocation,
+		MetricTimestamps: cfg.metricTimestamps(),
+		APIVersion:       apiVersion,
+		OneCallURL:       oneCallURL,
+		ForecastURL:      forecastURL,
+		LocationProvider: locationProvider,
+		CacheTTL:         cacheTTL,
+		LocationLabels:   locationLabels,
+		ProviderLabel:    len(enabled) > 1,
 	}
 
-	weatherCollector, err := weather.New(weatherConfig)
-	if err != nil {
-		return err
+	for _, provider := range enabled {
+		weatherConfig.Provider = provider
+		weatherCollector, err := weather.New(weatherConfig)
+		if err != nil {
+			return err
+		}
+		if err := group.Register(weatherCollector); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return prometheus.Register(weatherCollector)
+// nestStructureLocation returns the location of the first of the given Nest structures, if any.
+func nestStructureLocation(structures []nestapp.Structure) (weather.Location, bool) {
+	if len(structures) == 0 {
+		return weather.Location{}, false
+	}
+	return weather.Location{
+		Latitude:    structures[0].Latitude,
+		Longitude:   structures[0].Longitude,
+		PostalCode:  structures[0].PostalCode,
+		CountryCode: structures[0].CountryCode,
+	}, true
 }
 
-func registerNestAppCollector(cfg *ExporterConfig) error {
-	if cfg.NestGoogleAuthURL == nil || *cfg.NestGoogleAuthURL == "" {
-		if cfg.NestGoogleAuthCookies != nil && *cfg.NestGoogleAuthCookies != "" {
-			return errors.New("Cookies for Nest app provided, but the Google authentication URL not provided")
+// weatherLocation returns the location of the weather given by its coordinates or city, if any.
+func weatherLocation(cfg *ExporterConfig) (weather.Location, bool, error) {
+	location := weather.Location{Latitude: math.NaN(), Longitude: math.NaN()}
+	if cfg.WeatherCoordinates != nil && *cfg.WeatherCoordinates != "" {
+		fields := strings.Split(*cfg.WeatherCoordinates, ",")
+		if len(fields) != 2 {
+			return location, false, errInvalidWeatherCoords
+		}
+		latitude, err := strconv.ParseFloat(strings.TrimSpace(fields[0]), 64)
+		if err != nil {
+			return location, false, errInvalidWeatherCoords
+		}
+		longitude, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil {
+			return location, false, errInvalidWeatherCoords
+		}
+		location.Latitude, location.Longitude = latitude, longitude
+		return location, true, nil
+	}
+	if cfg.WeatherCity != nil && *cfg.WeatherCity != "" {
+		location.City = *cfg.WeatherCity
+		return location, true, nil
+	}
+	return location, false, nil
+}
+
+func registerNestAppCollector(cfg *ExporterConfig, labelSanitizer *sanitize.Sanitizer, group *collectorGroup) (*nestapp.Collector, error) {
+	cookies, cookiesFile := "", ""
+	if cfg.NestGoogleAuthCookies != nil {
+		cookies = *cfg.NestGoogleAuthCookies
+	}
+	if cfg.NestGoogleCookiesFile != nil {
+		cookiesFile = *cfg.NestGoogleCookiesFile
+	}
+	cookiesProvided := cookies != "" || cookiesFile != ""
+	authURL, masterToken, email, androidID := "", "", "", ""
+	if cfg.NestGoogleAuthURL != nil {
+		authURL = *cfg.NestGoogleAuthURL
+	}
+	if cfg.NestGoogleMasterToken != nil {
+		masterToken = *cfg.NestGoogleMasterToken
+	}
+	if cfg.NestGoogleEmail != nil {
+		email = *cfg.NestGoogleEmail
+	}
+	if cfg.NestGoogleAndroidID != nil {
+		androidID = *cfg.NestGoogleAndroidID
+	}
+	if masterToken != "" {
+		if email == "" {
+			return nil, errors.New("Google master token for the Nest app provided, but no email provided")
+		}
+	} else if authURL == "" {
+		if cookiesProvided {
+			return nil, errors.New("Cookies for Nest app provided, but the Google authentication URL not provided")
 		}
 		// This feature is not enabled
-		return nil
-	} else if cfg.NestGoogleAuthCookies == nil || *cfg.NestGoogleAuthCookies == "" {
-		return errors.New("Google auth URL for the Nest app provided, but no cookies provided")
+		return nil, nil
+	} else if !cookiesProvided {
+		return nil, errors.New("Google auth URL for the Nest app provided, but no cookies provided")
 	}
 
+	sensorStaleAfter := 0
+	if cfg.NestAppSensorStale != nil {
+		sensorStaleAfter = *cfg.NestAppSensorStale
+	}
+	sensorMaxAge := 0
+	if cfg.NestAppSensorMaxAge != nil {
+		sensorMaxAge = *cfg.NestAppSensorMaxAge
+	}
+	subscribe := false
+	if cfg.NestAppSubscribe != nil {
+		subscribe = *cfg.NestAppSubscribe
+	}
+	var structures []string
+	if cfg.NestAppStructures != nil {
+		structures = *cfg.NestAppStructures
+	}
+	var bucketTypes []string
+	if cfg.NestAppBucketTypes != nil {
+		bucketTypes = *cfg.NestAppBucketTypes
+	}
+	metricPrefix := ""
+	if cfg.NestAppMetricPrefix != nil {
+		metricPrefix = *cfg.NestAppMetricPrefix
+	}
+	apiHost, authPolicy := "", ""
+	if cfg.NestAppAPIHost != nil {
+		apiHost = *cfg.NestAppAPIHost
+	}
+	if cfg.NestAppAuthPolicy != nil {
+		authPolicy = *cfg.NestAppAuthPolicy
+	}
 	config := nestapp.Config{
-		Logger:      logger,
-		Timeout:     *cfg.Timeout,
-		AuthURL:     *cfg.NestGoogleAuthURL,
-		AuthCookies: *cfg.NestGoogleAuthCookies,
+		Logger:           logger,
+		Timeout:          cfg.timeout(cfg.NestAppTimeout),
+		AuthTimeout:      cfg.timeout(cfg.NestAppAuthTimeout),
+		Unit:             cfg.temperatureUnit(),
+		AuthURL:          authURL,
+		AuthCookies:      cookies,
+		AuthCookiesFile:  cookiesFile,
+		AuthMasterToken:  masterToken,
+		AuthEmail:        email,
+		AuthAndroidID:    androidID,
+		APIHost:          apiHost,
+		AuthPolicyID:     authPolicy,
+		LabelSanitizer:   labelSanitizer,
+		MetricTimestamps: cfg.metricTimestamps(),
+		SensorStaleAfter: sensorStaleAfter,
+		SensorMaxAge:     sensorMaxAge,
+		Subscribe:        subscribe,
+		Structures:       structures,
+		BucketTypes:      bucketTypes,
+		MetricPrefix:     metricPrefix,
+		Done:             group.done,
 	}
 
 	collector, err := nestapp.New(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return prometheus.Register(collector)
+	return collector, group.Register(collector)
 }
@@ -1,19 +1,27 @@
 package pkg
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"pronestheus/pkg/collectors/weather"
 	"pronestheus/test"
 	"testing"
+	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestAllMetrics(t *testing.T) {
-	t.Cleanup(resetRegistry)
-
 	nestServ := test.NestServer()
 	weatherServ := test.WeatherServerMetric()
 
@@ -21,21 +29,34 @@ func TestAllMetrics(t *testing.T) {
 	cfg.NestURL = &nestServ.URL
 	cfg.WeatherURL = &weatherServ.URL
 
-	_, err := NewExporter(cfg)
+	exporter, err := NewExporter(cfg)
 	assert.NoError(t, err)
 
 	w := httptest.NewRecorder()
-	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
 
-	promhttp.Handler().ServeHTTP(w, req)
+	exporter.Handler().ServeHTTP(w, req)
 
 	assert.Equal(t, w.Code, http.StatusOK)
 	assert.Contains(t, w.Body.String(), "nest_up 1")
-	assert.Contains(t, w.Body.String(), `nest_online{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room"} 1`)
-	assert.Contains(t, w.Body.String(), `nest_setpoint_temperature_celsius{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room"} 19.17838`)
-	assert.Contains(t, w.Body.String(), `nest_ambient_temperature_celsius{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room"} 20.23999`)
-	assert.Contains(t, w.Body.String(), `nest_humidity_percent{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room"} 57`)
-	assert.Contains(t, w.Body.String(), `nest_heating{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room"} 0`)
+	assert.Contains(t, w.Body.String(), "nest_oauth_token_refreshes_total 0")
+	assert.Contains(t, w.Body.String(), "nest_oauth_token_refresh_failures_total 0")
+	assert.Contains(t, w.Body.String(), `nest_devices_total{type="THERMOSTAT"} 1`)
+	assert.Contains(t, w.Body.String(), `nest_devices_total{type="CAMERA"} 1`)
+	assert.Contains(t, w.Body.String(), `nest_device_online{id="enterprises/PROJECT_ID/devices/CAMERA_ID",room="Hallway",type="CAMERA"} 0`)
+	assert.Contains(t, w.Body.String(), `nest_device_up{id="enterprises/PROJECT_ID/devices/DEVICE_ID"} 1`)
+	assert.Contains(t, w.Body.String(), `nest_thermostat_info{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",name="enterprises/PROJECT_ID/devices/DEVICE_ID",room="Living Room",structure="Home",type="THERMOSTAT"} 1`)
+	assert.Contains(t, w.Body.String(), `nest_online{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room",structure="Home"} 1`)
+	assert.Contains(t, w.Body.String(), `nest_setpoint_temperature_celsius{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room",structure="Home",type="heat"} 19.17838`)
+	assert.Contains(t, w.Body.String(), `nest_setpoint_temperature_celsius{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room",structure="Home",type="cool"} 26.5`)
+	assert.Contains(t, w.Body.String(), `nest_setpoint_ambient_delta_celsius{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room",structure="Home"} 0`)
+	assert.Contains(t, w.Body.String(), `nest_ambient_temperature_celsius{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room",structure="Home"} 20.23999`)
+	assert.Contains(t, w.Body.String(), `nest_humidity_percent{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room",structure="Home"} 57`)
+	assert.Contains(t, w.Body.String(), `nest_thermostat_offline_seconds{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room",structure="Home"} 0`)
+	assert.Contains(t, w.Body.String(), `nest_api_up{endpoint="devices"} 1`)
+	assert.Contains(t, w.Body.String(), `nest_api_up{endpoint="structures"} 1`)
+	assert.Contains(t, w.Body.String(), `nest_heating{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room",structure="Home"} 0`)
+	assert.Contains(t, w.Body.String(), `nest_thermostat_temperature_scale{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room",scale="CELSIUS",structure="Home"} 1`)
 	assert.Contains(t, w.Body.String(), "nest_weather_up 1")
 	assert.Contains(t, w.Body.String(), "nest_weather_temperature_celsius 20.26")
 	assert.Contains(t, w.Body.String(), "nest_weather_humidity_percent 88")
@@ -44,8 +65,6 @@ func TestAllMetrics(t *testing.T) {
 }
 
 func TestNoWeatherMetrics(t *testing.T) {
-	t.Cleanup(resetRegistry)
-
 	weatherToken := ""
 	nestServ := test.NestServer()
 
@@ -53,13 +72,13 @@ func TestNoWeatherMetrics(t *testing.T) {
 	cfg.NestURL = &nestServ.URL
 	cfg.WeatherToken = &weatherToken
 
-	_, err := NewExporter(cfg)
+	exporter, err := NewExporter(cfg)
 	assert.NoError(t, err)
 
 	w := httptest.NewRecorder()
-	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
 
-	promhttp.Handler().ServeHTTP(w, req)
+	exporter.Handler().ServeHTTP(w, req)
 
 	assert.Equal(t, w.Code, http.StatusOK)
 	assert.Contains(t, w.Body.String(), "nest_up 1")
@@ -67,8 +86,6 @@ func TestNoWeatherMetrics(t *testing.T) {
 }
 
 func TestFailedScraping(t *testing.T) {
-	t.Cleanup(resetRegistry)
-
 	nestServ := test.NestServerInvalidResponse()
 	weatherServ := test.WeatherServerInvalidResponse()
 
@@ -76,19 +93,491 @@ func TestFailedScraping(t *testing.T) {
 	cfg.NestURL = &nestServ.URL
 	cfg.WeatherURL = &weatherServ.URL
 
-	_, err := NewExporter(cfg)
+	exporter, err := NewExporter(cfg)
 	assert.NoError(t, err)
 
 	w := httptest.NewRecorder()
-	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
 
-	promhttp.Handler().ServeHTTP(w, req)
+	exporter.Handler().ServeHTTP(w, req)
 
 	assert.Equal(t, w.Code, http.StatusOK)
 	assert.NotContains(t, w.Body.String(), "nest_up 1")
 	assert.NotContains(t, w.Body.String(), "nest_weather_up 1")
 }
 
+func TestFahrenheitMetrics(t *testing.T) {
+	unit := "fahrenheit"
+	nestServ := test.NestServer()
+	weatherServ := test.WeatherServerImperial()
+
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.WeatherURL = &weatherServ.URL
+	cfg.TemperatureUnit = &unit
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+
+	exporter.Handler().ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Contains(t, w.Body.String(), `nest_heat_setpoint_temperature_fahrenheit{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room",structure="Home"} 66.521084`)
+	assert.Contains(t, w.Body.String(), `nest_ambient_temperature_fahrenheit{`)
+	assert.NotContains(t, w.Body.String(), `_celsius`)
+	assert.Contains(t, w.Body.String(), "nest_weather_temperature_fahrenheit 68.36")
+}
+
+func TestLabelSanitization(t *testing.T) {
+	weatherToken := ""
+	lowercase := true
+	rules := []string{`\s+=_`}
+	nestServ := test.NestServer()
+
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.WeatherToken = &weatherToken
+	cfg.LabelReplace = &rules
+	cfg.LabelLowercase = &lowercase
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+
+	exporter.Handler().ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Contains(t, w.Body.String(), `nest_online{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="custom_name",room="living_room",structure="home"} 1`)
+}
+
+func TestNestLabels(t *testing.T) {
+	weatherToken := ""
+	labels := []string{"room"}
+	nestServ := test.NestServer()
+
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.WeatherToken = &weatherToken
+	cfg.NestLabels = &labels
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+
+	exporter.Handler().ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Contains(t, w.Body.String(), `nest_online{room="Living Room"} 1`)
+	assert.Contains(t, w.Body.String(), `nest_thermostat_info{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",name="enterprises/PROJECT_ID/devices/DEVICE_ID",room="Living Room",structure="Home",type="THERMOSTAT"} 1`)
+}
+
+func TestNestV2MetricNames(t *testing.T) {
+	weatherToken := ""
+	v2MetricNames := true
+	nestServ := test.NestServer()
+
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.WeatherToken = &weatherToken
+	cfg.NestV2MetricNames = &v2MetricNames
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+
+	exporter.Handler().ServeHTTP(w, req)
+
+	labels := `{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room",structure="Home"}`
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Contains(t, w.Body.String(), `nest_sdm_up 1`)
+	assert.Contains(t, w.Body.String(), `nest_thermostat_online`+labels+` 1`)
+	assert.Contains(t, w.Body.String(), `nest_thermostat_ambient_temperature_celsius`+labels+` 20.23999`)
+	assert.Contains(t, w.Body.String(), `nest_thermostat_humidity_ratio`+labels+` 0.57`)
+	assert.Contains(t, w.Body.String(), `nest_thermostat_heating`+labels+` 0`)
+	assert.NotContains(t, w.Body.String(), `nest_up `)
+	assert.NotContains(t, w.Body.String(), `nest_online{`)
+	assert.Contains(t, w.Body.String(), `nest_thermostat_setpoint_temperature_celsius{id="enterprises/PROJECT_ID/devices/DEVICE_ID",label="Custom Name",room="Living Room",structure="Home",type="heat"} 19.17838`)
+	assert.NotContains(t, w.Body.String(), `nest_setpoint_temperature_celsius`)
+}
+
+func TestMetricTimestamps(t *testing.T) {
+	metricTimestamps := true
+	nestServ := test.NestServer()
+	weatherServ := test.WeatherServerMetric()
+
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.WeatherURL = &weatherServ.URL
+	cfg.MetricTimestamps = &metricTimestamps
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+
+	exporter.Handler().ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Contains(t, w.Body.String(), "nest_weather_up 1\n")
+	assert.Contains(t, w.Body.String(), "nest_weather_temperature_celsius 20.26 1594992007000")
+}
+
+func TestMultipleNestProjects(t *testing.T) {
+	weatherToken := ""
+	nestServ := test.NestServer()
+	projects := []string{"second,dummy,dummy,dummy"}
+
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.NestProjects = &projects
+	cfg.WeatherToken = &weatherToken
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+
+	exporter.Handler().ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Contains(t, w.Body.String(), `nest_up{project="dummy"} 1`)
+	assert.Contains(t, w.Body.String(), `nest_up{project="second"} 1`)
+}
+
+func TestInvalidNestProject(t *testing.T) {
+	projects := []string{"second,dummy"}
+
+	cfg := testConfig()
+	cfg.NestProjects = &projects
+
+	_, err := NewExporter(cfg)
+	assert.ErrorIs(t, err, errInvalidNestProject)
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	enabled, disabled := true, false
+	weatherToken := ""
+	nestServ := test.NestServer()
+
+	tests := []struct {
+		name           string
+		goMetrics      *bool
+		processMetrics *bool
+		want           []string
+		wantNot        []string
+	}{
+		{
+			name: "default",
+			want: []string{"go_goroutines", "process_cpu_seconds_total"},
+		},
+		{
+			name:           "Go metrics only",
+			goMetrics:      &enabled,
+			processMetrics: &disabled,
+			want:           []string{"go_goroutines"},
+			wantNot:        []string{"process_cpu_seconds_total"},
+		},
+		{
+			name:           "none",
+			goMetrics:      &disabled,
+			processMetrics: &disabled,
+			wantNot:        []string{"go_goroutines", "process_cpu_seconds_total"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.NestURL = &nestServ.URL
+			cfg.WeatherToken = &weatherToken
+			cfg.GoMetrics = test.goMetrics
+			cfg.ProcessMetrics = test.processMetrics
+
+			exporter, err := NewExporter(cfg)
+			assert.NoError(t, err)
+
+			body := scrape(exporter)
+			assert.Contains(t, body, "nest_up 1")
+			for _, metric := range test.want {
+				assert.Contains(t, body, metric)
+			}
+			for _, metric := range test.wantNot {
+				assert.NotContains(t, body, metric)
+			}
+		})
+	}
+}
+
+func TestMetricPrefix(t *testing.T) {
+	nestServ := test.NestServer()
+	weatherServ := test.WeatherServerMetric()
+
+	prefix := "home_"
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.WeatherURL = &weatherServ.URL
+	cfg.MetricPrefix = &prefix
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+
+	body := scrape(exporter)
+	assert.Contains(t, body, "\nhome_nest_up 1")
+	assert.Contains(t, body, "\nhome_nest_weather_up 1")
+	assert.NotContains(t, body, "\nnest_up 1")
+	// The runtime metrics keep their names.
+	assert.Contains(t, body, "\ngo_goroutines ")
+
+	invalid := "home-"
+	cfg.MetricPrefix = &invalid
+	_, err = NewExporter(cfg)
+	assert.ErrorIs(t, err, errInvalidMetricPrefix)
+}
+
+func TestConstLabels(t *testing.T) {
+	nestServ := test.NestServer()
+	weatherServ := test.WeatherServerMetric()
+
+	labels := []string{"house=main", "site=cabin"}
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.WeatherURL = &weatherServ.URL
+	cfg.ConstLabels = &labels
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+
+	body := scrape(exporter)
+	assert.Contains(t, body, `nest_up{house="main",site="cabin"} 1`)
+	assert.Contains(t, body, `nest_weather_up{house="main",site="cabin"} 1`)
+	assert.Contains(t, body, `go_goroutines{house="main",site="cabin"} `)
+
+	for _, invalid := range []string{"house", "1house=main", "__house=main"} {
+		labels := []string{invalid}
+		cfg.ConstLabels = &labels
+		_, err = NewExporter(cfg)
+		assert.ErrorIs(t, err, errInvalidConstLabel, invalid)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	unset, nestTimeout := 0, 20000
+
+	cfg := testConfig()
+	cfg.NestTimeout = &nestTimeout
+	cfg.WeatherTimeout = &unset
+
+	assert.Equal(t, 20000, cfg.timeout(cfg.NestTimeout))
+	assert.Equal(t, 5000, cfg.timeout(cfg.WeatherTimeout))
+	assert.Equal(t, 5000, cfg.timeout(cfg.NestAppAuthTimeout))
+}
+
+func TestWeatherProviderLabelOneEnabled(t *testing.T) {
+	nestServ := test.NestServer()
+	weatherServ := test.WeatherServerMetric()
+
+	// WeatherAPI.com is skipped without a key, leaving OpenWeatherMap alone.
+	providers := []string{"openweathermap", "weatherapi"}
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.WeatherURL = &weatherServ.URL
+	cfg.WeatherProvider = &providers
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+
+	body := scrape(exporter)
+	assert.Contains(t, body, "\nnest_weather_up 1")
+	assert.NotContains(t, body, `provider="`)
+}
+
+func TestHandler(t *testing.T) {
+	nestServ := test.NestServer()
+	weatherServ := test.WeatherServerMetric()
+
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.WeatherURL = &weatherServ.URL
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{path: "/", wantCode: http.StatusOK, wantBody: `<a href="/metrics">Metrics</a>`},
+		{path: "/metrics", wantCode: http.StatusOK, wantBody: "nest_up 1"},
+		// Not registered until a reload function is given.
+		{path: "/-/reload", wantCode: http.StatusOK, wantBody: "ProNestheus"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			exporter.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			assert.Equal(t, test.wantCode, w.Code)
+			assert.Contains(t, w.Body.String(), test.wantBody)
+
+			// Nothing is registered with the default mux.
+			_, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodGet, test.path, nil))
+			assert.Empty(t, pattern)
+		})
+	}
+
+	exporter.ReloadWith(func() (*ExporterConfig, error) { return cfg, nil })
+	w := httptest.NewRecorder()
+	exporter.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestWebConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+
+	tests := []struct {
+		name      string
+		webConfig string
+		wantErr   bool
+	}{
+		{
+			name:      "TLS",
+			webConfig: "tls_server_config:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n",
+		},
+		{
+			name:      "missing key",
+			webConfig: "tls_server_config:\n  cert_file: " + certFile + "\n  key_file: " + filepath.Join(dir, "missing.key") + "\n",
+			wantErr:   true,
+		},
+		{
+			name:      "client certificates",
+			webConfig: "tls_server_config:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n  client_auth_type: RequireAndVerifyClientCert\n  client_ca_file: " + certFile + "\n",
+		},
+		{
+			name:      "basic auth",
+			webConfig: "basic_auth_users:\n  prometheus: $2a$10$ZmqPAjn8T9IPhJvW9MDswey/qRHmvERrLJSlOEMvzYvBBdeMQMhiu\n",
+		},
+		{
+			name:      "basic auth with plain text password",
+			webConfig: "basic_auth_users:\n  prometheus: secret\n",
+			wantErr:   true,
+		},
+		{
+			name:      "unknown field",
+			webConfig: "tls_config: {}\n",
+			wantErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			webConfigFile := filepath.Join(dir, "web.yml")
+			assert.NoError(t, os.WriteFile(webConfigFile, []byte(test.webConfig), 0600))
+
+			apiURL := "https://example.com"
+
+			cfg := testConfig()
+			cfg.NestURL = &apiURL
+			cfg.WeatherURL = &apiURL
+			cfg.WebConfigFile = &webConfigFile
+
+			exporter, err := NewExporter(cfg)
+			if test.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, webConfigFile, exporter.webConfigFile)
+			}
+		})
+	}
+}
+
+func TestWeatherLocationWithoutNestApp(t *testing.T) {
+	apiURL := "https://example.com"
+	locationFromNest := true
+
+	cfg := testConfig()
+	cfg.NestURL = &apiURL
+	cfg.WeatherURL = &apiURL
+	cfg.WeatherLocationNest = &locationFromNest
+
+	_, err := NewExporter(cfg)
+	assert.ErrorIs(t, err, errWeatherLocationNoNestApp)
+}
+
+func TestWeatherLocation(t *testing.T) {
+	tests := []struct {
+		name         string
+		coordinates  string
+		city         string
+		wantLocation weather.Location
+		wantFound    bool
+		wantErr      error
+	}{
+		{
+			name: "location ID",
+		}, {
+			name:         "coordinates",
+			coordinates:  "52.3731, 4.8922",
+			city:         "Rotterdam",
+			wantLocation: weather.Location{Latitude: 52.3731, Longitude: 4.8922},
+			wantFound:    true,
+		}, {
+			name:        "invalid coordinates",
+			coordinates: "52.3731",
+			wantErr:     errInvalidWeatherCoords,
+		}, {
+			name:        "invalid latitude",
+			coordinates: "north,4.8922",
+			wantErr:     errInvalidWeatherCoords,
+		}, {
+			name:         "city",
+			city:         "Amsterdam,NL",
+			wantLocation: weather.Location{Latitude: math.NaN(), Longitude: math.NaN(), City: "Amsterdam,NL"},
+			wantFound:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.WeatherCoordinates = &test.coordinates
+			cfg.WeatherCity = &test.city
+
+			location, found, err := weatherLocation(cfg)
+			if test.wantErr != nil {
+				assert.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.wantFound, found)
+			if found {
+				assert.Equal(t, test.wantLocation.City, location.City)
+				if math.IsNaN(test.wantLocation.Latitude) {
+					assert.True(t, math.IsNaN(location.Latitude))
+					assert.True(t, math.IsNaN(location.Longitude))
+				} else {
+					assert.Equal(t, test.wantLocation.Latitude, location.Latitude)
+					assert.Equal(t, test.wantLocation.Longitude, location.Longitude)
+				}
+			}
+		})
+	}
+}
+
 func testConfig() *ExporterConfig {
 	listenAddr := ":9999"
 	metricsPath := "/metrics"
@@ -112,10 +601,27 @@ func testConfig() *ExporterConfig {
 	}
 }
 
-// resetRegistry resets the default registry of Prometheus after each test.
-// Without it, subsequent tests will fail because metrics were already registered in previous tests.
-func resetRegistry() {
-	reg := prometheus.NewRegistry()
-	prometheus.DefaultRegisterer = reg
-	prometheus.DefaultGatherer = reg
+// writeCertificate writes a self-signed certificate for localhost and its key to the given directory.
+func writeCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600))
+	return certFile, keyFile
 }
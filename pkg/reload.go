@@ -0,0 +1,326 @@
+package pkg
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"pronestheus/pkg/collectors/nestapp"
+)
+
+// Names of the groups of collectors which are registered, and reloaded, together.
+const (
+	runtimeGroup = "runtime"
+	nestGroup    = "nest"
+	nestAppGroup = "nestapp"
+	weatherGroup = "weather"
+)
+
+// allCollectorGroups are the collector groups in the order they're registered in. The weather collectors may depend
+// on the Nest app collector for their location.
+var allCollectorGroups = []string{runtimeGroup, nestGroup, nestAppGroup, weatherGroup}
+
+// collectorGroup is a prometheus.Registerer which collects the collectors of a group, so that they can all be
+// registered with the registry of the exporter at once, and unregistered on reload. Closing done stops their
+// background work.
+type collectorGroup struct {
+	registerer prometheus.Registerer
+	collectors []prometheus.Collector
+	done       chan struct{}
+	// nestApp is the Nest app collector of the nestapp group, if any.
+	nestApp *nestapp.Collector
+}
+
+func newCollectorGroup(registerer prometheus.Registerer) *collectorGroup {
+	return &collectorGroup{registerer: registerer, done: make(chan struct{})}
+}
+
+// Register implements prometheus.Registerer. The collector is only registered with the registry by registerAll.
+func (g *collectorGroup) Register(c prometheus.Collector) error {
+	g.collectors = append(g.collectors, c)
+	return nil
+}
+
+// MustRegister implements prometheus.Registerer.
+func (g *collectorGroup) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := g.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Unregister implements prometheus.Registerer.
+func (g *collectorGroup) Unregister(c prometheus.Collector) bool {
+	for i, registered := range g.collectors {
+		if registered == c {
+			g.collectors = append(g.collectors[:i], g.collectors[i+1:]...)
+			break
+		}
+	}
+	return g.registerer.Unregister(c)
+}
+
+// unregisterAll unregisters all collectors of the group, keeping track of them for registerAll.
+func (g *collectorGroup) unregisterAll() {
+	for _, c := range g.collectors {
+		g.registerer.Unregister(c)
+	}
+}
+
+// registerAll registers all collectors of the group with the registry. On failure, none of them is left registered.
+func (g *collectorGroup) registerAll() error {
+	for i, c := range g.collectors {
+		if err := g.registerer.Register(c); err != nil {
+			for _, registered := range g.collectors[:i] {
+				g.registerer.Unregister(registered)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// registerCollectors creates the collectors of the given groups and registers them in place of those of the groups
+// of the Exporter. The old collectors keep serving scrapes while the new ones are created, which may take network
+// requests; only then are they swapped, in one step for scrapes. On failure, the old collectors are kept.
+func (e *Exporter) registerCollectors(cfg *ExporterConfig, names []string) error {
+	groups, err := e.newCollectorGroups(cfg, names)
+	if err != nil {
+		return err
+	}
+	if err := e.swapCollectorGroups(groups); err != nil {
+		for _, group := range groups {
+			close(group.done)
+		}
+		return err
+	}
+	e.cfg = cfg
+	return nil
+}
+
+// newCollectorGroups creates the collectors of the given groups, without registering them.
+func (e *Exporter) newCollectorGroups(cfg *ExporterConfig, names []string) (map[string]*collectorGroup, error) {
+	labelSanitizer, err := newLabelSanitizer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	labeledRegisterer, err := constLabelsRegisterer(cfg, e.registry)
+	if err != nil {
+		return nil, err
+	}
+	registerer, err := metricsRegisterer(cfg, labeledRegisterer)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string]*collectorGroup{}
+	for _, name := range names {
+		if name == runtimeGroup {
+			groups[name] = newCollectorGroup(labeledRegisterer)
+		} else {
+			groups[name] = newCollectorGroup(registerer)
+		}
+	}
+
+	var nestAppCollector *nestapp.Collector
+	if old, ok := e.groups[nestAppGroup]; ok {
+		nestAppCollector = old.nestApp
+	}
+	if group, ok := groups[runtimeGroup]; ok {
+		registerRuntimeCollectors(cfg, group)
+	}
+	if group, ok := groups[nestGroup]; ok && err == nil {
+		err = registerNestCollector(cfg, labelSanitizer, group)
+	}
+	if group, ok := groups[nestAppGroup]; ok && err == nil {
+		nestAppCollector, err = registerNestAppCollector(cfg, labelSanitizer, group)
+		group.nestApp = nestAppCollector
+	}
+	if group, ok := groups[weatherGroup]; ok && err == nil {
+		err = registerWeatherCollectors(cfg, nestAppCollector, group)
+	}
+	if err != nil {
+		for _, group := range groups {
+			close(group.done)
+		}
+		return nil, err
+	}
+	return groups, nil
+}
+
+// swapCollectorGroups unregisters the collectors of the groups of the Exporter which the given groups replace, and
+// registers those of the given groups instead. Scrapes see either the old or the new collectors, never neither. If
+// the new collectors can't be registered, the old ones are registered again.
+func (e *Exporter) swapCollectorGroups(groups map[string]*collectorGroup) error {
+	e.registryMu.Lock()
+	defer e.registryMu.Unlock()
+
+	for name := range groups {
+		if old, ok := e.groups[name]; ok {
+			old.unregisterAll()
+		}
+	}
+
+	var registered []*collectorGroup
+	for _, name := range allCollectorGroups {
+		group, ok := groups[name]
+		if !ok {
+			continue
+		}
+		if err := group.registerAll(); err != nil {
+			for _, group := range registered {
+				group.unregisterAll()
+			}
+			for name := range groups {
+				if old, ok := e.groups[name]; ok {
+					if err := old.registerAll(); err != nil {
+						e.logger.Log("level", "error", "msg", "Failed restoring collectors after failed reload", "err", err)
+					}
+				}
+			}
+			return err
+		}
+		registered = append(registered, group)
+	}
+
+	for name, group := range groups {
+		e.groups[name] = group
+	}
+	return nil
+}
+
+// ReloadWith makes the exporter reload its configuration from the given function on SIGHUP and on POST requests to
+// /-/reload.
+func (e *Exporter) ReloadWith(loadConfig func() (*ExporterConfig, error)) {
+	if e.loadConfig == nil {
+		e.mux.HandleFunc("/-/reload", e.handleReload)
+	}
+	e.loadConfig = loadConfig
+}
+
+// Reload replaces the collectors whose configuration changed with ones created from the given configuration. The old
+// collectors serve scrapes until the new ones are created and registered. If the new collectors can't be created or
+// registered, the old ones are kept.
+// The listen address, metrics path and web config file only change on restart.
+func (e *Exporter) Reload(cfg *ExporterConfig) error {
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
+
+	if *cfg.ListenAddr != e.listenAddr || !reflect.DeepEqual(cfg.ListenSocketMode, e.cfg.ListenSocketMode) ||
+		*cfg.MetricsPath != e.metricsPath || !reflect.DeepEqual(cfg.WebConfigFile, e.cfg.WebConfigFile) {
+		e.logger.Log("level", "warn", "msg", "Changes of the listen address, metrics path and web config file need a restart")
+	}
+
+	names := changedCollectorGroups(e.cfg, cfg)
+	if len(names) == 0 {
+		e.logger.Log("level", "info", "msg", "Configuration unchanged, nothing to reload")
+		return nil
+	}
+
+	old := map[string]*collectorGroup{}
+	for _, name := range names {
+		if group, ok := e.groups[name]; ok {
+			old[name] = group
+		}
+	}
+
+	if err := e.registerCollectors(cfg, names); err != nil {
+		return err
+	}
+
+	for _, group := range old {
+		close(group.done)
+	}
+	e.logger.Log("level", "info", "msg", "Reloaded configuration", "collectors", strings.Join(names, ","))
+	return nil
+}
+
+// changedCollectorGroups returns the collector groups whose configuration differs between the given configurations,
+// in registration order. The fields of ExporterConfig belong to the groups by their prefixes; the others, such as
+// the temperature unit, to all groups but the runtime collectors. The constant labels belong to all groups.
+func changedCollectorGroups(old, new *ExporterConfig) []string {
+	changed := map[string]bool{}
+	oldValue, newValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		if reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+
+		name := oldValue.Type().Field(i).Name
+		switch {
+		case name == "ListenAddr" || name == "ListenSocketMode" || name == "MetricsPath" || name == "WebConfigFile":
+		case strings.HasPrefix(name, "NestApp") || strings.HasPrefix(name, "NestGoogle"):
+			changed[nestAppGroup] = true
+		case strings.HasPrefix(name, "Nest"):
+			changed[nestGroup] = true
+		case strings.HasPrefix(name, "Weather"):
+			changed[weatherGroup] = true
+		case name == "GoMetrics" || name == "ProcessMetrics":
+			changed[runtimeGroup] = true
+		case name == "ConstLabels":
+			for _, group := range allCollectorGroups {
+				changed[group] = true
+			}
+		default:
+			// Settings such as the temperature unit don't concern the runtime collectors.
+			for _, group := range allCollectorGroups {
+				if group != runtimeGroup {
+					changed[group] = true
+				}
+			}
+		}
+	}
+
+	// The weather collectors may hold on to the Nest app collector for their location.
+	if changed[nestAppGroup] {
+		changed[weatherGroup] = true
+	}
+
+	var names []string
+	for _, group := range allCollectorGroups {
+		if changed[group] {
+			names = append(names, group)
+		}
+	}
+	return names
+}
+
+// reload reloads the configuration from the function given to ReloadWith.
+func (e *Exporter) reload() error {
+	cfg, err := e.loadConfig()
+	if err != nil {
+		return err
+	}
+	return e.Reload(cfg)
+}
+
+// reloadOnSignal reloads the configuration on every SIGHUP.
+func (e *Exporter) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := e.reload(); err != nil {
+			e.logger.Log("level", "error", "msg", "Failed reloading configuration", "err", err)
+		}
+	}
+}
+
+// handleReload reloads the configuration on POST requests.
+func (e *Exporter) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests reload the configuration.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := e.reload(); err != nil {
+		e.logger.Log("level", "error", "msg", "Failed reloading configuration", "err", err)
+		http.Error(w, "Failed reloading configuration: "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"pronestheus/test"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	nestServ := test.NestServer()
+	weatherServ := test.WeatherServerMetric()
+
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.WeatherURL = &weatherServ.URL
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+	assert.Contains(t, scrape(exporter), "nest_weather_up 1")
+	nestCollectors := exporter.groups[nestGroup]
+
+	// Only the weather collector is replaced.
+	invalidWeatherURL := test.WeatherServerInvalidToken().URL
+	reloaded := *cfg
+	reloaded.WeatherURL = &invalidWeatherURL
+	assert.NoError(t, exporter.Reload(&reloaded))
+	body := scrape(exporter)
+	assert.Contains(t, body, "nest_up 1")
+	assert.Contains(t, body, "nest_weather_up 0")
+	assert.Same(t, nestCollectors, exporter.groups[nestGroup])
+
+	// A failed reload keeps the collectors.
+	projects := []string{"invalid"}
+	failed := reloaded
+	failed.NestProjects = &projects
+	assert.True(t, errors.Is(exporter.Reload(&failed), errInvalidNestProject))
+	body = scrape(exporter)
+	assert.Contains(t, body, "nest_up 1")
+	assert.Contains(t, body, "nest_weather_up 0")
+	assert.Same(t, nestCollectors, exporter.groups[nestGroup])
+}
+
+func TestScrapeDuringReload(t *testing.T) {
+	nestServ := test.NestServer()
+	weatherServ := test.WeatherServerMetric()
+
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.WeatherURL = &weatherServ.URL
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+
+	// The old collectors serve scrapes while the new ones are created.
+	invalidWeatherURL := test.WeatherServerInvalidToken().URL
+	reloaded := *cfg
+	reloaded.WeatherURL = &invalidWeatherURL
+	groups, err := exporter.newCollectorGroups(&reloaded, []string{weatherGroup})
+	assert.NoError(t, err)
+	assert.Contains(t, scrape(exporter), "nest_weather_up 1")
+	assert.NoError(t, exporter.swapCollectorGroups(groups))
+	assert.Contains(t, scrape(exporter), "nest_weather_up 0")
+	exporter.cfg = &reloaded
+
+	// Scrapes while the Nest and weather collectors are replaced over and over still get their metrics.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			timeout := 1000 + i
+			next := *cfg
+			next.NestTimeout = &timeout
+			next.WeatherTimeout = &timeout
+			assert.NoError(t, exporter.Reload(&next))
+		}
+	}()
+	for scrapes := 0; ; scrapes++ {
+		select {
+		case <-done:
+			assert.Greater(t, scrapes, 0)
+			return
+		default:
+		}
+		body := scrape(exporter)
+		assert.Contains(t, body, "nest_up 1")
+		assert.Contains(t, body, "\nnest_weather_up ")
+	}
+}
+
+func TestChangedCollectorGroups(t *testing.T) {
+	fahrenheit, subscribe, disabled, token := "fahrenheit", true, false, "token"
+	labels := []string{"house=main"}
+
+	tests := []struct {
+		name   string
+		change func(cfg *ExporterConfig)
+		want   []string
+	}{
+		{
+			name:   "unchanged",
+			change: func(cfg *ExporterConfig) {},
+		}, {
+			name:   "temperature unit",
+			change: func(cfg *ExporterConfig) { cfg.TemperatureUnit = &fahrenheit },
+			want:   []string{nestGroup, nestAppGroup, weatherGroup},
+		}, {
+			name:   "Nest refresh token",
+			change: func(cfg *ExporterConfig) { cfg.NestRefreshToken = &token },
+			want:   []string{nestGroup},
+		}, {
+			name:   "Nest app",
+			change: func(cfg *ExporterConfig) { cfg.NestAppSubscribe = &subscribe },
+			want:   []string{nestAppGroup, weatherGroup},
+		}, {
+			name:   "weather token",
+			change: func(cfg *ExporterConfig) { cfg.WeatherToken = &token },
+			want:   []string{weatherGroup},
+		}, {
+			name:   "Go metrics",
+			change: func(cfg *ExporterConfig) { cfg.GoMetrics = &disabled },
+			want:   []string{runtimeGroup},
+		}, {
+			name:   "constant labels",
+			change: func(cfg *ExporterConfig) { cfg.ConstLabels = &labels },
+			want:   allCollectorGroups,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			old, new := testConfig(), testConfig()
+			test.change(new)
+			assert.Equal(t, test.want, changedCollectorGroups(old, new))
+		})
+	}
+}
+
+func TestReloadEndpoint(t *testing.T) {
+	weatherToken := ""
+	nestServ := test.NestServer()
+	cfg := testConfig()
+	cfg.NestURL = &nestServ.URL
+	cfg.WeatherToken = &weatherToken
+
+	exporter, err := NewExporter(cfg)
+	assert.NoError(t, err)
+	loads := 0
+	exporter.ReloadWith(func() (*ExporterConfig, error) {
+		loads++
+		return cfg, nil
+	})
+
+	w := httptest.NewRecorder()
+	exporter.handleReload(w, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	exporter.handleReload(w, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, loads)
+}
+
+// scrape returns the metrics of the exporter.
+func scrape(exporter *Exporter) string {
+	w := httptest.NewRecorder()
+	exporter.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return w.Body.String()
+}
@@ -0,0 +1,63 @@
+package sanitize
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errInvalidRule = errors.New("invalid label replace rule; expected <regex>=<replacement>")
+
+// Sanitizer rewrites label values, such as room and structure names, so that they stay consistent regardless of how
+// they were named in the Nest app.
+type Sanitizer struct {
+	rules     []rule
+	lowercase bool
+}
+
+// rule replaces all matches of the pattern with the replacement.
+type rule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// New creates a Sanitizer from replace rules of the form <regex>=<replacement>, applied in the given order. The
+// replacement can refer to capture groups of the regex, e.g. $1. If lowercase is set, values are lowercased after
+// applying the rules.
+func New(rules []string, lowercase bool) (*Sanitizer, error) {
+	sanitizer := &Sanitizer{lowercase: lowercase}
+
+	for _, rawRule := range rules {
+		i := strings.LastIndex(rawRule, "=")
+		if i <= 0 {
+			return nil, errors.Wrap(errInvalidRule, rawRule)
+		}
+
+		pattern, err := regexp.Compile(rawRule[:i])
+		if err != nil {
+			return nil, errors.Wrap(errInvalidRule, err.Error())
+		}
+
+		sanitizer.rules = append(sanitizer.rules, rule{pattern: pattern, replacement: rawRule[i+1:]})
+	}
+
+	return sanitizer, nil
+}
+
+// Sanitize returns the sanitized label value. A nil Sanitizer returns the value unchanged.
+func (s *Sanitizer) Sanitize(value string) string {
+	if s == nil {
+		return value
+	}
+
+	for _, r := range s.rules {
+		value = r.pattern.ReplaceAllString(value, r.replacement)
+	}
+
+	if s.lowercase {
+		value = strings.ToLower(value)
+	}
+
+	return value
+}
@@ -0,0 +1,68 @@
+package sanitize
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []string
+		lowercase bool
+		value     string
+		want      string
+		wantErr   error
+	}{
+		{
+			name:  "no rules",
+			value: "Living Room",
+			want:  "Living Room",
+		}, {
+			name:  "spaces to dashes",
+			rules: []string{" =-"},
+			value: "Master Bed Room",
+			want:  "Master-Bed-Room",
+		}, {
+			name:      "rules in order and lowercase",
+			rules:     []string{`\s+=_`, `[^A-Za-z0-9_]=`},
+			lowercase: true,
+			value:     "Kid's  Room (2)",
+			want:      "kids_room_2",
+		}, {
+			name:  "capture groups",
+			rules: []string{`^(\w+) Room$=room-$1`},
+			value: "Living Room",
+			want:  "room-Living",
+		}, {
+			name:    "missing replacement",
+			rules:   []string{"Room"},
+			wantErr: errInvalidRule,
+		}, {
+			name:    "invalid regex",
+			rules:   []string{"(Room=Space"},
+			wantErr: errInvalidRule,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := New(test.rules, test.lowercase)
+
+			if test.wantErr != nil {
+				assert.Nil(t, s)
+				assert.True(t, errors.Is(err, test.wantErr))
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, s.Sanitize(test.value), test.want)
+			}
+		})
+	}
+}
+
+func TestNilSanitizer(t *testing.T) {
+	var s *Sanitizer
+	assert.Equal(t, s.Sanitize("Living Room"), "Living Room")
+}
@@ -0,0 +1,45 @@
+package pkg
+
+import (
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// notifySystemd tells systemd that the exporter is ready and, if the unit has a WatchdogSec, keeps sending watchdog
+// keepalives at half the watchdog interval until done is closed. Without NOTIFY_SOCKET, e.g. when not run by a
+// Type=notify unit, it does nothing.
+func (e *Exporter) notifySystemd(done <-chan struct{}) {
+	sent, err := daemon.SdNotify(false, daemon.SdNotifyReady)
+	if err != nil {
+		e.logger.Log("level", "warn", "msg", "Failed notifying systemd", "err", err)
+		return
+	}
+	if !sent {
+		return
+	}
+
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		e.logger.Log("level", "warn", "msg", "Failed reading systemd watchdog interval", "err", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := daemon.SdNotify(false, daemon.SdNotifyWatchdog); err != nil {
+					e.logger.Log("level", "warn", "msg", "Failed sending systemd watchdog keepalive", "err", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
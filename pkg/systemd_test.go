@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifySystemd(t *testing.T) {
+	tests := []struct {
+		name         string
+		watchdogUsec string
+		want         []string
+	}{
+		{
+			name: "ready",
+			want: []string{"READY=1"},
+		},
+		{
+			name:         "watchdog",
+			watchdogUsec: "20000",
+			want:         []string{"READY=1", "WATCHDOG=1", "WATCHDOG=1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			socket := filepath.Join(t.TempDir(), "notify.sock")
+			conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			t.Setenv("NOTIFY_SOCKET", socket)
+			t.Setenv("WATCHDOG_USEC", test.watchdogUsec)
+
+			done := make(chan struct{})
+			defer close(done)
+			exporter := &Exporter{logger: log.NewNopLogger()}
+			exporter.notifySystemd(done)
+
+			buf := make([]byte, 64)
+			for _, want := range test.want {
+				assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+				n, err := conn.Read(buf)
+				assert.NoError(t, err)
+				assert.Equal(t, want, string(buf[:n]))
+			}
+
+			if test.watchdogUsec == "" {
+				assert.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+				_, err := conn.Read(buf)
+				assert.Error(t, err, "no watchdog keepalives expected")
+			}
+		})
+	}
+}
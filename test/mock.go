@@ -1,12 +1,15 @@
 package test
 
 import (
+	"compress/gzip"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -28,6 +31,80 @@ func WeatherServerImperial() *httptest.Server {
 	}))
 }
 
+// WeatherServerOneCall returns a mock OpenWeatherMap server which returns valid responses with temperature in Celsius
+// for the current weather at /weather, the One Call API at /onecall and the forecast API at /forecast.
+func WeatherServerOneCall() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/weather", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, readFile(filepath.Join("weather_metric.json")))
+	})
+	mux.HandleFunc("/onecall", func(w http.ResponseWriter, r *http.Request) {
+		// The One Call API only knows locations by their coordinates.
+		if r.URL.Query().Get("lat") != "52.37" || r.URL.Query().Get("lon") != "4.89" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, readFile(filepath.Join("weather_onecall.json")))
+	})
+	mux.HandleFunc("/forecast", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("lat") != "52.37" || r.URL.Query().Get("lon") != "4.89" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, readFile(filepath.Join("weather_forecast.json")))
+	})
+	return httptest.NewServer(mux)
+}
+
+// WeatherServerGeocoding returns a mock OpenWeatherMap geocoding server which knows only Amsterdam.
+func WeatherServerGeocoding() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if !strings.HasPrefix(r.URL.Query().Get("q"), "Amsterdam") {
+			fmt.Fprintln(w, "[]")
+			return
+		}
+		fmt.Fprintln(w, readFile(filepath.Join("weather_geocoding.json")))
+	}))
+}
+
+// WeatherServerMetNo returns a mock MET Norway Locationforecast server which returns a valid response for requests
+// identifying themselves.
+func WeatherServerMetNo() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.UserAgent() == "" || strings.HasPrefix(r.UserAgent(), "Go-http-client") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Query().Get("lat") != "52.3731" || r.URL.Query().Get("lon") != "4.8922" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, readFile(filepath.Join("weather_metno.json")))
+	}))
+}
+
+// WeatherServerWeatherAPI returns a mock WeatherAPI.com current weather server which returns a valid response for
+// requests with a key.
+func WeatherServerWeatherAPI() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("q") != "52.37312,4.89221" && r.URL.Query().Get("q") != "Amsterdam" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, readFile(filepath.Join("weather_weatherapi.json")))
+	}))
+}
+
 // WeatherServerMissingID returns a mock OpenWeatherMap server which returns an error due to missing location ID.
 func WeatherServerMissingID() *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -52,14 +129,45 @@ func WeatherServerInvalidResponse() *httptest.Server {
 	}))
 }
 
-// NestServer returns a mock Nest server which returns a valid response.
+// NestServer returns a mock Nest server which returns a valid response for devices and structures.
 func NestServer() *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
+		if strings.Contains(r.URL.Path, "/structures") {
+			fmt.Fprintln(w, readFile(filepath.Join("nest_structures.json")))
+			return
+		}
 		fmt.Fprintln(w, readFile(filepath.Join("nest_valid.json")))
 	}))
 }
 
+// NestServerPaginated returns a mock Nest server which returns the devices list split into two pages.
+func NestServerPaginated() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		switch {
+		case strings.Contains(r.URL.Path, "/structures"):
+			fmt.Fprintln(w, readFile(filepath.Join("nest_structures.json")))
+		case r.URL.Query().Get("pageToken") == "PAGE_2":
+			fmt.Fprintln(w, readFile(filepath.Join("nest_page_2.json")))
+		default:
+			fmt.Fprintln(w, readFile(filepath.Join("nest_page_1.json")))
+		}
+	}))
+}
+
+// NestServerMalformedDevice returns a mock Nest server which returns one valid and one malformed thermostat.
+func NestServerMalformedDevice() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if strings.Contains(r.URL.Path, "/structures") {
+			fmt.Fprintln(w, readFile(filepath.Join("nest_structures.json")))
+			return
+		}
+		fmt.Fprintln(w, readFile(filepath.Join("nest_malformed_device.json")))
+	}))
+}
+
 // NestServerInvalidToken returns a mock Nest server which returns an error due to invalid authentication token.
 func NestServerInvalidToken() *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -68,6 +176,31 @@ func NestServerInvalidToken() *httptest.Server {
 	}))
 }
 
+// NestServerStructuresUnavailable returns a mock Nest server which lists the devices, but fails to list the structures.
+func NestServerStructuresUnavailable() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/structures") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, readFile(filepath.Join("nest_unavailable.json")))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, readFile(filepath.Join("nest_valid.json")))
+	}))
+}
+
+// NestServerRateLimited returns a mock Nest server which rejects requests due to rate limiting, asking to retry after
+// two minutes. The returned counter is incremented with each request.
+func NestServerRateLimited() (*httptest.Server, *int32) {
+	var requests int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintln(w, readFile(filepath.Join("nest_rate_limited.json")))
+	})), &requests
+}
+
 // NestServerInvalidResponse returns a mock Nest server which returns an invalid JSON response.
 func NestServerInvalidResponse() *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -76,6 +209,62 @@ func NestServerInvalidResponse() *httptest.Server {
 	}))
 }
 
+// NestAppServer returns a mock server for the Nest app API and its authentication: the Google auth URL at /auth, the
+// Nest auth proxy at /issue_jwt and the API itself, including the subscription to updates, at the root. The Google
+// auth URL only accepts the given cookies.
+func NestAppServer(cookies string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cookie") != cookies {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintln(w, `{"error": "USER_LOGGED_OUT", "detail": "No active session found."}`)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"access_token": "google token", "token_type": "Bearer", "expires_in": "3599"}`)
+	})
+	mux.HandleFunc("/issue_jwt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer google token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, `{"error": "UNAUTHENTICATED", "error_description": "Invalid Google access token."}`)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, readFile("nestapp_issue_jwt.json"), time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	})
+	mux.HandleFunc("/api/0.1/user/USER_ID/app_launch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Basic nest jwt" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body := strings.ReplaceAll(readFile("nestapp_app_launch.json"), "TRANSPORT_HOST", r.Host)
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusOK)
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			fmt.Fprintln(gz, body)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, body)
+	})
+	mux.HandleFunc("/v6/subscribe", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Basic nest jwt" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, readFile("nestapp_subscribe.json"))
+	})
+	return httptest.NewServer(mux)
+}
+
+// NestAppLaunch returns the body of a mock Nest app API app_launch response.
+func NestAppLaunch() []byte {
+	return []byte(readFile("nestapp_app_launch.json"))
+}
+
 // readFile returns contents of a file from the testdata folder.
 //
 // `go test` always executes tests with working directory set to the source of the package being tested.